@@ -0,0 +1,273 @@
+// Package actiontemplate fills in placeholders of game actions like "TWI_SetHP {arg1:int:1..100:50}".
+//
+// A placeholder has the form {name[:type[:range[:default]]]}.
+//   - name is one of user, input, bits, args (all arguments), argN (the N-th argument, starting at 1)
+//     or remaining (seconds until a cooldown is over)
+//   - type is either int or string, it defaults to string
+//   - range is min..max, either side may be omitted. For strings it limits the length.
+//   - default is used when the value is missing, otherwise the invocation is rejected
+//
+// Use {{ and }} for literal braces. Braces that do not enclose a placeholder, like a single "{" or "}", are kept as they are.
+package actiontemplate
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var ErrInvalidTemplate = errors.New("invalid template")
+
+// Vars are the values available to placeholders
+type Vars struct {
+	// User is the name of the chatter, redeemer or cheerer
+	User string
+	// Input is the text entered by the user, for chat commands all arguments
+	Input string
+	Bits  int
+	Args  []string
+	// Remaining is the time until the cooldown of the command is over
+	Remaining time.Duration
+}
+
+// Error describes why a value was rejected
+type Error struct {
+	Placeholder string
+	Reason      string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Placeholder, e.Reason)
+}
+
+type valueType int
+
+const (
+	typeString valueType = iota
+	typeInt
+)
+
+type placeholder struct {
+	raw    string
+	name   string
+	arg    int
+	typ    valueType
+	min    *int
+	max    *int
+	defVal *string
+}
+
+// Template is a parsed action, placeholders[i] follows literals[i]
+type Template struct {
+	literals     []string
+	placeholders []*placeholder
+}
+
+// Parse parses s and validates all placeholders and their defaults.
+func Parse(s string) (*Template, error) {
+	t := &Template{}
+	var literal strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"):
+			literal.WriteByte('{')
+			i++
+		case strings.HasPrefix(s[i:], "}}"):
+			literal.WriteByte('}')
+			i++
+		case s[i] == '{':
+			// a "{" without "}" before the next "{" is literal text
+			end := strings.IndexAny(s[i+1:], "{}") + 1
+			if end == 0 || s[i+end] == '{' {
+				literal.WriteByte('{')
+				continue
+			}
+			p, err := parsePlaceholder(s[i : i+end+1])
+			if err != nil {
+				return nil, err
+			}
+			t.literals = append(t.literals, literal.String())
+			t.placeholders = append(t.placeholders, p)
+			literal.Reset()
+			i += end
+		default:
+			literal.WriteByte(s[i])
+		}
+	}
+	t.literals = append(t.literals, literal.String())
+	return t, nil
+}
+
+func parsePlaceholder(raw string) (*placeholder, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w: %s %s", ErrInvalidTemplate, raw, reason)
+	}
+
+	fields := strings.SplitN(raw[1:len(raw)-1], ":", 4)
+	p := &placeholder{raw: raw, name: strings.TrimSpace(fields[0])}
+	switch {
+	case p.name == "user" || p.name == "input" || p.name == "args":
+	case p.name == "bits" || p.name == "remaining":
+		p.typ = typeInt
+	case strings.HasPrefix(p.name, "arg"):
+		n, err := strconv.Atoi(p.name[3:])
+		if err != nil || n < 1 {
+			return nil, invalid("has an invalid argument number")
+		}
+		p.arg = n
+	default:
+		return nil, invalid("has an unknown name")
+	}
+
+	if len(fields) > 1 {
+		switch strings.TrimSpace(fields[1]) {
+		case "int":
+			p.typ = typeInt
+		case "string", "":
+			p.typ = typeString
+		default:
+			return nil, invalid("has an unknown type")
+		}
+	}
+	if len(fields) > 2 && strings.TrimSpace(fields[2]) != "" {
+		lo, hi, ok := strings.Cut(fields[2], "..")
+		if !ok {
+			return nil, invalid("has an invalid range, expected min..max")
+		}
+		var err error
+		if p.min, err = parseBound(lo); err != nil {
+			return nil, invalid("has an invalid minimum")
+		}
+		if p.max, err = parseBound(hi); err != nil {
+			return nil, invalid("has an invalid maximum")
+		}
+		if p.min != nil && p.max != nil && *p.min > *p.max {
+			return nil, invalid("has a minimum greater than its maximum")
+		}
+	}
+	if len(fields) > 3 {
+		def := fields[3]
+		if _, err := p.check(def); err != nil {
+			return nil, invalid("has an invalid default. " + err.(*Error).Reason)
+		}
+		p.defVal = &def
+	}
+	return p, nil
+}
+
+func parseBound(s string) (*int, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// lookup returns the raw value for the placeholder or false if it is missing
+func (p *placeholder) lookup(v Vars) (string, bool) {
+	switch p.name {
+	case "user":
+		return v.User, v.User != ""
+	case "input":
+		return v.Input, v.Input != ""
+	case "args":
+		return strings.Join(v.Args, " "), len(v.Args) > 0
+	case "bits":
+		return strconv.Itoa(v.Bits), v.Bits > 0
+	case "remaining":
+		// rounded up, so a running cooldown is never reported as 0
+		return strconv.Itoa(int((v.Remaining + time.Second - 1) / time.Second)), true
+	}
+	if p.arg <= len(v.Args) {
+		return v.Args[p.arg-1], true
+	}
+	return "", false
+}
+
+// check validates value against type and range and returns it in its normalized form
+func (p *placeholder) check(value string) (string, error) {
+	reject := func(format string, args ...any) error {
+		return &Error{Placeholder: p.raw, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	size, unit := 0, ""
+	switch p.typ {
+	case typeInt:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return "", reject("%q is not a number", value)
+		}
+		value, size = strconv.Itoa(n), n
+	default:
+		// control characters could break the line based protocol of the game
+		value = strings.Map(func(r rune) rune {
+			if unicode.IsControl(r) {
+				return -1
+			}
+			return r
+		}, value)
+		size, unit = utf8.RuneCountInString(value), " characters"
+	}
+
+	if p.min != nil && size < *p.min {
+		return "", reject("must be at least %d%s", *p.min, unit)
+	}
+	if p.max != nil && size > *p.max {
+		return "", reject("must be at most %d%s", *p.max, unit)
+	}
+	return value, nil
+}
+
+// Expand fills in all placeholders. The returned error is an *Error if a value was missing or invalid.
+func (t *Template) Expand(v Vars) (string, error) {
+	var sb strings.Builder
+	for i, p := range t.placeholders {
+		sb.WriteString(t.literals[i])
+
+		value, ok := p.lookup(v)
+		if !ok {
+			if p.defVal == nil {
+				return "", &Error{Placeholder: p.raw, Reason: "value is missing"}
+			}
+			value = *p.defVal
+		}
+		value, err := p.check(value)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(value)
+	}
+	sb.WriteString(t.literals[len(t.literals)-1])
+	return sb.String(), nil
+}
+
+// Expand parses s and fills in all placeholders
+func Expand(s string, v Vars) (string, error) {
+	t, err := Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return t.Expand(v)
+}
+
+// ExpandAll expands all templates. If any of them fails, no result is returned,
+// so an invocation is either executed completely or not at all.
+func ExpandAll(templates []string, v Vars) ([]string, error) {
+	result := make([]string, 0, len(templates))
+	for _, s := range templates {
+		expanded, err := Expand(strings.TrimSpace(s), v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, expanded)
+	}
+	return result, nil
+}
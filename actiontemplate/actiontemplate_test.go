@@ -0,0 +1,104 @@
+package actiontemplate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpand(t *testing.T) {
+	vars := Vars{User: "viewer", Input: "hello there", Bits: 100, Args: []string{"wolf", "3"}}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"TWI_SetHP 1", "TWI_SetHP 1"},
+		{"TWI_Say {user} {input}", "TWI_Say viewer hello there"},
+		{"TWI_Spawn {arg1} {arg2:int:1..5}", "TWI_Spawn wolf 3"},
+		{"TWI_Spawn {arg1} {arg3:int:1..5:1}", "TWI_Spawn wolf 1"},
+		{"TWI_Gold {bits}", "TWI_Gold 100"},
+		{"TWI_Echo {args}", "TWI_Echo wolf 3"},
+		{"TWI_Json {{\"a\": {arg2:int}}}", `TWI_Json {"a": 3}`},
+		{"TWI_Spawn {arg2:int:..10}", "TWI_Spawn 3"},
+		{"wait {remaining}s", "wait 0s"},
+		{"TWI_Say :-}", "TWI_Say :-}"},
+		{"TWI_Say {arg1", "TWI_Say {arg1"},
+		{"TWI_Say { {user} }", "TWI_Say { viewer }"},
+		{"TWI_Say }{user}{", "TWI_Say }viewer{"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			got, err := Expand(tt.template, vars)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestExpandRejects(t *testing.T) {
+	tests := []struct {
+		template string
+		vars     Vars
+		reason   string
+	}{
+		{"TWI_SetHP {arg1:int:1..100}", Vars{}, "value is missing"},
+		{"TWI_SetHP {arg1:int:1..100}", Vars{Args: []string{"abc"}}, `"abc" is not a number`},
+		{"TWI_SetHP {arg1:int:1..100}", Vars{Args: []string{"0"}}, "must be at least 1"},
+		{"TWI_SetHP {arg1:int:1..100}", Vars{Args: []string{"101"}}, "must be at most 100"},
+		{"TWI_Say {input:string:..5}", Vars{Input: "too long"}, "must be at most 5 characters"},
+		{"TWI_Gold {bits}", Vars{}, "value is missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template+" "+tt.reason, func(t *testing.T) {
+			_, err := Expand(tt.template, tt.vars)
+			var tErr *Error
+			require.ErrorAs(t, err, &tErr)
+			assert.Equal(t, tt.reason, tErr.Reason)
+		})
+	}
+}
+
+func TestExpandRemovesControlCharacters(t *testing.T) {
+	got, err := Expand("TWI_Say {input}", Vars{Input: "hi\r\nTWI_Kill"})
+	require.NoError(t, err)
+	assert.Equal(t, "TWI_Say hiTWI_Kill", got)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, template := range []string{
+		"{unknown}",
+		"{arg0}",
+		"{argx}",
+		"{arg1:float}",
+		"{arg1:int:5}",
+		"{arg1:int:10..1}",
+		"{arg1:int:a..b}",
+		"{arg1:int:1..10:20}",
+		"{arg1:int::abc}",
+		"{ {arg1:int:a} }",
+	} {
+		t.Run(template, func(t *testing.T) {
+			_, err := Parse(template)
+			assert.ErrorIs(t, err, ErrInvalidTemplate)
+		})
+	}
+}
+
+func TestExpandAllIsAllOrNothing(t *testing.T) {
+	actions, err := ExpandAll([]string{" TWI_A {user} ", "TWI_B"}, Vars{User: "viewer"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"TWI_A viewer", "TWI_B"}, actions)
+
+	actions, err = ExpandAll([]string{"TWI_A", "TWI_B {arg1}"}, Vars{})
+	assert.Error(t, err)
+	assert.Nil(t, actions)
+}
+
+func TestExpandRemaining(t *testing.T) {
+	got, err := Expand("@{user} wait {remaining}s", Vars{User: "viewer", Remaining: time.Millisecond * 4200})
+	require.NoError(t, err)
+	assert.Equal(t, "@viewer wait 5s", got)
+}
@@ -0,0 +1,117 @@
+// Package chatcommand parses chat messages like `#spawn "cave troll" 3` into a command and its arguments.
+package chatcommand
+
+import (
+	"strings"
+	"unicode"
+)
+
+// MaxArgs is the maximum number of arguments kept, further arguments are dropped
+const MaxArgs = 16
+
+// Command is a parsed chat command
+type Command struct {
+	// Name is the lowercased first word including the prefix, e.g. "#spawn"
+	Name string
+	Args []string
+}
+
+// Parse splits text into a command and its arguments.
+// It returns false if text does not start with prefix or contains no command name.
+func Parse(prefix, text string) (Command, bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, prefix) {
+		return Command{}, false
+	}
+	name, rest := text, ""
+	if idx := strings.IndexFunc(text, unicode.IsSpace); idx != -1 {
+		name, rest = text[:idx], text[idx:]
+	}
+	name = Normalize(name)
+	if strings.TrimPrefix(name, Normalize(prefix)) == "" {
+		return Command{}, false
+	}
+	args := Tokenize(rest)
+	if len(args) > MaxArgs {
+		args = args[:MaxArgs]
+	}
+	return Command{Name: name, Args: args}, true
+}
+
+// Normalize returns name the way command names are compared
+func Normalize(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Tokenize splits s at whitespace. Single or double quotes group words into a single argument,
+// inside quotes a backslash escapes the next character. An unterminated quote extends to the end of s.
+func Tokenize(s string) []string {
+	var (
+		args    []string
+		current strings.Builder
+		inToken bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case quote != 0 && r == '\\':
+			escaped = true
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case unicode.IsSpace(r):
+			if inToken {
+				args = append(args, current.String())
+				current.Reset()
+				inToken = false
+			}
+		default:
+			current.WriteRune(r)
+			inToken = true
+		}
+	}
+	if inToken {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// Set looks up commands by name or alias, ignoring case
+type Set[T any] struct {
+	commands map[string]T
+}
+
+// Add registers cmd under name and all aliases.
+// The first registration of a name wins, add all commands before their aliases
+// to prevent an alias from shadowing another command.
+func (s *Set[T]) Add(name string, cmd T, aliases ...string) {
+	if s.commands == nil {
+		s.commands = make(map[string]T)
+	}
+	for _, n := range append([]string{name}, aliases...) {
+		n = Normalize(n)
+		if _, ok := s.commands[n]; ok || n == "" {
+			continue
+		}
+		s.commands[n] = cmd
+	}
+}
+
+// Lookup returns the command registered under name
+func (s Set[T]) Lookup(name string) (T, bool) {
+	cmd, ok := s.commands[Normalize(name)]
+	return cmd, ok
+}
+
+// Len returns the number of registered names including aliases
+func (s Set[T]) Len() int {
+	return len(s.commands)
+}
@@ -0,0 +1,85 @@
+package chatcommand
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		text string
+		want Command
+		ok   bool
+	}{
+		{"#hp 5", Command{Name: "#hp", Args: []string{"5"}}, true},
+		{"#HP", Command{Name: "#hp"}, true},
+		{"#hp\t5", Command{Name: "#hp", Args: []string{"5"}}, true},
+		{"  #hp  ", Command{Name: "#hp"}, true},
+		{`#spawn "cave troll" 3`, Command{Name: "#spawn", Args: []string{"cave troll", "3"}}, true},
+		{"#", Command{}, false},
+		{"# hp", Command{}, false},
+		{"hello #hp", Command{}, false},
+		{"", Command{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, ok := Parse("#", tt.text)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParseLimitsArgs(t *testing.T) {
+	cmd, ok := Parse("!", "!roll"+strings.Repeat(" x", MaxArgs+5))
+	assert.True(t, ok)
+	assert.Len(t, cmd.Args, MaxArgs)
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"  a   b ", []string{"a", "b"}},
+		{`"a b" c`, []string{"a b", "c"}},
+		{`'a "b"' c`, []string{`a "b"`, "c"}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+		{`a"b c"d`, []string{"ab cd"}},
+		{`""`, []string{""}},
+		{`"unterminated quote`, []string{"unterminated quote"}},
+		{`back\slash`, []string{`back\slash`}},
+		{"tab\tseparated", []string{"tab", "separated"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			assert.Equal(t, tt.want, Tokenize(tt.in))
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	var s Set[string]
+	s.Add("#Help", "help", "#h", "#?")
+	s.Add("#hp", "hp")
+	s.Add("#heal", "heal", "#hp")
+
+	for name, want := range map[string]string{
+		"#help": "help",
+		"#HELP": "help",
+		"#h":    "help",
+		"#?":    "help",
+		"#hp":   "hp",
+		"#heal": "heal",
+	} {
+		got, ok := s.Lookup(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, want, got, name)
+	}
+	_, ok := s.Lookup("#unknown")
+	assert.False(t, ok)
+	assert.Equal(t, 5, s.Len())
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/kirides/twitch-integration/metrics"
+	"github.com/kirides/twitch-integration/twitch/eventsub"
+)
+
+const (
+	// adminShutdownTimeout is how long running requests may take once the admin API stops
+	adminShutdownTimeout = 2 * time.Second
+	// defaultRecentEvents is the number of events returned by /api/events without limit
+	defaultRecentEvents = 20
+)
+
+// adminServer serves the state of the connector as JSON
+type adminServer struct {
+	services       *serviceManager
+	broker         *dataBroker
+	stats          *connectorStats
+	chat           *chatRelay
+	redemptions    *redemptionRelay
+	streamElements *streamElementsStatus
+	state          *gameState
+	metrics        *metrics.Registry
+}
+
+type adminConnections struct {
+	// IRC and EventSub are null while the integration is not running
+	IRC            *chatStatus            `json:"irc"`
+	EventSub       *eventsub.Status       `json:"eventsub"`
+	StreamElements streamElementsSnapshot `json:"streamelements"`
+}
+
+type adminClient struct {
+	Name string `json:"name"`
+	// Client is the name the client sent in its handshake
+	Client      string    `json:"client,omitempty"`
+	Version     int       `json:"version"`
+	Remote      string    `json:"remote,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Delivered   int64     `json:"delivered"`
+	Dropped     int64     `json:"dropped"`
+	Queued      int       `json:"queued"`
+}
+
+type adminBroker struct {
+	Published int64 `json:"published"`
+	Rejected  int64 `json:"rejected"`
+	// Dropped are events discarded while no game was connected
+	Dropped int64 `json:"dropped"`
+	// Unacknowledged is the number of events in the journal
+	Unacknowledged int                 `json:"unacknowledged"`
+	Queues         []subscriptionStats `json:"queues"`
+}
+
+type adminStatus struct {
+	UptimeSec   int64            `json:"uptime_sec"`
+	Services    []serviceStatus  `json:"services"`
+	Connections adminConnections `json:"connections"`
+	Clients     []adminClient    `json:"clients"`
+	Broker      adminBroker      `json:"broker"`
+	GameState   json.RawMessage  `json:"game_state,omitempty"`
+}
+
+func (a *adminServer) handler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, adminStatus{
+			UptimeSec:   int64(time.Since(a.stats.startedAt).Seconds()),
+			Services:    a.services.Status(),
+			Connections: a.connections(),
+			Clients:     a.clients(),
+			Broker:      a.brokerStatus(),
+			GameState:   a.state.get(),
+		})
+	})
+	mux.HandleFunc("GET /api/services", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.services.Status())
+	})
+	mux.HandleFunc("GET /api/connections", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.connections())
+	})
+	mux.HandleFunc("GET /api/clients", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.clients())
+	})
+	mux.HandleFunc("GET /api/broker", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, a.brokerStatus())
+	})
+	mux.HandleFunc("GET /api/eventsub/subscriptions", func(w http.ResponseWriter, r *http.Request) {
+		subs := []eventsub.SubscriptionStatus{}
+		if status := a.redemptions.status(); status != nil {
+			subs = status.Subscriptions
+		}
+		writeJSON(w, subs)
+	})
+	mux.HandleFunc("GET /api/events", func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultRecentEvents
+		if v := r.URL.Query().Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		writeJSON(w, a.broker.Recent(limit))
+	})
+	mux.Handle("GET /metrics", a.metrics.Handler())
+	return authenticate(token, mux)
+}
+
+// authenticate rejects requests without "Authorization: Bearer <token>"
+func authenticate(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func (a *adminServer) connections() adminConnections {
+	return adminConnections{
+		IRC:            a.chat.status(),
+		EventSub:       a.redemptions.status(),
+		StreamElements: a.streamElements.snapshot(),
+	}
+}
+
+func (a *adminServer) clients() []adminClient {
+	queues := make(map[string]subscriptionStats)
+	for _, q := range a.broker.Subscriptions() {
+		queues[q.Name] = q
+	}
+	clients := []adminClient{}
+	a.stats.pipeClients.Range(func(_, value any) bool {
+		c := value.(*pipeClient)
+		q := queues[c.name]
+		client := adminClient{
+			Name:        c.name,
+			Version:     int(c.version.Load()),
+			ConnectedAt: c.connectedAt,
+			Delivered:   q.Delivered,
+			Dropped:     q.Dropped,
+			Queued:      q.Queued,
+		}
+		if peer := c.peer.Load(); peer != nil {
+			client.Client = *peer
+		}
+		if addr := c.conn.RemoteAddr(); addr != nil {
+			client.Remote = addr.String()
+		}
+		clients = append(clients, client)
+		return true
+	})
+	return clients
+}
+
+func (a *adminServer) brokerStatus() adminBroker {
+	return adminBroker{
+		Published:      a.broker.Published(),
+		Rejected:       a.broker.Rejected(),
+		Dropped:        a.broker.Dropped(),
+		Unacknowledged: len(a.broker.Pending()),
+		Queues:         a.broker.Subscriptions(),
+	}
+}
+
+// serveAdmin runs the admin API until ctx is done
+func serveAdmin(ctx context.Context, logger *slog.Logger, cnf adminCnf, a *adminServer) error {
+	logger = logger.With(slog.String(logKeyCategory, "admin"))
+	if !cnf.Enabled {
+		logger.Info("admin API disabled by configuration.")
+		return nil
+	}
+	if cnf.Token == "" {
+		return errors.New("admin API requires a token")
+	}
+	host, _, err := net.SplitHostPort(cnf.Address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("admin API must listen on a loopback address, got %q", host)
+	}
+	l, err := net.Listen("tcp", cnf.Address)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           a.handler(cnf.Token),
+		ReadHeaderTimeout: 5 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info("admin API listening", slog.String("address", l.Addr().String()))
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"log/slog"
+
+	"github.com/kirides/twitch-integration/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{name: "missing header", status: http.StatusUnauthorized},
+		{name: "wrong token", authorization: "Bearer wrong", status: http.StatusUnauthorized},
+		{name: "other scheme", authorization: "Basic secret", status: http.StatusUnauthorized},
+		{name: "token without scheme", authorization: "secret", status: http.StatusUnauthorized},
+		{name: "empty token", authorization: "Bearer ", status: http.StatusUnauthorized},
+		{name: "valid token", authorization: "Bearer secret", status: http.StatusNoContent},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/status", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			authenticate("secret", next).ServeHTTP(w, r)
+
+			assert.Equal(t, tt.status, w.Code)
+			if tt.status == http.StatusUnauthorized {
+				assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestServeAdminConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		cnf  adminCnf
+		err  string
+	}{
+		{name: "disabled", cnf: adminCnf{Address: "0.0.0.0:0"}},
+		{name: "without token", cnf: adminCnf{Enabled: true, Address: "127.0.0.1:0"}, err: "admin API requires a token"},
+		{name: "any address", cnf: adminCnf{Enabled: true, Address: "0.0.0.0:0", Token: "secret"}, err: `admin API must listen on a loopback address, got "0.0.0.0"`},
+		{name: "all interfaces", cnf: adminCnf{Enabled: true, Address: ":0", Token: "secret"}, err: `admin API must listen on a loopback address, got ""`},
+		{name: "host name", cnf: adminCnf{Enabled: true, Address: "example.com:0", Token: "secret"}, err: `admin API must listen on a loopback address, got "example.com"`},
+		{name: "private address", cnf: adminCnf{Enabled: true, Address: "192.168.1.10:0", Token: "secret"}, err: `admin API must listen on a loopback address, got "192.168.1.10"`},
+		{name: "loopback", cnf: adminCnf{Enabled: true, Address: "127.0.0.1:0", Token: "secret"}},
+		{name: "loopback v6", cnf: adminCnf{Enabled: true, Address: "[::1]:0", Token: "secret"}},
+		{name: "localhost", cnf: adminCnf{Enabled: true, Address: "localhost:0", Token: "secret"}},
+		{name: "missing port", cnf: adminCnf{Enabled: true, Address: "127.0.0.1", Token: "secret"}, err: "address 127.0.0.1: missing port in address"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// accepted configurations shut down right away
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			err := serveAdmin(ctx, slog.New(slog.DiscardHandler), tt.cnf, &adminServer{metrics: metrics.NewRegistry()})
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
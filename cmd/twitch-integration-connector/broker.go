@@ -2,48 +2,445 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kirides/twitch-integration/journal"
 )
 
+// brokerEvent is a published event, Data is the serialized envelope including ID
+type brokerEvent struct {
+	ID   uint64
+	Type string
+	Data []byte
+}
+
+// overflowPolicy decides what happens when a client does not keep up with published events
+type overflowPolicy string
+
+const (
+	// overflowDropOldest discards the oldest queued event to make room for the new one
+	overflowDropOldest overflowPolicy = "drop-oldest"
+	// overflowDropNewest discards the new event
+	overflowDropNewest overflowPolicy = "drop-newest"
+	// overflowDisconnect closes the client's queue, which ends its connection
+	overflowDisconnect overflowPolicy = "disconnect"
+)
+
+// errBrokerBusy is returned by Publish when the broker does not keep up
+var errBrokerBusy = errors.New("broker queue is full, event dropped")
+
+// subscription is the queue of events for a single client
+type subscription struct {
+	name     string
+	ch       chan brokerEvent
+	overflow overflowPolicy
+	closed   bool
+
+	delivered atomic.Int64
+	dropped   atomic.Int64
+}
+
+// Events are closed when the client was disconnected for not keeping up
+func (s *subscription) Events() <-chan brokerEvent {
+	return s.ch
+}
+
+// Delivered counts an event that was written to the client
+func (s *subscription) Delivered() {
+	s.delivered.Add(1)
+}
+
+// deliver queues evt without blocking, it returns false if the subscription was closed
+func (s *subscription) deliver(evt brokerEvent) bool {
+	if s.closed {
+		return false
+	}
+	select {
+	case s.ch <- evt:
+		return true
+	default:
+	}
+	switch s.overflow {
+	case overflowDropNewest:
+		s.dropped.Add(1)
+	case overflowDisconnect:
+		s.dropped.Add(1)
+		s.closed = true
+		close(s.ch)
+		return false
+	default:
+		// the client reads concurrently, so there may be room again
+		select {
+		case <-s.ch:
+			s.dropped.Add(1)
+		default:
+		}
+		select {
+		case s.ch <- evt:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+	return true
+}
+
+// subscriptionStats is a snapshot of a client's queue
+type subscriptionStats struct {
+	Name      string `json:"name"`
+	Delivered int64  `json:"delivered"`
+	Dropped   int64  `json:"dropped"`
+	Queued    int    `json:"queued"`
+}
+
 type dataBroker struct {
 	events  chan []byte
-	clients map[chan []byte]struct{}
-	add     chan chan []byte
-	remove  chan chan []byte
+	clients map[*subscription]struct{}
+	add     chan *subscription
+	remove  chan *subscription
+	logger  *slog.Logger
+	queue   eventQueueCnf
+
+	statsMtx sync.Mutex
+	// stats of all clients, updated by Run
+	stats []*subscription
+
+	// journal keeps events until they were acknowledged, nil if disabled
+	journal *journal.Journal
+	lastID  uint64
+	// pending holds events while no client is connected
+	pending *pendingEvents
+
+	published atomic.Int64
+	rejected  atomic.Int64
+	// dropped counts events that were discarded while no game was connected
+	dropped atomic.Int64
+
+	recentMtx sync.Mutex
+	// recent are the last published events, recentNext is the slot of the next event
+	recent     []recentEvent
+	recentNext int
+
+	// done is closed once Run returned
+	done chan struct{}
+}
+
+const (
+	// pendingPruneInterval is how often expired pending events are dropped
+	pendingPruneInterval = 10 * time.Second
+	// flushInterval is how often a stopping broker checks whether all clients received their events
+	flushInterval = 50 * time.Millisecond
+	// recentEventsSize is the number of published events kept for the admin API
+	recentEventsSize = 100
+)
+
+// recentEvent is a published event as it was sent to the clients
+type recentEvent struct {
+	ID         uint64          `json:"id"`
+	Type       string          `json:"type"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Data       json.RawMessage `json:"data"`
 }
 
-func newBroker() *dataBroker {
+func newBroker(logger *slog.Logger, j *journal.Journal, pending pendingEventsCnf, queue eventQueueCnf) *dataBroker {
 	return &dataBroker{
-		events:  make(chan []byte, 1),
-		clients: make(map[chan []byte]struct{}),
-		remove:  make(chan chan []byte),
-		add:     make(chan chan []byte),
+		events:  make(chan []byte, 256),
+		clients: make(map[*subscription]struct{}),
+		remove:  make(chan *subscription),
+		add:     make(chan *subscription),
+		logger:  logger.With(slog.String(logKeyCategory, "broker")),
+		queue:   queue,
+		journal: j,
+		pending: newPendingEvents(pending),
+		done:    make(chan struct{}),
+		// without a journal IDs must not repeat after a restart while the game is still running
+		lastID: uint64(time.Now().UnixMilli()) * 1000,
+	}
+}
+
+// Subscribe creates a queue receiving all events published from now on
+func (b *dataBroker) Subscribe(name string) *subscription {
+	size := b.queue.Size
+	if size <= 0 {
+		size = 256
+	}
+	sub := &subscription{name: name, ch: make(chan brokerEvent, size), overflow: b.queue.Overflow}
+	select {
+	case b.add <- sub:
+	case <-b.done:
+		sub.closed = true
+		close(sub.ch)
+	}
+	return sub
+}
+
+func (b *dataBroker) Unsubscribe(sub *subscription) {
+	select {
+	case b.remove <- sub:
+	case <-b.done:
+	}
+}
+
+// stopped reports whether Run returned, subscriptions do not receive events anymore
+func (b *dataBroker) stopped() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Publish queues the event without blocking. It fails with errBrokerBusy if the broker does not keep up.
+func (b *dataBroker) Publish(evt []byte) error {
+	select {
+	case b.events <- evt:
+		b.published.Add(1)
+		return nil
+	default:
+		b.rejected.Add(1)
+		return errBrokerBusy
+	}
+}
+
+// Published is the number of events published since the start
+func (b *dataBroker) Published() int64 {
+	return b.published.Load()
+}
+
+// Rejected is the number of events Publish dropped because the broker did not keep up
+func (b *dataBroker) Rejected() int64 {
+	return b.rejected.Load()
+}
+
+// Dropped is the number of events discarded while no game was connected
+func (b *dataBroker) Dropped() int64 {
+	return b.dropped.Load()
+}
+
+// Subscriptions returns the state of the queues of all clients
+func (b *dataBroker) Subscriptions() []subscriptionStats {
+	b.statsMtx.Lock()
+	defer b.statsMtx.Unlock()
+	stats := make([]subscriptionStats, 0, len(b.stats))
+	for _, s := range b.stats {
+		stats = append(stats, subscriptionStats{
+			Name:      s.name,
+			Delivered: s.delivered.Load(),
+			Dropped:   s.dropped.Load(),
+			Queued:    len(s.ch),
+		})
 	}
+	return stats
 }
-func (b *dataBroker) Remove(c chan []byte) {
-	b.remove <- c
+
+func (b *dataBroker) updateStats() {
+	b.statsMtx.Lock()
+	defer b.statsMtx.Unlock()
+	b.stats = b.stats[:0]
+	for s := range b.clients {
+		b.stats = append(b.stats, s)
+	}
+	slices.SortFunc(b.stats, func(x, y *subscription) int { return strings.Compare(x.name, y.name) })
 }
 
-func (b *dataBroker) Add(c chan []byte) {
-	b.add <- c
+// Ack removes the events from the journal
+func (b *dataBroker) Ack(ids ...uint64) {
+	if b.journal == nil {
+		return
+	}
+	if err := b.journal.Ack(ids...); err != nil {
+		b.logger.Error("could not acknowledge events", slog.Any("err", err))
+	}
 }
 
-func (b *dataBroker) Publish(evt []byte) {
-	b.events <- evt
+// Pending returns the events that were not acknowledged, ordered by ID
+func (b *dataBroker) Pending() []brokerEvent {
+	if b.journal == nil {
+		return nil
+	}
+	entries := b.journal.Pending()
+	events := make([]brokerEvent, 0, len(entries))
+	for _, e := range entries {
+		var env struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(e.Data, &env)
+		events = append(events, brokerEvent{ID: e.ID, Type: env.Type, Data: e.Data})
+	}
+	return events
+}
+
+// stamp assigns an ID to the event and stores it in the journal
+func (b *dataBroker) stamp(evt []byte) (brokerEvent, error) {
+	var env struct {
+		Type string          `json:"type"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(evt, &env); err != nil {
+		return brokerEvent{}, err
+	}
+	serialize := func(id uint64) ([]byte, error) {
+		return json.Marshal(struct {
+			Type string          `json:"type"`
+			ID   uint64          `json:"id"`
+			Data json.RawMessage `json:"data"`
+		}{Type: env.Type, ID: id, Data: env.Data})
+	}
+	if b.journal != nil {
+		e, err := b.journal.Append(serialize)
+		if err == nil {
+			return brokerEvent{ID: e.ID, Type: env.Type, Data: e.Data}, nil
+		}
+		b.logger.Error("could not store event, it is lost if it is not delivered", slog.Any("err", err))
+	}
+	b.lastID++
+	data, err := serialize(b.lastID)
+	return brokerEvent{ID: b.lastID, Type: env.Type, Data: data}, err
+}
+
+// drop forgets events that were not delivered while no game was connected.
+// Journaled events stay in the journal and are delivered again once a game connects,
+// unless pending_events.ttl_sec configures their type with 0.
+func (b *dataBroker) drop(events []brokerEvent, reason string) {
+	for _, evt := range events {
+		if b.journal != nil && !b.pending.discards(evt.Type) {
+			b.logger.Info("Event kept in the journal until a game connects", slog.Uint64("id", evt.ID), slog.String("type", evt.Type), slog.String("reason", reason))
+			continue
+		}
+		b.dropped.Add(1)
+		b.logger.Warn("Event dropped", slog.Uint64("id", evt.ID), slog.String("type", evt.Type), slog.String("reason", reason))
+		b.Ack(evt.ID)
+	}
 }
 
+// fanOut delivers evt to all clients, removing clients that were disconnected for not keeping up
+func (b *dataBroker) fanOut(evt brokerEvent) {
+	for s := range b.clients {
+		if !s.deliver(evt) {
+			b.logger.Warn("Client disconnected, it did not keep up with events", slog.String("client", s.name))
+			delete(b.clients, s)
+			b.updateStats()
+		}
+	}
+}
+
+// remember keeps evt in the ring of recent events
+func (b *dataBroker) remember(evt brokerEvent) {
+	b.recentMtx.Lock()
+	defer b.recentMtx.Unlock()
+	e := recentEvent{ID: evt.ID, Type: evt.Type, ReceivedAt: time.Now(), Data: evt.Data}
+	if len(b.recent) < recentEventsSize {
+		b.recent = append(b.recent, e)
+		return
+	}
+	b.recent[b.recentNext] = e
+	b.recentNext = (b.recentNext + 1) % recentEventsSize
+}
+
+// Recent returns up to limit of the last published events, newest first
+func (b *dataBroker) Recent(limit int) []recentEvent {
+	b.recentMtx.Lock()
+	defer b.recentMtx.Unlock()
+	n := min(max(limit, 0), len(b.recent))
+	events := make([]recentEvent, 0, n)
+	// the newest event is right before recentNext, wrapping around
+	for i := range n {
+		idx := (b.recentNext - 1 - i + 2*len(b.recent)) % len(b.recent)
+		events = append(events, b.recent[idx])
+	}
+	return events
+}
+
+// publish assigns an ID to the event and delivers it, or holds it while no client is connected
+func (b *dataBroker) publish(data []byte) {
+	evt, err := b.stamp(data)
+	if err != nil {
+		b.logger.Error("could not assign event ID", slog.Any("err", err))
+		return
+	}
+	b.remember(evt)
+	if len(b.clients) == 0 {
+		b.drop(b.pending.hold(evt, time.Now()), "no game connected")
+		return
+	}
+	b.fanOut(evt)
+}
+
+// flushed reports whether the connected clients took all queued events.
+// Events they did not acknowledge stay in the journal and are delivered again on the next connect.
+func (b *dataBroker) flushed() bool {
+	for s := range b.clients {
+		if len(s.ch) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Run delivers published events until ctx is done.
+// It then delivers the events that were already published and returns once the connected clients
+// received them, or all clients disconnected.
 func (b *dataBroker) Run(ctx context.Context) error {
+	defer close(b.done)
+
+	prune := time.NewTicker(pendingPruneInterval)
+	defer prune.Stop()
+
+	ctxDone := ctx.Done()
+	var flush <-chan time.Time
 	for {
 		select {
-		case c := <-b.remove:
-			delete(b.clients, c)
-		case c := <-b.add:
-			b.clients[c] = struct{}{}
-		case <-ctx.Done():
-			return nil
-		case evt := <-b.events:
-			for c := range b.clients {
-				c <- evt
+		case s := <-b.remove:
+			delete(b.clients, s)
+			b.updateStats()
+			if flush != nil && b.flushed() {
+				return nil
+			}
+		case s := <-b.add:
+			b.clients[s] = struct{}{}
+			b.updateStats()
+			if len(b.clients) == 1 {
+				events, expired := b.pending.take(time.Now())
+				b.drop(expired, "expired")
+				if len(events) > 0 {
+					b.logger.Info("Delivering events received while no game was connected", slog.Int("count", len(events)))
+				}
+				for _, evt := range events {
+					b.fanOut(evt)
+				}
+			}
+		case <-prune.C:
+			b.drop(b.pending.expire(time.Now()), "expired")
+		case <-ctxDone:
+			ctxDone = nil
+			for drained := false; !drained; {
+				select {
+				case data := <-b.events:
+					b.publish(data)
+				default:
+					drained = true
+				}
+			}
+			if b.flushed() {
+				return nil
+			}
+			b.logger.Info("Waiting for clients to receive the remaining events")
+			ticker := time.NewTicker(flushInterval)
+			defer ticker.Stop()
+			flush = ticker.C
+		case <-flush:
+			if b.flushed() {
+				return nil
 			}
+		case data := <-b.events:
+			b.publish(data)
 		}
 	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"log/slog"
+
+	"github.com/kirides/twitch-integration/journal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBroker(queue eventQueueCnf) *dataBroker {
+	return newBroker(slog.New(slog.DiscardHandler), nil, pendingEventsCnf{}, queue)
+}
+
+// queued returns the IDs of the events in the subscription without blocking
+func queued(sub *subscription) []uint64 {
+	var ids []uint64
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				return ids
+			}
+			ids = append(ids, e.ID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestSubscriptionOverflow(t *testing.T) {
+	tests := []struct {
+		overflow overflowPolicy
+		queued   []uint64
+		dropped  int64
+		closed   bool
+	}{
+		{overflow: overflowDropOldest, queued: []uint64{3, 4}, dropped: 2},
+		{overflow: "", queued: []uint64{3, 4}, dropped: 2},
+		{overflow: overflowDropNewest, queued: []uint64{1, 2}, dropped: 2},
+		{overflow: overflowDisconnect, queued: []uint64{1, 2}, dropped: 1, closed: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.overflow), func(t *testing.T) {
+			sub := &subscription{name: "client", ch: make(chan brokerEvent, 2), overflow: tt.overflow}
+			for id := range uint64(4) {
+				sub.deliver(brokerEvent{ID: id + 1})
+			}
+			assert.Equal(t, tt.closed, sub.closed)
+			assert.Equal(t, tt.dropped, sub.dropped.Load())
+			assert.Equal(t, tt.queued, queued(sub))
+			if tt.closed {
+				_, ok := <-sub.ch
+				assert.False(t, ok, "queue must be closed")
+			}
+		})
+	}
+}
+
+func TestBrokerPublishDoesNotBlock(t *testing.T) {
+	b := newTestBroker(eventQueueCnf{})
+	for range cap(b.events) {
+		require.NoError(t, b.Publish([]byte(`{"type":"chat"}`)))
+	}
+	assert.ErrorIs(t, b.Publish([]byte(`{"type":"chat"}`)), errBrokerBusy)
+	assert.Equal(t, int64(cap(b.events)), b.Published())
+	assert.Equal(t, int64(1), b.Rejected())
+}
+
+func TestBrokerQueuesPerClient(t *testing.T) {
+	b := newTestBroker(eventQueueCnf{Size: 2, Overflow: overflowDropOldest})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Run(ctx) }()
+
+	fast := b.Subscribe("fast")
+	slow := b.Subscribe("slow")
+	for i := range 4 {
+		require.NoError(t, b.Publish(fmt.Appendf(nil, `{"type":"chat","data":{"n":%d}}`, i)))
+		// the fast client keeps up, the slow one does not read at all
+		select {
+		case <-fast.Events():
+			fast.Delivered()
+		case <-time.After(time.Second):
+			t.Fatal("event was not delivered")
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		stats := b.Subscriptions()
+		return len(stats) == 2 && stats[1].Dropped == 2
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, []subscriptionStats{
+		{Name: "fast", Delivered: 4},
+		{Name: "slow", Dropped: 2, Queued: 2},
+	}, b.Subscriptions())
+
+	b.Unsubscribe(slow)
+	b.Unsubscribe(fast)
+	cancel()
+	require.NoError(t, <-done)
+	assert.True(t, b.stopped())
+}
+
+func TestBrokerDisconnectsSlowClient(t *testing.T) {
+	b := newTestBroker(eventQueueCnf{Size: 1, Overflow: overflowDisconnect})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	sub := b.Subscribe("slow")
+	require.NoError(t, b.Publish([]byte(`{"type":"chat","data":{}}`)))
+	require.Eventually(t, func() bool {
+		stats := b.Subscriptions()
+		return len(stats) == 1 && stats[0].Queued == 1
+	}, time.Second, time.Millisecond*10)
+	require.NoError(t, b.Publish([]byte(`{"type":"chat","data":{}}`)))
+	require.Eventually(t, func() bool { return len(b.Subscriptions()) == 0 }, time.Second, time.Millisecond*10)
+
+	// the queued event is still delivered before the queue ends
+	var received int
+	for range sub.Events() {
+		received++
+	}
+	assert.Equal(t, 1, received)
+	assert.Equal(t, int64(1), sub.dropped.Load())
+}
+
+func TestBrokerStopKeepsUnacknowledgedEvents(t *testing.T) {
+	j, err := journal.Open(filepath.Join(t.TempDir(), "events.journal"), 0)
+	require.NoError(t, err)
+	defer j.Close()
+
+	b := newBroker(slog.New(slog.DiscardHandler), j, pendingEventsCnf{}, eventQueueCnf{})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Run(ctx) }()
+
+	sub := b.Subscribe("game")
+	require.Eventually(t, func() bool { return len(b.Subscriptions()) == 1 }, time.Second, time.Millisecond*10)
+	require.NoError(t, b.Publish([]byte(`{"type":"chat","data":{}}`)))
+	select {
+	case <-sub.Events():
+	case <-time.After(time.Second):
+		t.Fatal("event was not delivered")
+	}
+
+	// the client received the event but never acknowledges it
+	cancel()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("broker waited for the acknowledgement")
+	}
+	assert.Len(t, j.Pending(), 1)
+}
@@ -7,9 +7,13 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"log/slog"
 
+	"github.com/kirides/twitch-integration/chatcommand"
+	"github.com/kirides/twitch-integration/pipeproto"
 	"github.com/kirides/twitch-integration/twitch"
 	"github.com/kirides/twitch-integration/twitch/irc"
 )
@@ -18,9 +22,114 @@ type ChatMessage struct {
 	Text    string `json:"text"`
 	Sender  string `json:"sender"`
 	Channel string `json:"channel"`
+	// Command is the lowercased command name including the prefix, Args its arguments
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
 }
 
-func handleChat(ctx context.Context, cnf twitchCnf, logger *slog.Logger, ew eventPublisher) error {
+var (
+	errChatUnavailable  = pipeproto.Errorf(pipeproto.CodeUnavailable, "chat is not connected or read-only")
+	errChatMissingScope = pipeproto.Errorf(pipeproto.CodeUnavailable, `OAuth token does not contain "chat:edit" scope, required to send messages`)
+)
+
+// chatRelay sends messages through the chat client of handleChat while it is running
+type chatRelay struct {
+	mtx    sync.Mutex
+	client *irc.ChatClient
+	// reconnects and rateLimited of previous clients, the service creates a new client on restart
+	reconnects  uint64
+	rateLimited uint64
+}
+
+func (r *chatRelay) set(c *irc.ChatClient) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.client != nil {
+		r.reconnects += r.client.Reconnects()
+		r.rateLimited += r.client.RateLimited()
+	}
+	r.client = c
+}
+
+// counters returns the reconnects and rate limited messages of all clients since the start
+func (r *chatRelay) counters() (reconnects, rateLimited uint64) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	reconnects, rateLimited = r.reconnects, r.rateLimited
+	if r.client != nil {
+		reconnects += r.client.Reconnects()
+		rateLimited += r.client.RateLimited()
+	}
+	return reconnects, rateLimited
+}
+
+// Send queues the message, it is sent as soon as twitch's rate limits allow it
+func (r *chatRelay) Send(channel, message string) error {
+	r.mtx.Lock()
+	c := r.client
+	r.mtx.Unlock()
+	if c == nil || c.ReadOnly() {
+		return errChatUnavailable
+	}
+	if !c.CanSend() {
+		return errChatMissingScope
+	}
+	return c.Send(channel, message)
+}
+
+// stats adds the state of the chat client to s
+func (r *chatRelay) stats(s *pipeproto.Stats) {
+	r.mtx.Lock()
+	c := r.client
+	r.mtx.Unlock()
+	if c == nil {
+		return
+	}
+	health := c.Health()
+	s.ChatConnected = health.Connected
+	s.ChatLatencyMs = health.Latency.Milliseconds()
+	s.ChatQueued = c.QueueLength()
+	s.ChatDropped = int64(c.DroppedMessages())
+}
+
+// chatStatus is the state of the chat connection for the admin API
+type chatStatus struct {
+	Connected    bool      `json:"connected"`
+	ReadOnly     bool      `json:"read_only"`
+	CanSend      bool      `json:"can_send"`
+	ConnectedAt  time.Time `json:"connected_at,omitzero"`
+	LastReceived time.Time `json:"last_received,omitzero"`
+	LatencyMs    int64     `json:"latency_ms"`
+	PongTimeouts int       `json:"pong_timeouts"`
+	Queued       int       `json:"queued"`
+	Dropped      uint64    `json:"dropped"`
+	Channels     []string  `json:"channels"`
+}
+
+// status returns nil while handleChat is not running
+func (r *chatRelay) status() *chatStatus {
+	r.mtx.Lock()
+	c := r.client
+	r.mtx.Unlock()
+	if c == nil {
+		return nil
+	}
+	health := c.Health()
+	return &chatStatus{
+		Connected:    health.Connected,
+		ReadOnly:     c.ReadOnly(),
+		CanSend:      c.CanSend(),
+		ConnectedAt:  health.ConnectedAt,
+		LastReceived: health.LastReceived,
+		LatencyMs:    health.Latency.Milliseconds(),
+		PongTimeouts: health.PongTimeouts,
+		Queued:       c.QueueLength(),
+		Dropped:      c.DroppedMessages(),
+		Channels:     c.Channels(),
+	}
+}
+
+func handleChat(ctx context.Context, cnf twitchCnf, logger *slog.Logger, ew eventPublisher, relay *chatRelay) error {
 	logger = logger.With(logKeyCategory, "chat")
 
 	if !cnf.ChatIntegration {
@@ -28,33 +137,53 @@ func handleChat(ctx context.Context, cnf twitchCnf, logger *slog.Logger, ew even
 		return nil
 	}
 
-	if cnf.OAuthToken == "" || strings.Contains(cnf.OAuthToken, "id.twitch.tv") {
-		logger.Info("No credentials. Integration disabled.")
-		return nil
-	}
 	prefix := cnf.CommandPrefix
-	logger.Info("Starting Twitch chat integration")
 
-	c, err := irc.New(cnf.OAuthToken)
-	if err != nil {
-		return err
+	var c *irc.ChatClient
+	if cnf.ChatAnonymous {
+		logger.Info("Starting Twitch chat integration (anonymous, read-only)")
+		c = irc.NewAnonymous()
+	} else {
+		if cnf.OAuthToken == "" || strings.Contains(cnf.OAuthToken, "id.twitch.tv") {
+			logger.Info("No credentials. Integration disabled.")
+			return nil
+		}
+		logger.Info("Starting Twitch chat integration")
+
+		var err error
+		c, err = irc.New(cnf.OAuthToken)
+		if err != nil {
+			return err
+		}
+		if !c.CanSend() {
+			logger.Warn(`OAuth token does not contain "chat:edit" scope, chat_send requests are rejected`)
+		}
 	}
 
 	c.OnMessage(func(msg *irc.Message) error {
 		logger.Debug("message received", slog.String("trailer", msg.Trailer))
-		if !strings.HasPrefix(msg.Trailer, prefix) {
+		cmd, ok := chatcommand.Parse(prefix, msg.Trailer)
+		if !ok {
 			return nil
 		}
 		if len(msg.Trailer) > 40 {
 			msg.Trailer = msg.Trailer[:40]
 		}
 
-		data, err := json.Marshal(EventEnvelop{Type: "chat", Data: ChatMessage{Text: msg.Trailer, Sender: msg.Sender, Channel: msg.Channel}})
+		data, err := json.Marshal(EventEnvelop{Type: "chat", Data: ChatMessage{
+			Text:    msg.Trailer,
+			Sender:  msg.Sender,
+			Channel: msg.Channel,
+			Command: cmd.Name,
+			Args:    cmd.Args,
+		}})
 		if err != nil {
 			logger.Error("could not serialize message", slog.Any("err", err))
 			return nil
 		}
-		ew.Publish(data)
+		if err := ew.Publish(data); err != nil {
+			logger.Error("could not publish message", slog.Any("err", err), slog.String("sender", msg.Sender))
+		}
 		return nil
 	})
 
@@ -70,32 +199,29 @@ func handleChat(ctx context.Context, cnf twitchCnf, logger *slog.Logger, ew even
 		logger.Debug("received", slog.String("message", command))
 	}
 
-	for {
-		if err := c.OpenContext(ctx, twitch.IRCWebSocketURL); err != nil {
-			if errors.Is(err, context.Canceled) {
-				return nil
+	c.OnStateChange = func(sc irc.StateChange) {
+		switch sc.State {
+		case irc.StateConnecting:
+			logger.Info("connecting", slog.Int("attempt", sc.Attempt))
+		case irc.StateConnected:
+			logger.Info("connected")
+		case irc.StateJoined:
+			logger.Info("Joined", slog.String("channel", sc.Channel))
+		case irc.StateDisconnected:
+			if errors.Is(sc.Err, context.Canceled) {
+				logger.Info("disconnected")
+				return
 			}
-			logger.Error("failed to connect", slog.Any("err", err))
-			continue
+			logger.Warn("disconnected", slog.Any("err", sc.Err), slog.Duration("retry.after", sc.RetryIn))
 		}
-		defer c.Close()
-		logger.Info("connected")
-		break
 	}
 
-	for {
-		if err := c.JoinContext(ctx, cnf.Channel); err != nil {
-			if errors.Is(err, context.Canceled) {
-				return nil
-			}
-			logger.Error("failed to join", slog.Any("err", err))
-			continue
-		}
-		logger = logger.With(slog.String("channel", cnf.Channel))
-		logger.Info("Joined")
-		break
-	}
-	<-ctx.Done()
+	relay.set(c)
+	defer relay.set(nil)
 
-	return nil
+	url := cnf.IRCURL
+	if url == "" {
+		url = twitch.IRCWebSocketURL
+	}
+	return c.RunContext(ctx, url, cnf.chatChannels()...)
 }
@@ -1,11 +1,54 @@
 package main
 
-import "github.com/kirides/twitch-integration/twitch"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/kirides/twitch-integration/pipeproto"
+	"github.com/kirides/twitch-integration/transport"
+	"github.com/kirides/twitch-integration/twitch"
+)
 
 type config struct {
 	Debug          bool              `json:"debug"`
 	Twitch         twitchCnf         `json:"twitch"`
 	StreamElements streamElementsCnf `json:"streamElements"`
+	// EventJournal stores events until the game acknowledged them, empty disables it
+	EventJournal  string           `json:"event_journal"`
+	PendingEvents pendingEventsCnf `json:"pending_events"`
+	EventQueue    eventQueueCnf    `json:"event_queue"`
+	// Transport is how the game connects, it has to match the transport in the game's configuration
+	Transport transport.Config `json:"transport"`
+	// ShutdownTimeoutSec is how long to wait for services to stop before cancelling them
+	ShutdownTimeoutSec int      `json:"shutdown_timeout_sec"`
+	Admin              adminCnf `json:"admin"`
+}
+
+// adminCnf controls the HTTP admin API
+type adminCnf struct {
+	Enabled bool `json:"enabled"`
+	// Address must be a loopback address
+	Address string `json:"address"`
+	// Token has to be sent as "Authorization: Bearer <token>", it is generated when the API is enabled without one
+	Token string `json:"token"`
+}
+
+// eventQueueCnf controls the queue of events for each connected game
+type eventQueueCnf struct {
+	Size int `json:"size"`
+	// Overflow is "drop-oldest", "drop-newest" or "disconnect"
+	Overflow overflowPolicy `json:"overflow"`
+}
+
+// pendingEventsCnf controls which events are kept while no game is connected
+type pendingEventsCnf struct {
+	MaxEvents int `json:"max_events"`
+	// TTLSec is how long events of each type are kept, types without TTL are dropped
+	TTLSec map[string]int `json:"ttl_sec"`
 }
 
 type streamElementsCnf struct {
@@ -15,25 +58,49 @@ type streamElementsCnf struct {
 }
 
 type twitchCnf struct {
-	Channel                  string `json:"channel"`
-	OAuthToken               string `json:"oauth_token"`
-	ChannelPointsIntegration bool   `json:"channel_points"`
-	BitsIntegration          bool   `json:"bits"`
-	ChatIntegration          bool   `json:"chat"`
-	CommandPrefix            string `json:"command_prefix"`
-	EventSubURL              string `json:"eventsub_url"`
+	Channel                  string   `json:"channel"`
+	Channels                 []string `json:"channels"`
+	OAuthToken               string   `json:"oauth_token"`
+	ChannelPointsIntegration bool     `json:"channel_points"`
+	BitsIntegration          bool     `json:"bits"`
+	ChatIntegration          bool     `json:"chat"`
+	ChatAnonymous            bool     `json:"chat_anonymous"`
+	CommandPrefix            string   `json:"command_prefix"`
+	EventSubURL              string   `json:"eventsub_url"`
+	IRCURL                   string   `json:"irc_url"`
 }
 
 func defaultConfig() config {
 	return config{
+		EventJournal:       appName + ".journal",
+		Transport:          transport.Default(),
+		ShutdownTimeoutSec: 10,
+		Admin: adminCnf{
+			Address: "127.0.0.1:47111",
+		},
+		EventQueue: eventQueueCnf{
+			Size:     256,
+			Overflow: overflowDropOldest,
+		},
+		PendingEvents: pendingEventsCnf{
+			MaxEvents: 100,
+			TTLSec: map[string]int{
+				pipeproto.TypeChat:       0,
+				pipeproto.TypeRedemption: 900,
+				pipeproto.TypeBits:       900,
+				pipeproto.TypePerk:       900,
+			},
+		},
 		Twitch: twitchCnf{
-			OAuthToken:               "Get it here: https://id.twitch.tv/oauth2/authorize?response_type=token&client_id=1ab71yymdkcck627lsp93whxbmj0om&redirect_uri=https://twitchapps.com/tokengen/&scope=channel%3Aread%3Asubscriptions%20bits%3Aread%20channel%3Aread%3Aredemptions%20chat%3Aread",
+			OAuthToken:               "Get it here: https://id.twitch.tv/oauth2/authorize?response_type=token&client_id=1ab71yymdkcck627lsp93whxbmj0om&redirect_uri=https://twitchapps.com/tokengen/&scope=channel%3Aread%3Asubscriptions%20bits%3Aread%20channel%3Aread%3Aredemptions%20channel%3Amanage%3Aredemptions%20chat%3Aread%20chat%3Aedit",
 			CommandPrefix:            "#",
 			ChatIntegration:          true,
 			ChannelPointsIntegration: true,
 			BitsIntegration:          true,
 			Channel:                  "Channel name where commands will be sent",
+			Channels:                 []string{},
 			EventSubURL:              twitch.EventSubURL,
+			IRCURL:                   twitch.IRCWebSocketURL,
 		},
 		StreamElements: streamElementsCnf{
 			Enabled: false,
@@ -42,3 +109,91 @@ func defaultConfig() config {
 		},
 	}
 }
+
+// chatChannels returns all configured channels for chat commands
+func (c twitchCnf) chatChannels() []string {
+	var result []string
+	for _, channel := range append([]string{c.Channel}, c.Channels...) {
+		channel = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(channel), "#"))
+		if channel == "" || slices.Contains(result, channel) {
+			continue
+		}
+		result = append(result, channel)
+	}
+	return result
+}
+
+// validate rejects configurations the services cannot run with
+func (c config) validate() error {
+	switch c.EventQueue.Overflow {
+	case "", overflowDropOldest, overflowDropNewest, overflowDisconnect:
+	default:
+		return fmt.Errorf("event_queue.overflow must be %q, %q or %q, got %q", overflowDropOldest, overflowDropNewest, overflowDisconnect, c.EventQueue.Overflow)
+	}
+	if c.EventQueue.Size < 0 || c.PendingEvents.MaxEvents < 0 {
+		return errors.New("event_queue.size and pending_events.max_events must not be negative")
+	}
+	if c.ShutdownTimeoutSec < 0 {
+		return errors.New("shutdown_timeout_sec must not be negative")
+	}
+	if c.Admin.Enabled {
+		if _, _, err := net.SplitHostPort(c.Admin.Address); err != nil {
+			return fmt.Errorf("admin.address is invalid. %w", err)
+		}
+	}
+	return nil
+}
+
+// chatCnf returns the settings handleChat uses
+func (c twitchCnf) chatCnf() twitchCnf {
+	return twitchCnf{
+		Channel:         c.Channel,
+		Channels:        c.Channels,
+		OAuthToken:      c.OAuthToken,
+		ChatIntegration: c.ChatIntegration,
+		ChatAnonymous:   c.ChatAnonymous,
+		CommandPrefix:   c.CommandPrefix,
+		IRCURL:          c.IRCURL,
+	}
+}
+
+// eventSubCnf returns the settings handleEventSub uses
+func (c twitchCnf) eventSubCnf() twitchCnf {
+	return twitchCnf{
+		OAuthToken:               c.OAuthToken,
+		ChannelPointsIntegration: c.ChannelPointsIntegration,
+		BitsIntegration:          c.BitsIntegration,
+		EventSubURL:              c.EventSubURL,
+	}
+}
+
+// configChanges returns the services that have to be restarted to apply next,
+// and the settings that only apply after restarting the connector
+func configChanges(prev, next config) (services, restartRequired []string) {
+	if !reflect.DeepEqual(prev.Twitch.chatCnf(), next.Twitch.chatCnf()) {
+		services = append(services, serviceChat)
+	}
+	if !reflect.DeepEqual(prev.Twitch.eventSubCnf(), next.Twitch.eventSubCnf()) {
+		services = append(services, serviceEventSub)
+	}
+	if prev.StreamElements != next.StreamElements {
+		services = append(services, serviceStreamElements)
+	}
+	if prev.Admin != next.Admin {
+		services = append(services, serviceAdmin)
+	}
+
+	if prev.Transport != next.Transport {
+		restartRequired = append(restartRequired, "transport")
+	}
+	if prev.EventJournal != next.EventJournal {
+		restartRequired = append(restartRequired, "event_journal")
+	}
+	if prev.EventQueue != next.EventQueue {
+		restartRequired = append(restartRequired, "event_queue")
+	}
+	if !reflect.DeepEqual(prev.PendingEvents, next.PendingEvents) {
+		restartRequired = append(restartRequired, "pending_events")
+	}
+	return services, restartRequired
+}
@@ -16,12 +16,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"log/slog"
 
 	"slices"
 
+	"github.com/kirides/twitch-integration/pipeproto"
 	"github.com/kirides/twitch-integration/twitch"
 	"github.com/kirides/twitch-integration/twitch/eventsub"
 )
@@ -30,6 +34,80 @@ type Redemption struct {
 	Title    string `json:"title"`
 	Redeemer string `json:"redeemer"`
 	Channel  string `json:"channel"`
+	// Input is the text the redeemer entered, if the reward asks for it
+	Input string `json:"input,omitempty"`
+	// ID and RewardID identify the redemption for redemption_update requests
+	ID       string `json:"id,omitempty"`
+	RewardID string `json:"reward_id,omitempty"`
+}
+
+// scopeManageRedemptions is required to update redemptions
+const scopeManageRedemptions = "channel:manage:redemptions"
+
+var (
+	errRedemptionsUnavailable  = pipeproto.Errorf(pipeproto.CodeUnavailable, "channel points integration is not running")
+	errRedemptionsMissingScope = pipeproto.Errorf(pipeproto.CodeUnavailable, "OAuth token does not contain %q scope, required to update redemptions", scopeManageRedemptions)
+)
+
+// redemptionRelay updates redemptions through the eventsub connection of handleEventSub while it is running
+type redemptionRelay struct {
+	mtx           sync.Mutex
+	conn          *eventsub.WebsocketConnection
+	broadcasterID string
+	// canManage is false if the token lacks scopeManageRedemptions
+	canManage bool
+	// reconnects of previous connections, the service creates a new connection on restart
+	reconnects int
+}
+
+func (r *redemptionRelay) set(conn *eventsub.WebsocketConnection, broadcasterID string, canManage bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.conn != nil {
+		r.reconnects += r.conn.Status().Reconnects
+	}
+	r.conn = conn
+	r.broadcasterID = broadcasterID
+	r.canManage = canManage
+}
+
+// reconnectCount returns the reconnects of all connections since the start
+func (r *redemptionRelay) reconnectCount() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	n := r.reconnects
+	if r.conn != nil {
+		n += r.conn.Status().Reconnects
+	}
+	return n
+}
+
+// status returns nil while handleEventSub is not running
+func (r *redemptionRelay) status() *eventsub.Status {
+	r.mtx.Lock()
+	conn := r.conn
+	r.mtx.Unlock()
+	if conn == nil {
+		return nil
+	}
+	status := conn.Status()
+	return &status
+}
+
+// Update sets the status of the redemption
+func (r *redemptionRelay) Update(ctx context.Context, u pipeproto.RedemptionUpdate) error {
+	r.mtx.Lock()
+	conn, broadcasterID, canManage := r.conn, r.broadcasterID, r.canManage
+	r.mtx.Unlock()
+	if conn == nil {
+		return errRedemptionsUnavailable
+	}
+	if !canManage {
+		return errRedemptionsMissingScope
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return conn.UpdateRedemptionStatus(ctx, broadcasterID, u.RewardID, u.RedemptionID, u.Status)
 }
 
 type BitsEvent struct {
@@ -38,25 +116,24 @@ type BitsEvent struct {
 	Channel  string `json:"channel"`
 }
 
-func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, broker eventPublisher) {
+func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, broker eventPublisher, redemptions *redemptionRelay) error {
 	logger = logger.With(logKeyCategory, "eventsub")
 
 	if !cnf.ChannelPointsIntegration && !cnf.BitsIntegration {
 		logger.Info("integration disabled by configuration.")
-		return
+		return nil
 	}
 
 	if strings.Contains(cnf.OAuthToken, "id.twitch.tv") || cnf.OAuthToken == "" {
 		logger.Info("No credentials. Integration disabled.")
-		return
+		return nil
 	}
 
 	logger.Info("Starting Twitch Channelpoints integration.")
 
-	resp, err := twitch.OAuth2Validate(context.Background(), cnf.OAuthToken)
+	resp, err := twitch.OAuth2Validate(ctx, cnf.OAuthToken)
 	if err != nil {
-		logger.Error("Could not validate OAuth Token", slog.Any("err", err))
-		return
+		return fmt.Errorf("could not validate OAuth token. %w", err)
 	}
 
 	subFns := []func(subscriptions map[string]eventsub.Condition){}
@@ -69,13 +146,22 @@ func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, bro
 			userWithoutSpaces = strings.Replace(userWithoutSpaces, " ", "", -1)
 
 			redemption := rr.Reward.Title
-			data, err := json.Marshal(EventEnvelop{Type: "redemption", Data: Redemption{Title: redemption, Redeemer: userWithoutSpaces, Channel: "-"}})
+			data, err := json.Marshal(EventEnvelop{Type: "redemption", Data: Redemption{
+				Title:    redemption,
+				Redeemer: userWithoutSpaces,
+				Channel:  "-",
+				Input:    rr.UserInput,
+				ID:       rr.ID,
+				RewardID: rr.Reward.ID,
+			}})
 			if err != nil {
 				logger.Error("could not serialize redemption", slog.Any("err", err), slog.String("redeeming_user", rr.UserLogin))
 				return
 			}
 			logger.Debug("Reward redeemed", slog.String("redeeming_user", rr.UserLogin), slog.String("reward", redemption))
-			broker.Publish(data)
+			if err := broker.Publish(data); err != nil {
+				logger.Error("could not publish redemption", slog.Any("err", err), slog.String("redeeming_user", rr.UserLogin))
+			}
 		},
 		OnChannelCheer: func(rr eventsub.ChannelCheer) {
 
@@ -94,7 +180,9 @@ func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, bro
 				return
 			}
 			logger.Debug("Reward redeemed", slog.String("user", username), slog.Int64("bits", rr.Bits))
-			broker.Publish(data)
+			if err := broker.Publish(data); err != nil {
+				logger.Error("could not publish bits", slog.Any("err", err), slog.String("user", username))
+			}
 		},
 		OnChannelBitsUse: func(rr eventsub.ChannelBitsUse) {
 			logger.Info("ChannelBitsUse", slog.Any("BitsEvent", rr))
@@ -114,14 +202,18 @@ func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, bro
 				return
 			}
 			logger.Debug("Reward redeemed", slog.String("user", username), slog.Int64("bits", rr.Bits))
-			broker.Publish(data)
+			if err := broker.Publish(data); err != nil {
+				logger.Error("could not publish bits", slog.Any("err", err), slog.String("user", username))
+			}
 		},
 	}
 
 	if cnf.ChannelPointsIntegration {
 		if found := slices.Contains(resp.Scopes, "channel:read:redemptions"); !found {
-			logger.Error("OAuth token does not contain required scope(s)", slog.String("err", "scope not satisfied"), slog.String("scope", "channel:read:redemptions"))
-			return
+			return fmt.Errorf("OAuth token does not contain required scope %q", "channel:read:redemptions")
+		}
+		if !slices.Contains(resp.Scopes, scopeManageRedemptions) {
+			logger.Warn("OAuth token does not contain scope, redemption_update requests are rejected", slog.String("scope", scopeManageRedemptions))
 		}
 		subFns = append(subFns, func(subscriptions map[string]eventsub.Condition) {
 			subscriptions[eventsub.SubChannelChannelPointsCustomRewardRedemptionAdd] = eventsub.Condition{
@@ -132,8 +224,7 @@ func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, bro
 
 	if cnf.BitsIntegration {
 		if found := slices.Contains(resp.Scopes, "bits:read"); !found {
-			logger.Error("OAuth token does not contain required scope(s)", slog.String("err", "scope not satisfied"), slog.String("scope", "bits:read"))
-			return
+			return fmt.Errorf("OAuth token does not contain required scope %q", "bits:read")
 		}
 
 		// do not raise twice, TODO: replace channel.cheer with channel.bits.use once it's testable
@@ -151,7 +242,7 @@ func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, bro
 
 	if len(subFns) == 0 {
 		logger.Info("No integrations enabled")
-		return
+		return nil
 	}
 
 	conn, err := eventsub.NewWebsocket(
@@ -166,8 +257,7 @@ func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, bro
 		})
 
 	if err != nil {
-		logger.Error("failed to connect to twitch eventsub.", slog.Any("err", err))
-		return
+		return fmt.Errorf("failed to connect to twitch eventsub. %w", err)
 	}
 	conn.EventSubURL = cnf.EventSubURL
 
@@ -177,11 +267,11 @@ func handleEventSub(ctx context.Context, logger *slog.Logger, cnf twitchCnf, bro
 		logger.Debug("EVENT RECEIVED", slog.String("type", e.Metadata.MessageType), slog.String("data", string(e.Payload)))
 	}
 
-	go func() {
-		if err := conn.RunContext(ctx); err != nil {
-			logger.Error("failed to process events.", slog.Any("err", err))
-			return
-		}
-	}()
-	<-ctx.Done()
+	redemptions.set(conn, resp.UserID, slices.Contains(resp.Scopes, scopeManageRedemptions))
+	defer redemptions.set(nil, "", false)
+
+	if err := conn.RunContext(ctx); err != nil {
+		return fmt.Errorf("failed to process events. %w", err)
+	}
+	return nil
 }
@@ -3,16 +3,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"io"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"log/slog"
 
-	"github.com/Microsoft/go-winio"
+	"github.com/kirides/twitch-integration/journal"
+	"github.com/kirides/twitch-integration/transport"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -20,15 +24,25 @@ const (
 	appName        = "twitch-integration-connector"
 	configFileName = appName + ".json"
 	logKeyCategory = "category"
+	// maxPendingEvents limits the unacknowledged events kept in the journal
+	maxPendingEvents = 1000
+)
+
+// services restarted when their configuration changes
+const (
+	serviceChat           = "twitch chat"
+	serviceEventSub       = "twitch pubsub"
+	serviceStreamElements = "stream elements"
+	serviceAdmin          = "admin api"
 )
 
 type eventPublisher interface {
-	Publish(evt []byte)
+	// Publish must not block, it fails if the event could not be queued
+	Publish(evt []byte) error
 }
 
 func main() {
-	level := slog.LevelInfo
-	logLeveler := &level
+	logLeveler := &slog.LevelVar{}
 
 	logFile := &lumberjack.Logger{
 		Filename: appName + ".log",
@@ -51,58 +65,88 @@ func main() {
 	}
 
 	if cnf.Debug {
-		*logLeveler = slog.LevelDebug
+		logLeveler.Set(slog.LevelDebug)
 	}
+	// live is replaced when the configuration file changes, services read it whenever they start
+	live := &atomic.Pointer[config]{}
+	live.Store(&cnf)
 
 	appCtx, appCtxCancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer appCtxCancel()
 
-	eventCh := make(chan []byte, 10)
-	const (
-		SIDEveryone          = `D:(A;;GWGR;;;WD)`
-		SIDAllUsers          = `D:(A;;GWGR;;;AU)`
-		SIDAllUsersNoNetwork = `D:(A;;GWGR;;;AU)(D;;GA;;;NS)`
-		SIDInteractiveUser   = `D:(A;;GWGR;;;IU)`
-	)
-	pipePath := `\\.\pipe\__TwitchIntegration_Kirides_Conn`
-	ps, err := winio.ListenPipe(pipePath, &winio.PipeConfig{MessageMode: true, SecurityDescriptor: SIDInteractiveUser})
+	ps, err := transport.Listen(cnf.Transport)
 	if err != nil {
-		logger.Error("Could not setup pipe listener", slog.Any("err", err))
+		logger.Error("Could not setup pipe listener", slog.Any("err", err), slog.String("transport", cnf.Transport.String()))
 		return
 	}
+	logger.Info("Waiting for the game", slog.String("transport", cnf.Transport.String()))
 
 	services := newServiceManager(logger)
 
 	defer ps.Close()
-	services.Add("pipelistener stopping routine", func(ctx context.Context) {
+	services.Add("pipelistener stopping routine", phaseTransports, restartNever, func(ctx context.Context) error {
 		<-ctx.Done()
-		ps.Close()
+		return ps.Close()
 	})
-	broker := newBroker()
-	services.Add("data broker", func(ctx context.Context) {
-		broker.Run(ctx)
-		close(eventCh)
+	var eventJournal *journal.Journal
+	if cnf.EventJournal != "" {
+		eventJournal, err = journal.Open(cnf.EventJournal, maxPendingEvents)
+		if err != nil {
+			logger.Error("Could not open event journal", slog.Any("err", err))
+			return
+		}
+		defer eventJournal.Close()
+	}
+	broker := newBroker(logger, eventJournal, cnf.PendingEvents, cnf.EventQueue)
+	relay := &chatRelay{}
+	redemptions := &redemptionRelay{}
+	seStatus := &streamElementsStatus{}
+	stats := &connectorStats{startedAt: time.Now()}
+	state := &gameState{}
+	requests := newRequestDispatcher()
+	registerProviders(requests, broker, relay, redemptions, stats, state)
+	connMetrics := newMetrics(services, broker, stats, relay, redemptions, seStatus)
+	services.Add("data broker", phaseDelivery, restartNever, broker.Run)
+	services.Add("pipelistener", phaseTransports, restartNever, func(ctx context.Context) error {
+		handlePipeClients(ctx, logger, ps, broker, requests, stats)
+		return nil
 	})
-	services.Add("pipelistener", func(ctx context.Context) {
-		handlePipeClients(ctx, logger, ps, broker)
+	services.Add(serviceStreamElements, phaseProviders, restartOnFailure, func(ctx context.Context) error {
+		return handleStreamElements(ctx, live.Load().StreamElements, logger, connMetrics.publisher(broker, sourceStreamElements), seStatus)
 	})
-	services.Add("stream elements", func(ctx context.Context) {
-		if err := handleStreamElements(ctx, cnf.StreamElements, logger, broker); err != nil {
-			logger.Error("failed to handle stream elements", slog.Any("err", err))
-		}
+	services.Add(serviceChat, phaseProviders, restartOnFailure, func(ctx context.Context) error {
+		return handleChat(ctx, live.Load().Twitch, logger, connMetrics.publisher(broker, sourceIRC), relay)
 	})
-	services.Add("twitch chat", func(ctx context.Context) {
-		if err := handleChat(ctx, cnf.Twitch, logger, broker); err != nil {
-			logger.Error("failed to handle twitch chat", slog.Any("err", err))
-		}
+	services.Add(serviceEventSub, phaseProviders, restartOnFailure, func(ctx context.Context) error {
+		return handleEventSub(ctx, logger, live.Load().Twitch, connMetrics.publisher(broker, sourceEventSub), redemptions)
 	})
-	services.Add("twitch pubsub", func(ctx context.Context) {
-		handleEventSub(ctx, logger, cnf.Twitch, broker)
+	admin := &adminServer{
+		services:       services,
+		broker:         broker,
+		stats:          stats,
+		chat:           relay,
+		redemptions:    redemptions,
+		streamElements: seStatus,
+		state:          state,
+		metrics:        connMetrics.registry,
+	}
+	services.Add(serviceAdmin, phaseTransports, restartOnFailure, func(ctx context.Context) error {
+		return serveAdmin(ctx, logger, live.Load().Admin, admin)
+	})
+	services.Add("config watcher", phaseProviders, restartOnFailure, func(ctx context.Context) error {
+		return watchConfig(ctx, logger, func(next config) {
+			prev := live.Swap(&next)
+			applyConfig(logger, services, logLeveler, *prev, next)
+		})
 	})
 	<-appCtx.Done()
+	// a second interrupt terminates right away
+	appCtxCancel()
 	logger.Info("Shutting down")
 
-	services.Stop()
+	if err := services.Stop(time.Duration(live.Load().ShutdownTimeoutSec) * time.Second); err != nil {
+		logger.Error("Shutdown incomplete", slog.Any("err", err))
+	}
 }
 
 type loggerFn func(format string, args ...interface{})
@@ -120,6 +164,7 @@ func prettyJson(data any) ([]byte, error) {
 	return buf.Bytes(), err
 }
 
+// readAndUpdateConfig reads the configuration, a missing file is created with the defaults
 func readAndUpdateConfig() (config, error) {
 	confFilePath, err := filepath.Abs(configFileName)
 	cnf := defaultConfig()
@@ -134,29 +179,41 @@ func readAndUpdateConfig() (config, error) {
 		confFilePath = filepath.Join(filepath.Dir(execPath), configFileName)
 	*/
 
-	writeConfigIndented := func(cnf config) error {
-		data, err := prettyJson(cnf)
-		if err != nil {
-			return err
-		}
-		os.WriteFile(confFilePath, data, 0640)
-		return nil
-	}
-
 	configContent, err := os.ReadFile(confFilePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if err := writeConfigIndented(cnf); err != nil {
+			data, err := prettyJson(cnf)
+			if err != nil {
 				return cnf, err
 			}
+			os.WriteFile(confFilePath, data, 0640)
+			return cnf, nil
 		}
-	} else {
-		if err := json.Unmarshal(configContent, &cnf); err != nil {
-			return cnf, err
-		}
-		if err := writeConfigIndented(cnf); err != nil {
-			return cnf, err
-		}
+		return cnf, err
+	}
+	return loadConfig(confFilePath, configContent)
+}
+
+// loadConfig parses and validates the content of the configuration file.
+// Settings missing in the file and a generated admin token are written back to it.
+func loadConfig(confFilePath string, configContent []byte) (config, error) {
+	cnf := defaultConfig()
+	if err := json.Unmarshal(configContent, &cnf); err != nil {
+		return cnf, err
+	}
+	if cnf.Admin.Enabled && cnf.Admin.Token == "" {
+		cnf.Admin.Token = rand.Text()
+	}
+	if err := cnf.validate(); err != nil {
+		return cnf, err
+	}
+	data, err := prettyJson(cnf)
+	if err != nil {
+		return cnf, err
+	}
+	// writing an unchanged file would trigger another reload
+	if !bytes.Equal(data, configContent) {
+		os.WriteFile(confFilePath, data, 0640)
 	}
 	return cnf, nil
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/kirides/twitch-integration/metrics"
+)
+
+const metricsPrefix = "twitch_integration_"
+
+// event sources of the events metric
+const (
+	sourceIRC            = "irc"
+	sourceEventSub       = "eventsub"
+	sourceStreamElements = "streamelements"
+)
+
+// countingPublisher counts the events of a provider by type before publishing them.
+// Malformed events are not counted, the broker rejects them.
+type countingPublisher struct {
+	eventPublisher
+	events *metrics.CounterVec
+	source string
+}
+
+func (p countingPublisher) Publish(evt []byte) error {
+	var env struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(evt, &env); err == nil {
+		p.events.With(p.source, env.Type).Inc()
+	}
+	return p.eventPublisher.Publish(evt)
+}
+
+// connectorMetrics are served by the admin API
+type connectorMetrics struct {
+	registry *metrics.Registry
+	events   *metrics.CounterVec
+}
+
+// publisher returns a publisher counting the events of source
+func (m *connectorMetrics) publisher(pub eventPublisher, source string) eventPublisher {
+	return countingPublisher{eventPublisher: pub, events: m.events, source: source}
+}
+
+func newMetrics(services *serviceManager, broker *dataBroker, stats *connectorStats, chat *chatRelay, redemptions *redemptionRelay, streamElements *streamElementsStatus) *connectorMetrics {
+	r := metrics.NewRegistry()
+	m := &connectorMetrics{
+		registry: r,
+		events:   r.NewCounter(metricsPrefix+"events", "Events received from the providers.", "source", "type"),
+	}
+	gauge := func(name, help string, fn func() float64) {
+		r.Collect(metricsPrefix+name, help, metrics.TypeGauge, nil, func(emit metrics.EmitFunc) { emit(fn()) })
+	}
+	counter := func(name, help string, fn func() float64) {
+		r.Collect(metricsPrefix+name, help, metrics.TypeCounter, nil, func(emit metrics.EmitFunc) { emit(fn()) })
+	}
+
+	counter("broker_published", "Events accepted by the broker.", func() float64 { return float64(broker.Published()) })
+	counter("broker_rejected", "Events dropped because the broker did not keep up.", func() float64 { return float64(broker.Rejected()) })
+	counter("broker_dropped", "Events discarded while no game was connected.", func() float64 { return float64(broker.Dropped()) })
+	gauge("broker_unacknowledged", "Events in the journal waiting to be acknowledged.", func() float64 { return float64(len(broker.Pending())) })
+	r.Collect(metricsPrefix+"broker_client_delivered", "Events written to a client.", metrics.TypeCounter, []string{"client"}, func(emit metrics.EmitFunc) {
+		for _, q := range broker.Subscriptions() {
+			emit(float64(q.Delivered), q.Name)
+		}
+	})
+	r.Collect(metricsPrefix+"broker_client_dropped", "Events dropped because a client did not keep up.", metrics.TypeCounter, []string{"client"}, func(emit metrics.EmitFunc) {
+		for _, q := range broker.Subscriptions() {
+			emit(float64(q.Dropped), q.Name)
+		}
+	})
+	r.Collect(metricsPrefix+"broker_client_queued", "Events waiting to be written to a client.", metrics.TypeGauge, []string{"client"}, func(emit metrics.EmitFunc) {
+		for _, q := range broker.Subscriptions() {
+			emit(float64(q.Queued), q.Name)
+		}
+	})
+	gauge("pipe_clients", "Connected game clients.", func() float64 { return float64(stats.clients.Load()) })
+	counter("events_acked", "Events acknowledged by the game clients.", func() float64 { return float64(stats.eventsAcked.Load()) })
+
+	r.Collect(metricsPrefix+"provider_connected", "Whether a provider is connected.", metrics.TypeGauge, []string{"provider"}, func(emit metrics.EmitFunc) {
+		irc, es := chat.status(), redemptions.status()
+		emit(boolValue(irc != nil && irc.Connected), sourceIRC)
+		emit(boolValue(es != nil && es.Connected), sourceEventSub)
+		emit(boolValue(streamElements.snapshot().Connected), sourceStreamElements)
+	})
+	r.Collect(metricsPrefix+"provider_reconnects", "Connections to a provider after the first one.", metrics.TypeCounter, []string{"provider"}, func(emit metrics.EmitFunc) {
+		reconnects, _ := chat.counters()
+		emit(float64(reconnects), sourceIRC)
+		emit(float64(redemptions.reconnectCount()), sourceEventSub)
+		emit(float64(streamElements.reconnects()), sourceStreamElements)
+	})
+	r.Collect(metricsPrefix+"keepalive_latency_seconds", "Round-trip time of the last IRC PING, delay of the last EventSub keepalive.", metrics.TypeGauge, []string{"provider"}, func(emit metrics.EmitFunc) {
+		if s := chat.status(); s != nil {
+			emit(float64(s.LatencyMs)/1000, sourceIRC)
+		}
+		if s := redemptions.status(); s != nil {
+			emit(float64(s.KeepaliveLatencyMs)/1000, sourceEventSub)
+		}
+	})
+
+	gauge("chat_send_queue", "Chat messages waiting to be sent.", func() float64 {
+		if s := chat.status(); s != nil {
+			return float64(s.Queued)
+		}
+		return 0
+	})
+	counter("chat_rate_limited", "Chat messages rejected or dropped because of rate limits.", func() float64 {
+		_, rateLimited := chat.counters()
+		return float64(rateLimited)
+	})
+
+	gauge("eventsub_subscription_cost", "Total cost of the EventSub subscriptions.", func() float64 {
+		if s := redemptions.status(); s != nil {
+			return float64(s.TotalCost)
+		}
+		return 0
+	})
+	gauge("eventsub_subscription_max_cost", "Maximum total cost of EventSub subscriptions allowed by twitch.", func() float64 {
+		if s := redemptions.status(); s != nil {
+			return float64(s.MaxTotalCost)
+		}
+		return 0
+	})
+	r.Collect(metricsPrefix+"eventsub_subscriptions", "EventSub subscriptions by status.", metrics.TypeGauge, []string{"type", "status"}, func(emit metrics.EmitFunc) {
+		if s := redemptions.status(); s != nil {
+			for _, sub := range s.Subscriptions {
+				emit(1, sub.Type, sub.Status)
+			}
+		}
+	})
+
+	r.Collect(metricsPrefix+"service_restarts", "Restarts of a connector service.", metrics.TypeCounter, []string{"service"}, func(emit metrics.EmitFunc) {
+		for _, s := range services.Status() {
+			emit(float64(s.Restarts), s.Name)
+		}
+	})
+	return m
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
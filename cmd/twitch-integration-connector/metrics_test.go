@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kirides/twitch-integration/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type publisherFunc func(evt []byte) error
+
+func (f publisherFunc) Publish(evt []byte) error {
+	return f(evt)
+}
+
+func TestCountingPublisherSkipsMalformedEvents(t *testing.T) {
+	r := metrics.NewRegistry()
+	m := &connectorMetrics{registry: r, events: r.NewCounter("events", "", "source", "type")}
+	published := 0
+	pub := m.publisher(publisherFunc(func([]byte) error { published++; return nil }), sourceIRC)
+
+	require.NoError(t, pub.Publish([]byte(`{"type":"chat","data":{}}`)))
+	require.NoError(t, pub.Publish([]byte(`{"type":"chat","data":{}}`)))
+	require.NoError(t, pub.Publish([]byte(`not json`)))
+	assert.Equal(t, 3, published)
+
+	var sb strings.Builder
+	_, err := r.WriteTo(&sb)
+	require.NoError(t, err)
+	assert.Contains(t, sb.String(), `events_total{source="irc",type="chat"} 2`+"\n")
+	assert.NotContains(t, sb.String(), `type=""`)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+)
+
+// pendingEvents holds events published while no game client is connected.
+// It is not safe for concurrent use, the broker owns it.
+type pendingEvents struct {
+	maxEvents int
+	ttl       map[string]time.Duration
+	events    []pendingEvent
+}
+
+type pendingEvent struct {
+	evt     brokerEvent
+	expires time.Time
+}
+
+func newPendingEvents(cnf pendingEventsCnf) *pendingEvents {
+	ttl := make(map[string]time.Duration, len(cnf.TTLSec))
+	for typ, sec := range cnf.TTLSec {
+		ttl[typ] = time.Duration(sec) * time.Second
+	}
+	return &pendingEvents{maxEvents: cnf.MaxEvents, ttl: ttl}
+}
+
+// hold keeps evt until it expires and returns the events that were dropped,
+// either evt itself if its type is not kept or the oldest events once the buffer is full.
+func (p *pendingEvents) hold(evt brokerEvent, now time.Time) []brokerEvent {
+	ttl := p.ttl[evt.Type]
+	if ttl <= 0 || p.maxEvents <= 0 {
+		return []brokerEvent{evt}
+	}
+	dropped := p.expire(now)
+	p.events = append(p.events, pendingEvent{evt: evt, expires: now.Add(ttl)})
+	if over := len(p.events) - p.maxEvents; over > 0 {
+		for _, e := range p.events[:over] {
+			dropped = append(dropped, e.evt)
+		}
+		p.events = append(p.events[:0], p.events[over:]...)
+	}
+	return dropped
+}
+
+// discards reports whether events of typ are configured to not be kept, with a TTL of 0
+func (p *pendingEvents) discards(typ string) bool {
+	ttl, ok := p.ttl[typ]
+	return ok && ttl <= 0
+}
+
+// expire removes and returns the expired events
+func (p *pendingEvents) expire(now time.Time) []brokerEvent {
+	var expired []brokerEvent
+	kept := p.events[:0]
+	for _, e := range p.events {
+		if now.After(e.expires) {
+			expired = append(expired, e.evt)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	clear(p.events[len(kept):])
+	p.events = kept
+	return expired
+}
+
+// take empties the buffer and returns the events that did not expire, oldest first
+func (p *pendingEvents) take(now time.Time) (events, expired []brokerEvent) {
+	expired = p.expire(now)
+	for _, e := range p.events {
+		events = append(events, e.evt)
+	}
+	p.events = nil
+	return events, expired
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"log/slog"
+
+	"github.com/kirides/twitch-integration/journal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func eventIDs(events []brokerEvent) []uint64 {
+	var ids []uint64
+	for _, e := range events {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func TestPendingEventsHold(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		maxEvents int
+		held      []brokerEvent
+		dropped   []uint64
+		kept      []uint64
+	}{
+		{
+			name:      "kept",
+			maxEvents: 10,
+			held:      []brokerEvent{{ID: 1, Type: "redemption"}, {ID: 2, Type: "bits"}},
+			kept:      []uint64{1, 2},
+		},
+		{
+			name:      "ttl of zero",
+			maxEvents: 10,
+			held:      []brokerEvent{{ID: 1, Type: "chat"}, {ID: 2, Type: "redemption"}},
+			dropped:   []uint64{1},
+			kept:      []uint64{2},
+		},
+		{
+			name:      "type without ttl",
+			maxEvents: 10,
+			held:      []brokerEvent{{ID: 1, Type: "unknown"}},
+			dropped:   []uint64{1},
+		},
+		{
+			name:      "oldest above max events",
+			maxEvents: 2,
+			held:      []brokerEvent{{ID: 1, Type: "bits"}, {ID: 2, Type: "bits"}, {ID: 3, Type: "bits"}},
+			dropped:   []uint64{1},
+			kept:      []uint64{2, 3},
+		},
+		{
+			name:      "disabled",
+			maxEvents: 0,
+			held:      []brokerEvent{{ID: 1, Type: "bits"}},
+			dropped:   []uint64{1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPendingEvents(pendingEventsCnf{
+				MaxEvents: tt.maxEvents,
+				TTLSec:    map[string]int{"chat": 0, "redemption": 60, "bits": 60},
+			})
+			var dropped []brokerEvent
+			for _, evt := range tt.held {
+				dropped = append(dropped, p.hold(evt, now)...)
+			}
+			assert.Equal(t, tt.dropped, eventIDs(dropped))
+
+			events, expired := p.take(now)
+			assert.Equal(t, tt.kept, eventIDs(events))
+			assert.Empty(t, expired)
+		})
+	}
+}
+
+func TestPendingEventsExpire(t *testing.T) {
+	p := newPendingEvents(pendingEventsCnf{
+		MaxEvents: 10,
+		TTLSec:    map[string]int{"redemption": 60, "bits": 300},
+	})
+	now := time.Now()
+	assert.Empty(t, p.hold(brokerEvent{ID: 1, Type: "redemption"}, now))
+	assert.Empty(t, p.hold(brokerEvent{ID: 2, Type: "bits"}, now))
+	assert.Empty(t, p.hold(brokerEvent{ID: 3, Type: "redemption"}, now.Add(30*time.Second)))
+
+	assert.Empty(t, p.expire(now.Add(time.Minute)))
+	assert.Equal(t, []uint64{1}, eventIDs(p.expire(now.Add(61*time.Second))))
+
+	events, expired := p.take(now.Add(2 * time.Minute))
+	assert.Equal(t, []uint64{2}, eventIDs(events))
+	assert.Equal(t, []uint64{3}, eventIDs(expired))
+
+	events, expired = p.take(now)
+	assert.Empty(t, events)
+	assert.Empty(t, expired)
+}
+
+func TestBrokerDropKeepsJournaledEvents(t *testing.T) {
+	j, err := journal.Open(filepath.Join(t.TempDir(), "events.journal"), 0)
+	require.NoError(t, err)
+	defer j.Close()
+
+	b := newBroker(slog.New(slog.DiscardHandler), j, pendingEventsCnf{
+		MaxEvents: 1,
+		TTLSec:    map[string]int{"chat": 0, "redemption": 60},
+	}, eventQueueCnf{})
+	b.publish([]byte(`{"type":"chat","data":{}}`))
+	b.publish([]byte(`{"type":"redemption","data":{"n":1}}`))
+	b.publish([]byte(`{"type":"redemption","data":{"n":2}}`))
+	b.drop(b.pending.expire(time.Now().Add(time.Hour)), "expired")
+
+	// chat is configured to not be kept, the evicted and expired redemptions are delivered on the next connect
+	var types []string
+	for _, e := range b.Pending() {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{"redemption", "redemption"}, types)
+	assert.Equal(t, int64(1), b.Dropped())
+}
+
+func TestBrokerDropWithoutJournal(t *testing.T) {
+	b := newBroker(slog.New(slog.DiscardHandler), nil, pendingEventsCnf{
+		MaxEvents: 1,
+		TTLSec:    map[string]int{"redemption": 60},
+	}, eventQueueCnf{})
+	b.publish([]byte(`{"type":"redemption","data":{"n":1}}`))
+	b.publish([]byte(`{"type":"redemption","data":{"n":2}}`))
+	assert.Equal(t, int64(1), b.Dropped())
+}
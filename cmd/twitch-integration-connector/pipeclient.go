@@ -2,63 +2,281 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
 
-	"github.com/Microsoft/go-winio"
+	"github.com/kirides/twitch-integration/pipeproto"
+	"github.com/kirides/twitch-integration/transport"
 )
 
-func handlePipeClients(ctx context.Context, logger *slog.Logger, ps net.Listener, broker *dataBroker) {
+// connectorHello is sent to clients that start a handshake
+var connectorHello = pipeproto.Hello{
+	Version:      pipeproto.CurrentVersion,
+	MinVersion:   pipeproto.Version1,
+	Client:       appName,
+	Events:       []string{pipeproto.TypeChat, pipeproto.TypeRedemption, pipeproto.TypeBits, pipeproto.TypePerk},
+	MaxFrameSize: pipeproto.DefaultMaxFrameSize,
+}
+
+// handshakeWait is how long to wait for a client's hello before assuming it only speaks Version1
+const handshakeWait = time.Second
+
+// pipeClient is a game integration connected to the pipe
+type pipeClient struct {
+	name        string
+	connectedAt time.Time
+	conn        net.Conn
+	w           *pipeproto.FrameWriter
+	logger      *slog.Logger
+	// peer is the client name sent in the handshake
+	peer atomic.Pointer[string]
+	// events are the event types the client accepts, nil accepts all
+	events atomic.Pointer[map[string]struct{}]
+	// version is the negotiated protocol version, clients acknowledge events starting with Version2
+	version    atomic.Int32
+	negotiated chan struct{}
+}
+
+func newPipeClient(name string, conn net.Conn, logger *slog.Logger) *pipeClient {
+	c := &pipeClient{
+		name:        name,
+		connectedAt: time.Now(),
+		conn:        conn,
+		w:           pipeproto.NewFrameWriter(conn),
+		logger:      logger.With(slog.String("client", name)),
+		negotiated:  make(chan struct{}),
+	}
+	c.version.Store(pipeproto.Version1)
+	return c
+}
+
+// accepts reports whether the client listed the type of evt in its handshake
+func (c *pipeClient) accepts(evt brokerEvent) bool {
+	events := c.events.Load()
+	if events == nil {
+		return true
+	}
+	_, ok := (*events)[evt.Type]
+	return ok
+}
+
+// acknowledges reports whether the client sends acks for the events it handled
+func (c *pipeClient) acknowledges() bool {
+	return c.version.Load() >= pipeproto.Version2
+}
+
+func handlePipeClients(ctx context.Context, logger *slog.Logger, ps net.Listener, broker *dataBroker, requests *requestDispatcher, stats *connectorStats) {
 	logger = logger.With(slog.String(logKeyCategory, "pipelistener"))
 
+	// the connections are closed once ctx is done
+	var clients sync.WaitGroup
+	defer clients.Wait()
+
+	var clientID atomic.Int64
 	for {
 		conn, err := ps.Accept()
 		if err != nil {
-			if !errors.Is(err, winio.ErrPipeListenerClosed) {
+			var authErr *transport.AuthError
+			if errors.As(err, &authErr) {
+				logger.Warn("client rejected", slog.Any("err", err))
+				continue
+			}
+			if !transport.IsClosed(err) {
 				logger.Error("failed to accept", slog.Any("err", err))
 			}
 			return
 		}
+		clients.Add(1)
 		go func(c net.Conn) {
+			defer clients.Done()
 			defer c.Close()
 			logger.Info("Client connected to event pipe")
+			stats.clients.Add(1)
+			defer stats.clients.Add(-1)
+
+			name := fmt.Sprintf("pipe-%d", clientID.Add(1))
+			sub := broker.Subscribe(name)
+			defer broker.Unsubscribe(sub)
 
-			eventStream := make(chan []byte, 10)
-			broker.Add(eventStream)
-			defer broker.Remove(eventStream)
+			client := newPipeClient(name, c, logger)
+			stats.pipeClients.Store(name, client)
+			defer stats.pipeClients.Delete(name)
 
-			if err := handlePipeClient(ctx, c, eventStream); err != nil {
+			// ends once the connection is closed
+			go readPipeClient(ctx, client, requests)
+
+			if err := handlePipeClient(ctx, client, broker, sub); err != nil {
 				logger.Error("failed to handle client", slog.Any("err", err))
 			}
 		}(conn)
 	}
 }
 
-func handlePipeClient(ctx context.Context, conn net.Conn, events <-chan []byte) error {
+func handlePipeClient(ctx context.Context, client *pipeClient, broker *dataBroker, sub *subscription) error {
 	frequency := time.Second * 5
 	ticker := time.NewTicker(frequency)
 	pingMsg := []byte(`{"type":"ping"}`)
 	defer ticker.Stop()
 
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-client.negotiated:
+	case <-time.After(handshakeWait):
+	}
+
+	// send is done once the event reached the client, or the client acknowledged it
+	send := func(e brokerEvent) error {
+		if !client.accepts(e) {
+			broker.Ack(e.ID)
+			return nil
+		}
+		if err := client.w.Write(e.Data); err != nil {
+			if !errors.Is(err, pipeproto.ErrFrameTooLarge) {
+				return err
+			}
+			client.logger.Warn("event dropped", slog.Uint64("id", e.ID), slog.Any("err", err))
+			broker.Ack(e.ID)
+			return nil
+		}
+		sub.Delivered()
+		if !client.acknowledges() {
+			broker.Ack(e.ID)
+		}
+		return nil
+	}
+
+	// events received while no game was connected are also in the journal
+	redelivered := make(map[uint64]struct{})
+	if client.acknowledges() {
+		pending := broker.Pending()
+		if len(pending) > 0 {
+			client.logger.Info("Redelivering unacknowledged events", slog.Int("count", len(pending)))
+		}
+		for _, e := range pending {
+			if err := send(e); err != nil {
+				return err
+			}
+			redelivered[e.ID] = struct{}{}
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		case e, ok := <-events:
+		case e, ok := <-sub.Events():
 			if !ok {
-				return nil
+				if broker.stopped() {
+					return nil
+				}
+				return errors.New("client did not keep up with events")
+			}
+			if _, ok := redelivered[e.ID]; ok {
+				continue
 			}
-			if err := writeLenPrefixed(conn, e); err != nil {
+			if err := send(e); err != nil {
 				return err
 			}
 			ticker.Reset(frequency)
 		case <-ticker.C:
-			if err := writeLenPrefixed(conn, pingMsg); err != nil {
+			if err := client.w.Write(pingMsg); err != nil {
 				return err
 			}
 		}
 	}
 }
+
+// readPipeClient dispatches requests sent by the client until the connection is closed
+func readPipeClient(ctx context.Context, client *pipeClient, requests *requestDispatcher) {
+	logger := client.logger
+	r := pipeproto.NewFrameReader(client.conn)
+	handshakeDone := false
+	for {
+		data, err := r.Read()
+		if err != nil {
+			if errors.Is(err, pipeproto.ErrFrameTooLarge) {
+				logger.Warn("client message dropped", slog.Any("err", err))
+				continue
+			}
+			if !transport.IsClosed(err) {
+				logger.Debug("stopped reading from client", slog.Any("err", err))
+			}
+			return
+		}
+		var req pipeproto.Envelope
+		if err := json.Unmarshal(data, &req); err != nil {
+			logger.Warn("could not deserialize client message", slog.Any("err", err))
+			continue
+		}
+		if req.Type == pipeproto.TypeHello {
+			if handshakeDone {
+				logger.Warn("ignoring repeated handshake")
+				continue
+			}
+			handshakeDone = true
+			if err := client.handshake(req, r); err != nil {
+				logger.Warn("handshake failed", slog.Any("err", err))
+				client.conn.Close()
+				return
+			}
+			continue
+		}
+		logger.Debug("request received", slog.String("type", req.Type), slog.Uint64("id", req.ID))
+		resp := requests.dispatch(ctx, logger, req)
+		if resp == nil {
+			continue
+		}
+		if err := client.w.Write(resp); err != nil {
+			logger.Warn("could not send response", slog.String("type", req.Type), slog.Any("err", err))
+		}
+	}
+}
+
+// handshake negotiates the protocol version and switches both directions to its framing.
+// Mismatching versions are answered with an error, the connection should be closed afterwards.
+func (c *pipeClient) handshake(req pipeproto.Envelope, r *pipeproto.FrameReader) error {
+	hello, err := decodeRequest[pipeproto.Hello](req.Data)
+	var version int
+	if err == nil {
+		version, err = pipeproto.Negotiate(connectorHello, hello)
+	}
+	if err != nil {
+		if data, mErr := pipeproto.MarshalError(pipeproto.TypeHello, 0, err); mErr == nil {
+			c.w.Write(data)
+		}
+		return err
+	}
+
+	if len(hello.Events) > 0 {
+		events := make(map[string]struct{}, len(hello.Events))
+		for _, e := range hello.Events {
+			events[e] = struct{}{}
+		}
+		c.events.Store(&events)
+	}
+
+	reply := connectorHello
+	reply.Version = version
+	data, err := pipeproto.Marshal(pipeproto.TypeHello, 0, reply)
+	if err != nil {
+		return err
+	}
+	// the client does not send anything until it received the reply
+	r.Upgrade(version, connectorHello.MaxFrameSize)
+	if err := c.w.WriteAndUpgrade(data, version, hello.MaxFrameSize); err != nil {
+		return err
+	}
+	c.version.Store(int32(version))
+	c.peer.Store(&hello.Client)
+	close(c.negotiated)
+	c.logger.Info("Client handshake completed", slog.String("client", hello.Client), slog.Int("version", version), slog.Any("events", hello.Events))
+	return nil
+}
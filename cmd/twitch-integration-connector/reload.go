@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configReloadDelay collects the writes of a single save before the configuration is read
+const configReloadDelay = time.Second
+
+// watchConfig calls apply with the new configuration whenever the configuration file changes.
+// Invalid configurations are logged and ignored, so the last valid configuration stays active.
+func watchConfig(ctx context.Context, logger *slog.Logger, apply func(cnf config)) error {
+	logger = logger.With(slog.String(logKeyCategory, "config"))
+	confFilePath, err := filepath.Abs(configFileName)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+	// editors often replace the file instead of writing it, so the directory is watched
+	if err := watcher.Add(filepath.Dir(confFilePath)); err != nil {
+		return err
+	}
+
+	reload := time.NewTimer(configReloadDelay)
+	reload.Stop()
+	defer reload.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return errors.New("config watcher closed")
+			}
+			if event.Has(fsnotify.Write|fsnotify.Create) && strings.EqualFold(filepath.Base(event.Name), configFileName) {
+				reload.Reset(configReloadDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return errors.New("config watcher closed")
+			}
+			logger.Warn("fsnotify received an error", slog.Any("err", err))
+		case <-reload.C:
+			content, err := os.ReadFile(confFilePath)
+			if err != nil {
+				logger.Warn("Could not read the configuration, keeping the previous one", slog.Any("err", err))
+				continue
+			}
+			cnf, err := loadConfig(confFilePath, content)
+			if err != nil {
+				logger.Warn("Invalid configuration, keeping the previous one", slog.Any("err", err))
+				continue
+			}
+			apply(cnf)
+		}
+	}
+}
+
+// applyConfig restarts the services whose configuration changed from prev to next
+func applyConfig(logger *slog.Logger, services *serviceManager, logLeveler *slog.LevelVar, prev, next config) {
+	logger = logger.With(slog.String(logKeyCategory, "config"))
+	if prev.Debug != next.Debug {
+		level := slog.LevelInfo
+		if next.Debug {
+			level = slog.LevelDebug
+		}
+		logLeveler.Set(level)
+		logger.Info("Log level changed", slog.String("level", level.String()))
+	}
+
+	restart, restartRequired := configChanges(prev, next)
+	if len(restartRequired) > 0 {
+		logger.Warn("Configuration changes only apply after restarting the connector", slog.Any("settings", restartRequired))
+	}
+	if len(restart) == 0 {
+		logger.Debug("Configuration reloaded, no service affected")
+		return
+	}
+	logger.Info("Configuration reloaded", slog.Any("services", restart))
+	for _, svc := range restart {
+		if err := services.Restart(svc); err != nil {
+			logger.Error("Could not restart service", slog.String("service", svc), slog.Any("err", err))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"log/slog"
+
+	"github.com/kirides/twitch-integration/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigChanges(t *testing.T) {
+	tests := []struct {
+		name            string
+		change          func(cnf *config)
+		services        []string
+		restartRequired []string
+	}{
+		{name: "unchanged", change: func(cnf *config) {}},
+		{name: "debug", change: func(cnf *config) { cnf.Debug = true }},
+		{name: "shutdown timeout", change: func(cnf *config) { cnf.ShutdownTimeoutSec = 30 }},
+		{name: "channel", change: func(cnf *config) { cnf.Twitch.Channel = "other" }, services: []string{serviceChat}},
+		{name: "channels", change: func(cnf *config) { cnf.Twitch.Channels = []string{"other"} }, services: []string{serviceChat}},
+		{name: "chat", change: func(cnf *config) { cnf.Twitch.ChatIntegration = false }, services: []string{serviceChat}},
+		{name: "command prefix", change: func(cnf *config) { cnf.Twitch.CommandPrefix = "?" }, services: []string{serviceChat}},
+		{name: "channel points", change: func(cnf *config) { cnf.Twitch.ChannelPointsIntegration = false }, services: []string{serviceEventSub}},
+		{name: "bits", change: func(cnf *config) { cnf.Twitch.BitsIntegration = false }, services: []string{serviceEventSub}},
+		{name: "eventsub url", change: func(cnf *config) { cnf.Twitch.EventSubURL = "wss://localhost" }, services: []string{serviceEventSub}},
+		{name: "oauth token", change: func(cnf *config) { cnf.Twitch.OAuthToken = "other" }, services: []string{serviceChat, serviceEventSub}},
+		{name: "stream elements", change: func(cnf *config) { cnf.StreamElements.Token = "other" }, services: []string{serviceStreamElements}},
+		{name: "admin", change: func(cnf *config) { cnf.Admin.Address = "127.0.0.1:9000" }, services: []string{serviceAdmin}},
+		{name: "transport", change: func(cnf *config) { cnf.Transport.Kind = "tcp" }, restartRequired: []string{"transport"}},
+		{name: "event journal", change: func(cnf *config) { cnf.EventJournal = "other.journal" }, restartRequired: []string{"event_journal"}},
+		{name: "event queue", change: func(cnf *config) { cnf.EventQueue.Size = 1 }, restartRequired: []string{"event_queue"}},
+		{name: "pending events", change: func(cnf *config) { cnf.PendingEvents.TTLSec["chat"] = 60 }, restartRequired: []string{"pending_events"}},
+		{
+			name: "everything",
+			change: func(cnf *config) {
+				cnf.Twitch.OAuthToken = "other"
+				cnf.StreamElements.Enabled = true
+				cnf.Admin.Enabled = true
+				cnf.Transport = transport.Config{Kind: "unix", Address: "connector.sock"}
+				cnf.EventJournal = "other.journal"
+				cnf.EventQueue.Overflow = overflowDisconnect
+				cnf.PendingEvents.MaxEvents = 1
+			},
+			services:        []string{serviceChat, serviceEventSub, serviceStreamElements, serviceAdmin},
+			restartRequired: []string{"transport", "event_journal", "event_queue", "pending_events"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev, next := testConfig(), testConfig()
+			tt.change(&next)
+
+			services, restartRequired := configChanges(prev, next)
+			assert.Equal(t, tt.services, services)
+			assert.Equal(t, tt.restartRequired, restartRequired)
+		})
+	}
+}
+
+// testConfig returns a configuration with all integrations enabled
+func testConfig() config {
+	cnf := defaultConfig()
+	cnf.Twitch.Channel = "channel"
+	cnf.Twitch.OAuthToken = "token"
+	cnf.Twitch.ChatIntegration = true
+	cnf.Twitch.ChannelPointsIntegration = true
+	cnf.Twitch.BitsIntegration = true
+	return cnf
+}
+
+func TestApplyConfig(t *testing.T) {
+	s := newTestServiceManager(t)
+	runs := map[string]*atomic.Int32{}
+	for _, svc := range []string{serviceChat, serviceEventSub, serviceStreamElements, serviceAdmin} {
+		runs[svc] = &atomic.Int32{}
+		s.Add(svc, phaseProviders, restartOnFailure, func(ctx context.Context) error {
+			runs[svc].Add(1)
+			<-ctx.Done()
+			return nil
+		})
+	}
+	for svc := range runs {
+		waitForState(t, s, svc, serviceRunning)
+	}
+
+	var level slog.LevelVar
+	prev, next := testConfig(), testConfig()
+	next.Debug = true
+	next.Twitch.Channel = "other"
+	next.StreamElements.Token = "other"
+	applyConfig(slog.New(slog.DiscardHandler), s, &level, prev, next)
+
+	assert.Equal(t, slog.LevelDebug, level.Level())
+	require.Eventually(t, func() bool {
+		return runs[serviceChat].Load() == 2 && runs[serviceStreamElements].Load() == 2
+	}, time.Second*5, time.Millisecond)
+	assert.Equal(t, int32(1), runs[serviceEventSub].Load())
+	assert.Equal(t, int32(1), runs[serviceAdmin].Load())
+	for svc := range runs {
+		waitForState(t, s, svc, serviceRunning)
+	}
+
+	applyConfig(slog.New(slog.DiscardHandler), s, &level, next, prev)
+	assert.Equal(t, slog.LevelInfo, level.Level())
+}
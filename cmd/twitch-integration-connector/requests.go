@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kirides/twitch-integration/pipeproto"
+)
+
+// requestHandler answers a request of a pipe client. The result is sent as the response data.
+type requestHandler func(ctx context.Context, data json.RawMessage) (any, error)
+
+// requestDispatcher routes requests of pipe clients to their provider
+type requestDispatcher struct {
+	handlers map[string]requestHandler
+}
+
+func newRequestDispatcher() *requestDispatcher {
+	return &requestDispatcher{handlers: make(map[string]requestHandler)}
+}
+
+// Handle registers h for requests of type typ, it must not be called after dispatching started
+func (d *requestDispatcher) Handle(typ string, h requestHandler) {
+	d.handlers[typ] = h
+}
+
+// dispatch handles the request and returns the serialized response,
+// or nil if the client did not ask for one.
+func (d *requestDispatcher) dispatch(ctx context.Context, logger *slog.Logger, req pipeproto.Envelope) []byte {
+	var result any
+	h, ok := d.handlers[req.Type]
+	var err error
+	if !ok {
+		err = pipeproto.Errorf(pipeproto.CodeUnknownType, "unknown request type %q", req.Type)
+	} else {
+		result, err = h(ctx, req.Data)
+	}
+	if err != nil {
+		logger.Warn("request failed", slog.String("type", req.Type), slog.Uint64("id", req.ID), slog.Any("err", err))
+	}
+	if req.ID == 0 {
+		return nil
+	}
+	resp, mErr := pipeproto.MarshalResponse(req.ID, result, err)
+	if mErr != nil {
+		logger.Error("could not serialize response", slog.String("type", req.Type), slog.Any("err", mErr))
+		resp, _ = pipeproto.MarshalResponse(req.ID, nil, pipeproto.Errorf(pipeproto.CodeFailed, "could not serialize response"))
+	}
+	return resp
+}
+
+// decodeRequest unmarshals the request data, failures are reported as bad requests
+func decodeRequest[T any](data json.RawMessage) (T, error) {
+	var v T
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, pipeproto.Errorf(pipeproto.CodeBadRequest, "%v", err)
+	}
+	return v, nil
+}
+
+// connectorStats are collected for the stats request
+type connectorStats struct {
+	startedAt   time.Time
+	clients     atomic.Int64
+	eventsAcked atomic.Int64
+	// pipeClients are the connected *pipeClient by name
+	pipeClients sync.Map
+}
+
+// gameState keeps the last state reported by the game
+type gameState struct {
+	mtx   sync.Mutex
+	state json.RawMessage
+}
+
+func (g *gameState) set(state json.RawMessage) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.state = append(json.RawMessage(nil), state...)
+}
+
+// get returns the last reported state, nil if the game did not report one
+func (g *gameState) get() json.RawMessage {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.state
+}
+
+// registerProviders wires all request types to the services handling them
+func registerProviders(d *requestDispatcher, broker *dataBroker, chat *chatRelay, redemptions *redemptionRelay, stats *connectorStats, state *gameState) {
+	d.Handle(pipeproto.TypeChatSend, func(ctx context.Context, data json.RawMessage) (any, error) {
+		req, err := decodeRequest[pipeproto.ChatSend](data)
+		if err != nil {
+			return nil, err
+		}
+		return nil, chat.Send(req.Channel, req.Message)
+	})
+	d.Handle(pipeproto.TypeRedemptionUpdate, func(ctx context.Context, data json.RawMessage) (any, error) {
+		req, err := decodeRequest[pipeproto.RedemptionUpdate](data)
+		if err != nil {
+			return nil, err
+		}
+		if req.Status != pipeproto.StatusFulfilled && req.Status != pipeproto.StatusCanceled {
+			return nil, pipeproto.Errorf(pipeproto.CodeBadRequest, "invalid status %q", req.Status)
+		}
+		return nil, redemptions.Update(ctx, req)
+	})
+	d.Handle(pipeproto.TypeGameState, func(ctx context.Context, data json.RawMessage) (any, error) {
+		if !json.Valid(data) {
+			return nil, pipeproto.Errorf(pipeproto.CodeBadRequest, "game state is not valid JSON")
+		}
+		state.set(data)
+		return nil, nil
+	})
+	d.Handle(pipeproto.TypeAck, func(ctx context.Context, data json.RawMessage) (any, error) {
+		req, err := decodeRequest[pipeproto.Ack](data)
+		if err != nil {
+			return nil, err
+		}
+		stats.eventsAcked.Add(int64(len(req.EventIDs)))
+		broker.Ack(req.EventIDs...)
+		return nil, nil
+	})
+	d.Handle(pipeproto.TypeStats, func(ctx context.Context, data json.RawMessage) (any, error) {
+		result := pipeproto.Stats{
+			UptimeSec:       int64(time.Since(stats.startedAt).Seconds()),
+			Clients:         stats.clients.Load(),
+			EventsPublished: broker.Published(),
+			EventsAcked:     stats.eventsAcked.Load(),
+			EventsRejected:  broker.Rejected(),
+		}
+		for _, q := range broker.Subscriptions() {
+			result.Queues = append(result.Queues, pipeproto.QueueStats{
+				Client:    q.Name,
+				Delivered: q.Delivered,
+				Dropped:   q.Dropped,
+				Queued:    q.Queued,
+			})
+		}
+		chat.stats(&result)
+		return result, nil
+	})
+}
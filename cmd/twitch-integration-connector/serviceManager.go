@@ -2,67 +2,384 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"log/slog"
 )
 
+// restartPolicy decides whether a service is started again once its handler returned
+type restartPolicy string
+
+const (
+	// restartNever runs the handler once
+	restartNever restartPolicy = "never"
+	// restartOnFailure restarts the handler when it returned an error or panicked
+	restartOnFailure restartPolicy = "on-failure"
+	// restartAlways restarts the handler whenever it returned before shutdown
+	restartAlways restartPolicy = "always"
+)
+
+func (p restartPolicy) restarts(err error) bool {
+	switch p {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return err != nil
+	default:
+		return false
+	}
+}
+
+const (
+	// restartBackoffMin is the delay before the first restart, it doubles with every further restart
+	restartBackoffMin = time.Second
+	restartBackoffMax = 5 * time.Minute
+	// restartStableAfter is how long a service has to run until the backoff starts over
+	restartStableAfter = time.Minute
+	// a service restarted more than crashLoopRestarts times within crashLoopWindow is given up
+	crashLoopRestarts = 5
+	crashLoopWindow   = 10 * time.Minute
+)
+
+// shutdownPhase orders how services are stopped, services of earlier phases are stopped first
+type shutdownPhase int
+
+const (
+	// phaseProviders produce events, they are stopped first so no new events arrive
+	phaseProviders shutdownPhase = iota
+	// phaseDelivery services flush events to the connected clients
+	phaseDelivery
+	// phaseTransports services close the listener and client connections
+	phaseTransports
+
+	phaseCount = iota
+)
+
+func (p shutdownPhase) String() string {
+	switch p {
+	case phaseProviders:
+		return "providers"
+	case phaseDelivery:
+		return "delivery"
+	case phaseTransports:
+		return "transports"
+	}
+	return fmt.Sprintf("phase %d", int(p))
+}
+
+// shutdownGrace is how long Stop waits for services after the deadline passed and they were cancelled
+const shutdownGrace = time.Second
+
+// serviceState is the lifecycle state of a service
+type serviceState string
+
+const (
+	serviceRunning    serviceState = "running"
+	serviceRestarting serviceState = "restarting"
+	serviceStopped    serviceState = "stopped"
+	// serviceFailed services returned an error and are not restarted anymore
+	serviceFailed serviceState = "failed"
+)
+
+// serviceStatus is a snapshot of a service
+type serviceStatus struct {
+	Name      string        `json:"name"`
+	Policy    restartPolicy `json:"policy"`
+	State     serviceState  `json:"state"`
+	Restarts  int           `json:"restarts"`
+	LastError string        `json:"last_error,omitempty"`
+	StartedAt time.Time     `json:"started_at,omitzero"`
+}
+
+// service is a handler supervised by the serviceManager
+type service struct {
+	status  serviceStatus
+	phase   shutdownPhase
+	handler func(ctx context.Context) error
+
+	// supervised is true while a go-routine supervises the handler
+	supervised bool
+	// cancelRun cancels the current run of the handler, reload requests a restart with the new configuration
+	cancelRun context.CancelFunc
+	reload    bool
+}
+
 type serviceManager struct {
-	running sync.Map
-	wg      sync.WaitGroup
+	wg [phaseCount]sync.WaitGroup
+
+	mtx      sync.Mutex
+	services map[string]*service
 
-	ctx       context.Context
-	ctxCancel context.CancelFunc
-	logger    *slog.Logger
+	// each phase is cancelled separately, ctxCancel cancels all of them
+	phaseCtx    [phaseCount]context.Context
+	phaseCancel [phaseCount]context.CancelFunc
+	ctxCancel   context.CancelFunc
+	logger      *slog.Logger
+
+	// backoff of restarts, see restartBackoffMin and restartBackoffMax
+	backoffMin time.Duration
+	backoffMax time.Duration
 }
 
 func newServiceManager(logger *slog.Logger) *serviceManager {
 	ctx, cancel := context.WithCancel(context.Background())
 	logger = logger.With(logKeyCategory, "serviceManager")
-	return &serviceManager{
-		ctx:       ctx,
-		ctxCancel: cancel,
-		logger:    logger,
+	s := &serviceManager{
+		services:   make(map[string]*service),
+		ctxCancel:  cancel,
+		logger:     logger,
+		backoffMin: restartBackoffMin,
+		backoffMax: restartBackoffMax,
+	}
+	for i := range s.phaseCtx {
+		s.phaseCtx[i], s.phaseCancel[i] = context.WithCancel(ctx)
+	}
+	return s
+}
+
+// Add runs handler until its phase is stopped, restarting it according to policy
+func (s *serviceManager) Add(svc string, phase shutdownPhase, policy restartPolicy, handler func(ctx context.Context) error) {
+	sv := &service{
+		status:  serviceStatus{Name: svc, Policy: policy},
+		phase:   phase,
+		handler: handler,
 	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.services[svc] = sv
+	s.start(sv)
 }
 
-func (s *serviceManager) Add(svc string, handler func(ctx context.Context)) {
-	s.wg.Add(1)
+// start supervises sv in a new go-routine, s.mtx must be held
+func (s *serviceManager) start(sv *service) {
+	sv.supervised = true
+	s.wg[sv.phase].Add(1)
 	go func() {
-		defer s.wg.Done()
-		s.running.Store(svc, "")
-		defer s.running.Delete(svc)
-		handler(s.ctx)
+		defer s.wg[sv.phase].Done()
+		s.supervise(s.phaseCtx[sv.phase], sv)
 	}()
 }
 
-func (s *serviceManager) Stop() error {
-	s.ctxCancel()
-
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
+// Restart stops the running handler of svc and starts it again right away, without backoff.
+// Services that stopped or were given up are started again. Restart does nothing once Stop was called.
+func (s *serviceManager) Restart(svc string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	sv, ok := s.services[svc]
+	if !ok {
+		return fmt.Errorf("unknown service %q", svc)
+	}
+	if s.phaseCtx[sv.phase].Err() != nil {
+		return nil
+	}
+	if !sv.supervised {
+		s.start(sv)
+		return nil
+	}
+	sv.reload = true
+	if sv.cancelRun != nil {
+		sv.cancelRun()
+	}
+	return nil
+}
 
-	ticks := 0
+func (s *serviceManager) supervise(ctx context.Context, sv *service) {
+	svc, policy := sv.status.Name, sv.status.Policy
+	logger := s.logger.With(slog.String("service", svc))
+	backoff := s.backoffMin
+	var restarts []time.Time
+	reload := func() {
+		logger.Info("Restarting service to apply the configuration")
+		backoff = s.backoffMin
+		restarts = nil
+	}
 	for {
-		ticks++
-		if ticks < 5 {
-			ticker.Reset(time.Duration(10*ticks) * time.Millisecond)
-		} else if ticks == 5 {
-			ticker.Reset(time.Second)
+		started := time.Now()
+		runCtx, cancelRun := context.WithCancel(ctx)
+		s.update(sv, func(sv *service) {
+			sv.status.State = serviceRunning
+			sv.status.StartedAt = started
+			sv.cancelRun = cancelRun
+		})
+
+		err := runService(runCtx, sv.handler)
+		cancelRun()
+		if ctx.Err() != nil {
+			s.finish(sv, serviceStopped)
+			return
+		}
+		if s.reloaded(sv) {
+			reload()
+			continue
+		}
+		if err != nil {
+			logger.Error("Service failed", slog.Any("err", err))
+			s.update(sv, func(sv *service) { sv.status.LastError = err.Error() })
+		} else {
+			logger.Info("Service stopped")
+		}
+
+		if !policy.restarts(err) {
+			state := serviceStopped
+			if err != nil {
+				state = serviceFailed
+			}
+			if s.finish(sv, state) {
+				return
+			}
+			reload()
+			continue
 		}
-		<-ticker.C
 
-		count := 0
-		s.running.Range(func(key, _ interface{}) bool {
-			s.logger.Info("Still running", "service", key)
-			count++
-			return true
+		now := time.Now()
+		if now.Sub(started) >= restartStableAfter {
+			backoff = s.backoffMin
+		}
+		restarts = slices.DeleteFunc(restarts, func(t time.Time) bool { return now.Sub(t) > crashLoopWindow })
+		restarts = append(restarts, now)
+		if len(restarts) > crashLoopRestarts {
+			logger.Error("Service keeps failing, giving up", slog.Int("restarts", crashLoopRestarts), slog.Duration("window", crashLoopWindow))
+			if s.finish(sv, serviceFailed) {
+				return
+			}
+			reload()
+			continue
+		}
+
+		logger.Info("Restarting service", slog.Duration("retry.after", backoff))
+		waitCtx, cancelWait := context.WithCancel(ctx)
+		s.update(sv, func(sv *service) {
+			sv.status.State = serviceRestarting
+			sv.status.Restarts++
+			sv.cancelRun = cancelWait
 		})
-		if count == 0 {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-waitCtx.Done():
+			// stopped or restarted to apply the configuration
+			timer.Stop()
+		case <-timer.C:
+		}
+		cancelWait()
+		if ctx.Err() != nil {
+			s.finish(sv, serviceStopped)
+			return
+		}
+		if s.reloaded(sv) {
+			reload()
+			continue
+		}
+		backoff = min(backoff*2, s.backoffMax)
+	}
+}
+
+// reloaded reports and resets whether Restart was called for sv
+func (s *serviceManager) reloaded(sv *service) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	reload := sv.reload
+	sv.reload = false
+	return reload
+}
+
+// finish marks sv as no longer supervised, unless Restart was called meanwhile.
+// It returns false if the handler has to be started again.
+func (s *serviceManager) finish(sv *service, state serviceState) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if sv.reload && s.phaseCtx[sv.phase].Err() == nil {
+		sv.reload = false
+		return false
+	}
+	sv.reload = false
+	sv.status.State = state
+	sv.supervised = false
+	sv.cancelRun = nil
+	return true
+}
+
+// runService calls handler, a panic is returned as error
+func runService(ctx context.Context, handler func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx)
+}
+
+func (s *serviceManager) update(sv *service, fn func(sv *service)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	fn(sv)
+}
+
+// Status returns the state of all services, ordered by name
+func (s *serviceManager) Status() []serviceStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	status := make([]serviceStatus, 0, len(s.services))
+	for _, sv := range s.services {
+		status = append(status, sv.status)
+	}
+	slices.SortFunc(status, func(x, y serviceStatus) int { return strings.Compare(x.Name, y.Name) })
+	return status
+}
+
+// Stop stops the services phase by phase, waiting for each phase before stopping the next one.
+// Once timeout passed all remaining services are cancelled, Stop then waits shutdownGrace
+// and returns an error naming the services that are still running.
+func (s *serviceManager) Stop(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for phase := range shutdownPhase(phaseCount) {
+		// Restart does not start services of cancelled phases
+		s.mtx.Lock()
+		s.phaseCancel[phase]()
+		s.mtx.Unlock()
+		if !s.wait(phase, deadline) {
+			s.logger.Warn("Services did not stop in time, cancelling all services", slog.String("phase", phase.String()), slog.Duration("timeout", timeout))
 			break
 		}
 	}
+	s.ctxCancel()
 
+	grace := time.Now().Add(shutdownGrace)
+	for phase := range shutdownPhase(phaseCount) {
+		s.wait(phase, grace)
+	}
+
+	var stuck []string
+	s.mtx.Lock()
+	for name, sv := range s.services {
+		if sv.supervised {
+			stuck = append(stuck, name)
+		}
+	}
+	s.mtx.Unlock()
+	if len(stuck) > 0 {
+		slices.Sort(stuck)
+		return fmt.Errorf("services did not stop: %s", strings.Join(stuck, ", "))
+	}
 	return nil
 }
+
+// wait returns false if the services of phase are still running at deadline
+func (s *serviceManager) wait(phase shutdownPhase, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg[phase].Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"log/slog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errTestService = errors.New("service failed")
+
+func newTestServiceManager(t *testing.T) *serviceManager {
+	t.Helper()
+	s := newServiceManager(slog.New(slog.DiscardHandler))
+	s.backoffMin = time.Millisecond
+	s.backoffMax = time.Millisecond * 4
+	t.Cleanup(func() { s.Stop(time.Second) })
+	return s
+}
+
+// serviceStatusOf returns the status of the service name
+func serviceStatusOf(s *serviceManager, name string) serviceStatus {
+	for _, status := range s.Status() {
+		if status.Name == name {
+			return status
+		}
+	}
+	return serviceStatus{}
+}
+
+func waitForState(t *testing.T, s *serviceManager, name string, state serviceState) serviceStatus {
+	t.Helper()
+	require.Eventually(t, func() bool { return serviceStatusOf(s, name).State == state }, time.Second*5, time.Millisecond)
+	return serviceStatusOf(s, name)
+}
+
+func TestRestartPolicy(t *testing.T) {
+	tests := []struct {
+		policy    restartPolicy
+		onSuccess bool
+		onFailure bool
+	}{
+		{policy: restartNever},
+		{policy: restartOnFailure, onFailure: true},
+		{policy: restartAlways, onSuccess: true, onFailure: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			assert.Equal(t, tt.onSuccess, tt.policy.restarts(nil))
+			assert.Equal(t, tt.onFailure, tt.policy.restarts(errTestService))
+		})
+	}
+}
+
+func TestServiceManagerFinalStates(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  restartPolicy
+		handler func(ctx context.Context) error
+		state   serviceState
+		err     string
+	}{
+		{
+			name:    "never stopped",
+			policy:  restartNever,
+			handler: func(ctx context.Context) error { return nil },
+			state:   serviceStopped,
+		},
+		{
+			name:    "never failed",
+			policy:  restartNever,
+			handler: func(ctx context.Context) error { return errTestService },
+			state:   serviceFailed,
+			err:     errTestService.Error(),
+		},
+		{
+			name:    "on-failure stopped",
+			policy:  restartOnFailure,
+			handler: func(ctx context.Context) error { return nil },
+			state:   serviceStopped,
+		},
+		{
+			name:    "panic",
+			policy:  restartNever,
+			handler: func(ctx context.Context) error { panic("boom") },
+			state:   serviceFailed,
+			err:     "panic: boom",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServiceManager(t)
+			s.Add("svc", phaseProviders, tt.policy, tt.handler)
+
+			status := waitForState(t, s, "svc", tt.state)
+			assert.Equal(t, tt.err, status.LastError)
+			assert.Zero(t, status.Restarts)
+		})
+	}
+}
+
+func TestServiceManagerRestartsWithBackoff(t *testing.T) {
+	s := newTestServiceManager(t)
+	var runs atomic.Int32
+	s.Add("svc", phaseProviders, restartOnFailure, func(ctx context.Context) error {
+		if runs.Add(1) <= 3 {
+			return errTestService
+		}
+		<-ctx.Done()
+		return nil
+	})
+
+	require.Eventually(t, func() bool { return runs.Load() == 4 }, time.Second*5, time.Millisecond)
+	status := waitForState(t, s, "svc", serviceRunning)
+	assert.Equal(t, 3, status.Restarts)
+	assert.Equal(t, errTestService.Error(), status.LastError)
+}
+
+func TestServiceManagerGivesUpCrashLoop(t *testing.T) {
+	s := newTestServiceManager(t)
+	var runs atomic.Int32
+	s.Add("svc", phaseProviders, restartAlways, func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	})
+
+	status := waitForState(t, s, "svc", serviceFailed)
+	assert.Equal(t, crashLoopRestarts, status.Restarts)
+	assert.Equal(t, int32(crashLoopRestarts+1), runs.Load())
+}
+
+func TestServiceManagerStopsPhasesInOrder(t *testing.T) {
+	s := newServiceManager(slog.New(slog.DiscardHandler))
+	var mtx sync.Mutex
+	var events []string
+	record := func(event string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		events = append(events, event)
+	}
+	for _, phase := range []shutdownPhase{phaseTransports, phaseDelivery, phaseProviders} {
+		s.Add(phase.String(), phase, restartNever, func(ctx context.Context) error {
+			<-ctx.Done()
+			record(phase.String() + " cancelled")
+			// later phases must wait until this one returned
+			time.Sleep(time.Millisecond * 20)
+			record(phase.String() + " stopped")
+			return nil
+		})
+	}
+
+	require.NoError(t, s.Stop(time.Second*5))
+	assert.Equal(t, []string{
+		"providers cancelled", "providers stopped",
+		"delivery cancelled", "delivery stopped",
+		"transports cancelled", "transports stopped",
+	}, events)
+	for _, status := range s.Status() {
+		assert.Equal(t, serviceStopped, status.State, status.Name)
+	}
+}
+
+func TestServiceManagerStopTimeout(t *testing.T) {
+	s := newServiceManager(slog.New(slog.DiscardHandler))
+	release := make(chan struct{})
+	defer close(release)
+	s.Add("stuck", phaseProviders, restartNever, func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	transportCancelled := make(chan struct{})
+	s.Add("transport", phaseTransports, restartNever, func(ctx context.Context) error {
+		<-ctx.Done()
+		close(transportCancelled)
+		return nil
+	})
+
+	start := time.Now()
+	err := s.Stop(time.Millisecond * 50)
+	require.EqualError(t, err, "services did not stop: stuck")
+	assert.Less(t, time.Since(start), time.Millisecond*50+shutdownGrace*2)
+
+	// once the timeout passed, the remaining phases are cancelled without waiting for the stuck one
+	select {
+	case <-transportCancelled:
+	default:
+		t.Fatal("transport was not cancelled")
+	}
+	assert.Equal(t, serviceStopped, serviceStatusOf(s, "transport").State)
+}
+
+func TestServiceManagerRestart(t *testing.T) {
+	s := newTestServiceManager(t)
+	assert.EqualError(t, s.Restart("unknown"), `unknown service "unknown"`)
+
+	var runs atomic.Int32
+	s.Add("once", phaseProviders, restartNever, func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	})
+	waitForState(t, s, "once", serviceStopped)
+
+	// a service that is no longer supervised is started again
+	require.NoError(t, s.Restart("once"))
+	require.Eventually(t, func() bool { return runs.Load() == 2 }, time.Second*5, time.Millisecond)
+	waitForState(t, s, "once", serviceStopped)
+
+	require.NoError(t, s.Stop(time.Second))
+	require.NoError(t, s.Restart("once"))
+	assert.Equal(t, int32(2), runs.Load(), "services must not start after Stop")
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"log/slog"
 
@@ -13,7 +15,49 @@ import (
 	"github.com/kirides/twitch-integration/streamelements"
 )
 
-func handleStreamElements(ctx context.Context, cnf streamElementsCnf, logger *slog.Logger, ew eventPublisher) error {
+// streamElementsStatus is the state of the StreamElements connection
+type streamElementsStatus struct {
+	mtx       sync.Mutex
+	connected bool
+	since     time.Time
+	lastError string
+	connects  int
+}
+
+func (s *streamElementsStatus) set(connected bool, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if connected {
+		s.connects++
+	}
+	s.connected = connected
+	s.since = time.Now()
+	if err != nil {
+		s.lastError = err.Error()
+	}
+}
+
+// streamElementsSnapshot is the state of the StreamElements connection for the admin API
+type streamElementsSnapshot struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func (s *streamElementsStatus) snapshot() streamElementsSnapshot {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return streamElementsSnapshot{Connected: s.connected, Since: s.since, LastError: s.lastError}
+}
+
+// reconnects counts connections after the first one
+func (s *streamElementsStatus) reconnects() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return max(s.connects-1, 0)
+}
+
+func handleStreamElements(ctx context.Context, cnf streamElementsCnf, logger *slog.Logger, ew eventPublisher, status *streamElementsStatus) (err error) {
 	logger = logger.With(slog.String(logKeyCategory, "streamElements"))
 	if !cnf.Enabled {
 		logger.Info("integration disabled by configuration.")
@@ -25,6 +69,7 @@ func handleStreamElements(ctx context.Context, cnf streamElementsCnf, logger *sl
 		return nil
 	}
 	logger.Info("Starting StreamElements integration.")
+	defer func() { status.set(false, err) }()
 
 	sio := socketio.New(loggerFn(func(format string, args ...interface{}) {
 		logger.Info(fmt.Sprintf(format, args...))
@@ -34,11 +79,15 @@ func handleStreamElements(ctx context.Context, cnf streamElementsCnf, logger *sl
 	}
 	defer sio.Close()
 
+	// listenCtx ends when the connection is lost, so the service can be restarted
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		<-ctx.Done()
+		<-listenCtx.Done()
 		sio.Close()
 	}()
 
@@ -51,6 +100,7 @@ func handleStreamElements(ctx context.Context, cnf streamElementsCnf, logger *sl
 		return fmt.Errorf("failed to send authenticate request. %w", err)
 	}
 	logger.Info("authenticated")
+	status.set(true, nil)
 
 	sioBroker := socketio.NewBroker(sio)
 
@@ -58,15 +108,24 @@ func handleStreamElements(ctx context.Context, cnf streamElementsCnf, logger *sl
 	sioBroker.Subscribe(streamelements.EventRedemption, handler)
 	defer sioBroker.Unsubscribe(streamelements.EventRedemption, handler)
 
+	listenErr := make(chan error, 1)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		sioBroker.Listen(ctx)
+		defer cancel()
+		listenErr <- sioBroker.Listen(listenCtx)
 	}()
 
-	streamElementsConsumeLoop(ctx, logger, handler, cnf, ew)
+	streamElementsConsumeLoop(listenCtx, logger, handler, cnf, ew)
 	wg.Wait()
-	return nil
+	err = <-listenErr
+	if ctx.Err() != nil {
+		return nil
+	}
+	if err == nil {
+		err = errors.New("closed by server")
+	}
+	return fmt.Errorf("connection lost. %w", err)
 }
 
 func streamElementsConsumeLoop(ctx context.Context, logger *slog.Logger, handler <-chan *socketio.Message, cnf streamElementsCnf, ew eventPublisher) {
@@ -89,13 +148,19 @@ func streamElementsConsumeLoop(ctx context.Context, logger *slog.Logger, handler
 				user = strings.Replace(user, " ", "", -1)
 
 				redemption := red.Item.Name
-				data, err := json.Marshal(EventEnvelop{Type: "streamelements-perk", Data: Redemption{Title: redemption, Redeemer: user, Channel: cnf.Channel}})
+				input := make([]string, 0, len(red.Input))
+				for _, v := range red.Input {
+					input = append(input, fmt.Sprint(v))
+				}
+				data, err := json.Marshal(EventEnvelop{Type: "streamelements-perk", Data: Redemption{Title: redemption, Redeemer: user, Channel: cnf.Channel, Input: strings.Join(input, " ")}})
 				if err != nil {
 					logger.Error("could not serialize redemption", slog.Any("err", err), slog.String("redeeming_user", red.Redeemer.Username))
 					continue
 				}
 				logger.Debug("perk redeemed", slog.String("redeeming_user", red.Redeemer.Username), slog.String("perk", redemption))
-				ew.Publish(data)
+				if err := ew.Publish(data); err != nil {
+					logger.Error("could not publish perk", slog.Any("err", err), slog.String("redeeming_user", red.Redeemer.Username))
+				}
 			}
 		}
 	}
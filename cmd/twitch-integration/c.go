@@ -9,8 +9,10 @@ import (
 	"bytes"
 	"container/list"
 	"context"
+	"encoding/json"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -18,11 +20,14 @@ import (
 	"go.uber.org/zap/zapcore"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/kirides/twitch-integration/cooldown"
+	"github.com/kirides/twitch-integration/pipeproto"
 )
 
 var (
 	funcQueue    = &strQueue{l: list.New(), mtx: new(sync.Mutex)}
 	currentAlloc *C.char
+	statsAlloc   *C.char
 	lastError    *C.char
 	appCtx       context.Context
 	appCtxCancel func()
@@ -119,9 +124,15 @@ func (w *outputDebugStringAWriter) Write(data []byte) (int, error) {
 type App struct {
 	logger    *zap.Logger
 	configMtx sync.Mutex
+	// cooldowns are kept when the config is reloaded
+	cooldowns *cooldown.Tracker
+	// connector is set while connected to the connector
+	connector atomic.Pointer[connectorClient]
+	// seenEvents are kept across reconnects, so redelivered events are not handled twice
+	seenEvents *recentIDs
 }
 
-var app = &App{}
+var app = &App{cooldowns: cooldown.NewTracker(), seenEvents: newRecentIDs(1024)}
 
 func (a *App) ReplaceConfig(c config) {
 
@@ -239,3 +250,31 @@ func cHandleEvents() *C.char {
 	}
 	return cSetStr(&currentAlloc, fn)
 }
+
+//export cSetGameState
+func cSetGameState(state *C.char) *C.char {
+	client := app.connector.Load()
+	if client == nil {
+		return cErrorS("not connected")
+	}
+	data := C.GoString(state)
+	if !json.Valid([]byte(data)) {
+		return cErrorS("state is not valid JSON")
+	}
+	if err := client.Notify(pipeproto.TypeGameState, json.RawMessage(data)); err != nil {
+		return cError(err)
+	}
+	return cErrorS("")
+}
+
+// cGetStats returns the connector's stats as JSON, or an empty string if they are not available.
+// It does not block the game, the stats are those received since the previous call.
+//
+//export cGetStats
+func cGetStats() *C.char {
+	client := app.connector.Load()
+	if client == nil {
+		return cSetStr(&statsAlloc, "")
+	}
+	return cSetStr(&statsAlloc, string(client.Stats(app.logger)))
+}
@@ -6,11 +6,16 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/kirides/twitch-integration/actiontemplate"
+	"github.com/kirides/twitch-integration/chatcommand"
+	"github.com/kirides/twitch-integration/cooldown"
+	"github.com/kirides/twitch-integration/transport"
 	"go.uber.org/zap"
 )
 
@@ -21,26 +26,108 @@ const (
 type chatCommand struct {
 	Actions     []string `json:"actions"`
 	CooldownSec int32    `json:"cooldown_sec"`
-	Message     string   `json:"message"`
+	// UserCooldownSec is the cooldown for the user that used the command
+	UserCooldownSec int32 `json:"user_cooldown_sec,omitempty"`
+	// CooldownGroup shares a cooldown with other commands, see config.CooldownGroups
+	CooldownGroup string `json:"cooldown_group,omitempty"`
+	// Message is sent to chat after the actions were triggered,
+	// CooldownMessage when the command is on cooldown. Both support the placeholders of actions.
+	Message         string `json:"message"`
+	CooldownMessage string `json:"cooldown_message,omitempty"`
+	// Aliases are alternative names for the command, e.g. "#h" for "#help"
+	Aliases []string `json:"aliases,omitempty"`
+
+	// key identifies the command and all its aliases for cooldowns
+	key string
+}
+
+func (c chatCommand) cooldown() cooldownCnf {
+	return cooldownCnf{CooldownSec: c.CooldownSec, UserCooldownSec: c.UserCooldownSec, CooldownGroup: c.CooldownGroup}
+}
+
+// cooldownCnf limits how often rewards, bits and perks trigger their actions
+type cooldownCnf struct {
+	CooldownSec     int32  `json:"cooldown_sec"`
+	UserCooldownSec int32  `json:"user_cooldown_sec,omitempty"`
+	CooldownGroup   string `json:"cooldown_group,omitempty"`
 }
 
 type config struct {
 	Debug          bool           `json:"debug"`
 	Twitch         twitch         `json:"twitch"`
 	StreamElements streamElements `json:"streamElements"`
+	// CooldownGroups is the cooldown in seconds of each group,
+	// none of the group's commands can be used within that time after one of them was used
+	CooldownGroups map[string]int32 `json:"cooldown_groups,omitempty"`
+	// Transport is how to connect to the connector, it has to match the connector's configuration
+	Transport transport.Config `json:"transport"`
 }
+
+// cooldownRule returns the rule for the action identified by key
+func (c config) cooldownRule(key string, cd cooldownCnf) cooldown.Rule {
+	return cooldown.Rule{
+		Key:           key,
+		Global:        time.Duration(cd.CooldownSec) * time.Second,
+		PerUser:       time.Duration(cd.UserCooldownSec) * time.Second,
+		Group:         cd.CooldownGroup,
+		GroupCooldown: time.Duration(c.CooldownGroups[cd.CooldownGroup]) * time.Second,
+	}
+}
+
 type twitch struct {
 	Rewards map[string][]string    `json:"rewards"`
 	Bits    map[int][]string       `json:"bits"`
 	Chat    map[string]chatCommand `json:"chat"`
+	// ChannelChat contains chat commands for specific channels, these take precedence over Chat
+	ChannelChat map[string]map[string]chatCommand `json:"channel_chat"`
+
+	RewardCooldowns map[string]cooldownCnf `json:"reward_cooldowns,omitempty"`
+	BitsCooldowns   map[int]cooldownCnf    `json:"bits_cooldowns,omitempty"`
+	// UpdateRedemptions fulfills handled redemptions and refunds rejected ones.
+	// Twitch only allows this for rewards created with the client ID of the connector's token.
+	UpdateRedemptions bool `json:"update_redemptions,omitempty"`
+
+	// chat and channelChat index the commands by name and alias, ignoring case
+	chat        chatcommand.Set[chatCommand]
+	channelChat map[string]chatcommand.Set[chatCommand]
+}
+
+// chatCommand looks up the command for the channel, falling back to the commands for all channels
+func (t twitch) chatCommand(channel, name string) (chatCommand, bool) {
+	if commands, ok := t.channelChat[strings.ToLower(channel)]; ok {
+		if cmd, ok := commands.Lookup(name); ok {
+			return cmd, true
+		}
+	}
+	return t.chat.Lookup(name)
+}
+
+// indexChatCommands registers all commands before any alias, so aliases never shadow commands.
+// keyPrefix distinguishes commands of different channels.
+func indexChatCommands(keyPrefix string, commands map[string]chatCommand) chatcommand.Set[chatCommand] {
+	var set chatcommand.Set[chatCommand]
+	for name, cmd := range commands {
+		cmd.key = keyPrefix + chatcommand.Normalize(name)
+		set.Add(name, cmd)
+	}
+	for name, cmd := range commands {
+		cmd.key = keyPrefix + chatcommand.Normalize(name)
+		for _, alias := range cmd.Aliases {
+			set.Add(alias, cmd)
+		}
+	}
+	return set
 }
+
 type streamElements struct {
-	Perks map[string][]string `json:"perks"`
+	Perks         map[string][]string    `json:"perks"`
+	PerkCooldowns map[string]cooldownCnf `json:"perk_cooldowns,omitempty"`
 }
 
 func defaultConfig() config {
 	return config{
-		Debug: false,
+		Debug:     false,
+		Transport: transport.Default(),
 		StreamElements: streamElements{
 			Perks: map[string][]string{
 				"Item1": {"TWI_XXX", "TWI_YYY"},
@@ -52,6 +139,7 @@ func defaultConfig() config {
 			},
 			Chat: map[string]chatCommand{
 				"#help": {
+					Aliases:     []string{"#h"},
 					Actions:     []string{"XXXXXXXXXXXXXXXXXXXX"},
 					Message:     "Dies hier wird im Chat angezeigt",
 					CooldownSec: 5,
@@ -65,8 +153,8 @@ func defaultConfig() config {
 	}
 }
 
-func allKeysToUpper(m map[string][]string) map[string][]string {
-	copy := make(map[string][]string, len(m))
+func allKeysToUpper[T any](m map[string]T) map[string]T {
+	copy := make(map[string]T, len(m))
 
 	for k, v := range m {
 		copy[strings.ToUpper(k)] = v
@@ -126,13 +214,54 @@ func readConfigJson() (config, error) {
 	}
 	cnf.Twitch.Rewards = allKeysToUpper(cnf.Twitch.Rewards)
 	cnf.StreamElements.Perks = allKeysToUpper(cnf.StreamElements.Perks)
+	cnf.Twitch.RewardCooldowns = allKeysToUpper(cnf.Twitch.RewardCooldowns)
+	cnf.StreamElements.PerkCooldowns = allKeysToUpper(cnf.StreamElements.PerkCooldowns)
 
 	if cnf.Twitch.Chat == nil {
 		cnf.Twitch.Chat = make(map[string]chatCommand)
 	}
+	cnf.Twitch.chat = indexChatCommands("chat:", cnf.Twitch.Chat)
+	cnf.Twitch.channelChat = make(map[string]chatcommand.Set[chatCommand], len(cnf.Twitch.ChannelChat))
+	for channel, commands := range cnf.Twitch.ChannelChat {
+		channel = strings.ToLower(strings.TrimPrefix(channel, "#"))
+		cnf.Twitch.channelChat[channel] = indexChatCommands("chat:"+channel+":", commands)
+	}
+	validateActions(cnf, app.logger)
 	return cnf, nil
 }
 
+// validateActions reports all actions and chat messages with invalid placeholders, these reject every invocation
+func validateActions(cnf config, logger *zap.Logger) {
+	check := func(kind, name string, actions []string) {
+		for _, action := range actions {
+			if _, err := actiontemplate.Parse(action); err != nil {
+				logger.Warn("invalid action", zap.String("kind", kind), zap.String("name", name), zap.String("action", action), zap.Error(err))
+			}
+		}
+	}
+	for name, actions := range cnf.Twitch.Rewards {
+		check("reward", name, actions)
+	}
+	for bits, actions := range cnf.Twitch.Bits {
+		check("bits", strconv.Itoa(bits), actions)
+	}
+	checkCommand := func(name string, cmd chatCommand) {
+		check("chat", name, cmd.Actions)
+		check("chat message", name, []string{cmd.Message, cmd.CooldownMessage})
+	}
+	for name, cmd := range cnf.Twitch.Chat {
+		checkCommand(name, cmd)
+	}
+	for channel, commands := range cnf.Twitch.ChannelChat {
+		for name, cmd := range commands {
+			checkCommand(channel+" "+name, cmd)
+		}
+	}
+	for name, actions := range cnf.StreamElements.Perks {
+		check("perk", name, actions)
+	}
+}
+
 func watchForConfigChanges(ctx context.Context, watcher *fsnotify.Watcher, logger *zap.Logger) {
 	execPath, err := os.Executable()
 	if err != nil {
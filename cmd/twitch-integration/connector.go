@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kirides/twitch-integration/pipeproto"
+	"go.uber.org/zap"
+)
+
+const (
+	requestTimeout = 10 * time.Second
+	// handshakeTimeout is how long to wait for the connector's hello before assuming it only speaks Version1
+	handshakeTimeout = 2 * time.Second
+)
+
+var errConnectorClosed = errors.New("connection to the connector closed")
+
+// integrationHello is sent to the connector when connecting
+var integrationHello = pipeproto.Hello{
+	Version:      pipeproto.CurrentVersion,
+	MinVersion:   pipeproto.Version1,
+	Client:       "twitch-integration",
+	Events:       []string{pipeproto.TypeChat, pipeproto.TypeRedemption, pipeproto.TypeBits, pipeproto.TypePerk},
+	MaxFrameSize: pipeproto.DefaultMaxFrameSize,
+}
+
+type outgoingFrame struct {
+	id   uint64
+	data []byte
+}
+
+// connectorClient sends requests to the connector and matches its responses.
+// Requests are written in order by run, which waits for the handshake to complete.
+type connectorClient struct {
+	w      *pipeproto.FrameWriter
+	out    chan outgoingFrame
+	nextID atomic.Uint64
+
+	readyOnce sync.Once
+	ready     chan struct{}
+	done      chan struct{}
+
+	mtx     sync.Mutex
+	pending map[uint64]chan pipeproto.Envelope
+	closed  bool
+
+	// stats is the answer to the last stats request, see Stats
+	statsMtx        sync.Mutex
+	stats           json.RawMessage
+	statsRefreshing bool
+}
+
+func newConnectorClient(w io.Writer) *connectorClient {
+	return &connectorClient{
+		w:       pipeproto.NewFrameWriter(w),
+		out:     make(chan outgoingFrame, 64),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan pipeproto.Envelope),
+	}
+}
+
+// hello starts the handshake, nothing else may be written until completeHandshake was called
+func (c *connectorClient) hello() error {
+	data, err := pipeproto.Marshal(pipeproto.TypeHello, 0, integrationHello)
+	if err != nil {
+		return err
+	}
+	return c.w.Write(data)
+}
+
+// completeHandshake switches to the negotiated framing and releases queued requests.
+// It returns false if the handshake was already completed, e.g. by timing out.
+func (c *connectorClient) completeHandshake(version, peerMaxSize int) bool {
+	completed := false
+	c.readyOnce.Do(func() {
+		c.w.Upgrade(version, peerMaxSize)
+		close(c.ready)
+		completed = true
+	})
+	return completed
+}
+
+// run writes queued requests until the client is closed. Write errors close conn.
+func (c *connectorClient) run(conn io.Closer, logger *zap.Logger) {
+	select {
+	case <-c.ready:
+	case <-c.done:
+		return
+	}
+	for {
+		select {
+		case <-c.done:
+			return
+		case f := <-c.out:
+			err := c.w.Write(f.data)
+			if err == nil {
+				continue
+			}
+			if errors.Is(err, pipeproto.ErrFrameTooLarge) {
+				c.resolve(pipeproto.Envelope{ID: f.id, Error: pipeproto.Errorf(pipeproto.CodeBadRequest, "%v", err)})
+				continue
+			}
+			logger.Warn("could not write to connector", zap.Error(err))
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (c *connectorClient) enqueue(typ string, id uint64, data any) error {
+	msg, err := pipeproto.Marshal(typ, id, data)
+	if err != nil {
+		return err
+	}
+	select {
+	case c.out <- outgoingFrame{id: id, data: msg}:
+		return nil
+	case <-c.done:
+		return errConnectorClosed
+	}
+}
+
+// Notify sends a request without waiting for a response
+func (c *connectorClient) Notify(typ string, data any) error {
+	return c.enqueue(typ, 0, data)
+}
+
+// Request sends a request and waits for its response.
+// Failed requests return a *pipeproto.Error.
+func (c *connectorClient) Request(ctx context.Context, typ string, data any) (json.RawMessage, error) {
+	id, ch, err := c.start(typ, data)
+	if err != nil {
+		return nil, err
+	}
+	return c.wait(ctx, id, ch)
+}
+
+// RequestAsync sends a request and logs if it fails. Requests are queued before it returns,
+// so the connector receives them in order.
+func (c *connectorClient) RequestAsync(ctx context.Context, logger *zap.Logger, typ string, data any) {
+	id, ch, err := c.start(typ, data)
+	if err != nil {
+		logger.Warn("could not send request", zap.String("type", typ), zap.Error(err))
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+		defer cancel()
+		if _, err := c.wait(ctx, id, ch); err != nil {
+			logger.Warn("request failed", zap.String("type", typ), zap.Error(err))
+		}
+	}()
+}
+
+// Stats returns the connector's stats of the last completed request, or nil if there is none yet.
+// It never waits for the connector, each call starts a new request unless one is still running.
+func (c *connectorClient) Stats(logger *zap.Logger) json.RawMessage {
+	c.statsMtx.Lock()
+	defer c.statsMtx.Unlock()
+	if !c.statsRefreshing {
+		c.statsRefreshing = true
+		go c.refreshStats(logger)
+	}
+	return c.stats
+}
+
+func (c *connectorClient) refreshStats(logger *zap.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	data, err := c.Request(ctx, pipeproto.TypeStats, nil)
+
+	c.statsMtx.Lock()
+	defer c.statsMtx.Unlock()
+	c.statsRefreshing = false
+	if err != nil {
+		logger.Warn("could not query stats", zap.Error(err))
+		return
+	}
+	c.stats = data
+}
+
+func (c *connectorClient) start(typ string, data any) (uint64, chan pipeproto.Envelope, error) {
+	id := c.nextID.Add(1)
+	ch := make(chan pipeproto.Envelope, 1)
+
+	c.mtx.Lock()
+	if c.closed {
+		c.mtx.Unlock()
+		return 0, nil, errConnectorClosed
+	}
+	c.pending[id] = ch
+	c.mtx.Unlock()
+
+	if err := c.enqueue(typ, id, data); err != nil {
+		c.forget(id)
+		return 0, nil, err
+	}
+	return id, ch, nil
+}
+
+func (c *connectorClient) wait(ctx context.Context, id uint64, ch chan pipeproto.Envelope) (json.RawMessage, error) {
+	select {
+	case <-ctx.Done():
+		c.forget(id)
+		return nil, ctx.Err()
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, errConnectorClosed
+		}
+		if resp.Error != nil {
+			return nil, resp.Error
+		}
+		return resp.Data, nil
+	}
+}
+
+func (c *connectorClient) forget(id uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.pending, id)
+}
+
+// resolve hands a response to the request waiting for it
+func (c *connectorClient) resolve(resp pipeproto.Envelope) {
+	c.mtx.Lock()
+	ch, ok := c.pending[resp.ID]
+	delete(c.pending, resp.ID)
+	c.mtx.Unlock()
+	if ok {
+		ch <- resp
+	}
+}
+
+// close fails all pending and future requests
+func (c *connectorClient) close() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.done)
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kirides/twitch-integration/pipeproto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConnectorClientStats(t *testing.T) {
+	conn, connector := net.Pipe()
+	defer connector.Close()
+	c := newConnectorClient(conn)
+	defer c.close()
+	c.completeHandshake(pipeproto.CurrentVersion, pipeproto.DefaultMaxFrameSize)
+	go c.run(conn, zap.NewNop())
+
+	// the first call has nothing to return yet and must not wait for the connector
+	assert.Nil(t, c.Stats(zap.NewNop()))
+	assert.Nil(t, c.Stats(zap.NewNop()))
+
+	reader := pipeproto.NewFrameReader(connector)
+	reader.Upgrade(pipeproto.CurrentVersion, pipeproto.DefaultMaxFrameSize)
+	data, err := reader.Read()
+	require.NoError(t, err)
+	var req pipeproto.Envelope
+	require.NoError(t, json.Unmarshal(data, &req))
+	require.Equal(t, pipeproto.TypeStats, req.Type)
+	c.resolve(pipeproto.Envelope{Type: pipeproto.TypeResponse, ID: req.ID, Data: json.RawMessage(`{"published":1}`)})
+
+	require.Eventually(t, func() bool {
+		return string(c.Stats(zap.NewNop())) == `{"published":1}`
+	}, time.Second, time.Millisecond*10)
+}
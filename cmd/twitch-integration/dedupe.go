@@ -0,0 +1,36 @@
+package main
+
+import "sync"
+
+// recentIDs remembers the last IDs it was given, to skip events the connector delivered again
+type recentIDs struct {
+	mtx   sync.Mutex
+	ids   map[uint64]struct{}
+	order []uint64
+	next  int
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{
+		ids:   make(map[uint64]struct{}, size),
+		order: make([]uint64, 0, size),
+	}
+}
+
+// add returns false if id was already added, otherwise it forgets the oldest ID once full
+func (r *recentIDs) add(id uint64) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if _, ok := r.ids[id]; ok {
+		return false
+	}
+	if len(r.order) < cap(r.order) {
+		r.order = append(r.order, id)
+	} else {
+		delete(r.ids, r.order[r.next])
+		r.order[r.next] = id
+		r.next = (r.next + 1) % len(r.order)
+	}
+	r.ids[id] = struct{}{}
+	return true
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"strings"
-	"syscall"
+	"time"
 
-	"github.com/Microsoft/go-winio"
+	"github.com/kirides/twitch-integration/actiontemplate"
+	"github.com/kirides/twitch-integration/chatcommand"
+	"github.com/kirides/twitch-integration/pipeproto"
+	"github.com/kirides/twitch-integration/transport"
 	"go.uber.org/zap"
 )
 
@@ -22,7 +24,7 @@ func main() {
 }
 
 func handleEventPipe(ctx context.Context, app *App, logger *zap.Logger) error {
-	conn, err := winio.DialPipeAccess(ctx, `\\.\pipe\__TwitchIntegration_Kirides_Conn`, syscall.GENERIC_READ)
+	conn, err := transport.Dial(ctx, app.GetConfig().Transport)
 	if err != nil {
 		return err
 	}
@@ -31,102 +33,247 @@ func handleEventPipe(ctx context.Context, app *App, logger *zap.Logger) error {
 		<-ctx.Done()
 		conn.Close()
 	}()
-	logger.Debug("connected to event pipe")
+	logger.Debug("connected to event pipe", zap.Stringer("transport", app.GetConfig().Transport))
 
-	buffer := make([]byte, 16384)
+	client := newConnectorClient(conn)
+	defer client.close()
+	app.connector.Store(client)
+	defer app.connector.CompareAndSwap(client, nil)
+
+	if err := client.hello(); err != nil {
+		return fmt.Errorf("could not start handshake. %w", err)
+	}
+	// connectors without handshake support never answer
+	fallback := time.AfterFunc(handshakeTimeout, func() {
+		if client.completeHandshake(pipeproto.Version1, pipeproto.MaxFrameSize) {
+			logger.Info("connector did not answer the handshake, using protocol version 1")
+		}
+	})
+	defer fallback.Stop()
+	go client.run(conn, logger)
+
+	reader := pipeproto.NewFrameReader(conn)
 	for {
-		if _, err := io.ReadFull(conn, buffer[:2]); err != nil {
-			return fmt.Errorf("could not read message size. %w", err)
+		data, err := reader.Read()
+		if err != nil {
+			if errors.Is(err, pipeproto.ErrFrameTooLarge) {
+				logger.Warn("message dropped", zap.Error(err))
+				continue
+			}
+			return fmt.Errorf("could not read message. %w", err)
 		}
-		size := binary.LittleEndian.Uint16(buffer[:2])
-		if int(size) > len(buffer) {
-			return fmt.Errorf("unexpectedly large message")
+		var event pipeproto.Envelope
+		if err := json.Unmarshal(data, &event); err != nil {
+			logger.Warn("message dropped, could not deserialize it", zap.Error(err))
+			continue
 		}
-		if _, err := io.ReadFull(conn, buffer[:size]); err != nil {
-			return fmt.Errorf("could not read message. %w", err)
+		switch event.Type {
+		case pipeproto.TypeResponse:
+			client.resolve(event)
+			continue
+		case pipeproto.TypeHello:
+			if event.Error != nil {
+				return fmt.Errorf("connector rejected the handshake. %w", event.Error)
+			}
+			var hello pipeproto.Hello
+			if err := json.Unmarshal(event.Data, &hello); err != nil {
+				return fmt.Errorf("could not deserialize handshake. %w", err)
+			}
+			reader.Upgrade(hello.Version, integrationHello.MaxFrameSize)
+			if !client.completeHandshake(hello.Version, hello.MaxFrameSize) {
+				// requests were already sent using version 1
+				return fmt.Errorf("connector answered the handshake after %s", handshakeTimeout)
+			}
+			logger.Info("connected to connector", zap.String("connector", hello.Client), zap.Int("version", hello.Version))
+			continue
+		}
+
+		if event.ID != 0 && !app.seenEvents.add(event.ID) {
+			logger.Debug("ignoring redelivered event", zap.Uint64("id", event.ID), zap.String("type", event.Type))
+			ackEvent(client, logger, event.ID)
+			continue
 		}
-		type envelope struct {
-			Type string          `json:"type"`
-			Data json.RawMessage `json:"data"`
+		if err := handleEvent(ctx, client, logger, event); err != nil {
+			// the event fails the same way when it is delivered again, so it is acknowledged anyway
+			logger.Warn("skipping event", zap.Uint64("id", event.ID), zap.String("type", event.Type), zap.Error(err))
 		}
-		var event envelope
-		if err := json.Unmarshal(buffer[:size], &event); err != nil {
-			return fmt.Errorf("could not deserialize message. %w", err)
+		if event.ID != 0 {
+			ackEvent(client, logger, event.ID)
 		}
+	}
+}
 
-		cnf := app.GetConfig()
-		switch event.Type {
-		case "chat":
-			type ChatMessage struct {
-				Text    string `json:"text"`
-				Sender  string `json:"sender"`
-				Channel string `json:"channel"`
-			}
-			var chatMessage ChatMessage
-			if err := json.Unmarshal(event.Data, &chatMessage); err != nil {
-				return fmt.Errorf("could not deserialize chat message event. %w", err)
-			}
-			if fn, ok := cnf.Twitch.Chat[chatMessage.Text]; ok {
-				logger.Info("Event accepted", zap.String("sender", chatMessage.Sender), zap.String("text", chatMessage.Text), zap.Strings("actions", fn.Actions))
-				for _, fn := range fn.Actions {
-					fn := strings.TrimSpace(fn)
-					enqueueEvent(fmt.Sprintf("CHAT %s %s", chatMessage.Sender, fn))
-				}
-			}
-		case "redemption":
-			type Redemption struct {
-				Title    string `json:"title"`
-				Redeemer string `json:"redeemer"`
-				Channel  string `json:"channel"`
-			}
-			var redeption Redemption
-			if err := json.Unmarshal(event.Data, &redeption); err != nil {
-				return fmt.Errorf("could not deserialize redeption event. %w", err)
-			}
-			logger.Debug("reward triggered", zap.String("redeemer", redeption.Redeemer), zap.String("reward", redeption.Title))
-			if fn, ok := cnf.Twitch.Rewards[strings.ToUpper(redeption.Title)]; ok {
-				logger.Info("handling reward", zap.String("redeemer", redeption.Redeemer), zap.String("reward", redeption.Title), zap.Strings("actions", fn))
-				for _, fn := range fn {
-					fn := strings.TrimSpace(fn)
-					enqueueEvent(fmt.Sprintf("REWARD_ADD %s %s", redeption.Redeemer, fn))
-				}
-			}
-		case "bits":
-			type BitsEvent struct {
-				BitsUsed int    `json:"bitsUsed"`
-				User     string `json:"user"`
-				Channel  string `json:"channel"`
-			}
-			var redeption BitsEvent
-			if err := json.Unmarshal(event.Data, &redeption); err != nil {
-				return fmt.Errorf("could not deserialize redeption event. %w", err)
-			}
-			logger.Debug("bits triggered", zap.String("bits_user", redeption.User), zap.Int("bits", redeption.BitsUsed))
-			if fn, ok := cnf.Twitch.Bits[redeption.BitsUsed]; ok {
-				logger.Info("handling bits", zap.String("bits_user", redeption.User), zap.Int("bits", redeption.BitsUsed), zap.Strings("actions", fn))
-				for _, fn := range fn {
-					fn := strings.TrimSpace(fn)
-					enqueueEvent(fmt.Sprintf("BITS_USED %s %s", redeption.User, fn))
-				}
-			}
-		case "streamelements-perk":
-			type Redemption struct {
-				Title    string `json:"title"`
-				Redeemer string `json:"redeemer"`
-				Channel  string `json:"channel"`
-			}
-			var redeption Redemption
-			if err := json.Unmarshal(event.Data, &redeption); err != nil {
-				return fmt.Errorf("could not deserialize streamelements-perk event. %w", err)
-			}
-			logger.Debug("StreamElements perk triggered", zap.String("redeemer", redeption.Redeemer), zap.String("perk", redeption.Title))
-			if fn, ok := cnf.StreamElements.Perks[strings.ToUpper(redeption.Title)]; ok {
-				logger.Info("handling StreamElements perk", zap.String("redeemer", redeption.Redeemer), zap.String("perk", redeption.Title), zap.Strings("actions", fn))
-				for _, fn := range fn {
-					fn := strings.TrimSpace(fn)
-					enqueueEvent(fmt.Sprintf("REWARD_ADD %s %s", redeption.Redeemer, fn))
-				}
+// ackEvent tells the connector that the event was handled, so it is not delivered again
+func ackEvent(client *connectorClient, logger *zap.Logger, id uint64) {
+	if err := client.Notify(pipeproto.TypeAck, pipeproto.Ack{EventIDs: []uint64{id}}); err != nil {
+		logger.Warn("could not acknowledge event", zap.Uint64("id", id), zap.Error(err))
+	}
+}
+
+// handleEvent enqueues the actions for the event. An error means that the event is malformed.
+func handleEvent(ctx context.Context, client *connectorClient, logger *zap.Logger, event pipeproto.Envelope) error {
+	cnf := app.GetConfig()
+	switch event.Type {
+	case pipeproto.TypeChat:
+		type ChatMessage struct {
+			Text    string   `json:"text"`
+			Sender  string   `json:"sender"`
+			Channel string   `json:"channel"`
+			Command string   `json:"command"`
+			Args    []string `json:"args"`
+		}
+		var chatMessage ChatMessage
+		if err := json.Unmarshal(event.Data, &chatMessage); err != nil {
+			return fmt.Errorf("could not deserialize chat message event. %w", err)
+		}
+		if chatMessage.Command == "" {
+			// sent by a connector that does not parse commands yet
+			cmd, _ := chatcommand.Parse("", chatMessage.Text)
+			chatMessage.Command, chatMessage.Args = cmd.Name, cmd.Args
+		}
+		fn, ok := cnf.Twitch.chatCommand(chatMessage.Channel, chatMessage.Command)
+		if !ok {
+			// commands containing spaces only match the whole message
+			fn, ok = cnf.Twitch.chatCommand(chatMessage.Channel, chatMessage.Text)
+		}
+		if ok {
+			vars := actiontemplate.Vars{
+				User:  chatMessage.Sender,
+				Input: strings.Join(chatMessage.Args, " "),
+				Args:  chatMessage.Args,
+			}
+			actions, err := actiontemplate.ExpandAll(fn.Actions, vars)
+			if err != nil {
+				logger.Warn("Event rejected", zap.String("sender", chatMessage.Sender), zap.String("command", chatMessage.Command), zap.Strings("args", chatMessage.Args), zap.Error(err))
+				return nil
+			}
+			rule := cnf.cooldownRule(fn.key, fn.cooldown())
+			if remaining, ok := app.cooldowns.Try(rule, chatMessage.Sender); !ok {
+				logger.Info("Event on cooldown", zap.String("sender", chatMessage.Sender), zap.String("command", chatMessage.Command), zap.Duration("remaining", remaining))
+				vars.Remaining = remaining
+				sendChatTemplate(ctx, client, logger, chatMessage.Channel, fn.CooldownMessage, vars)
+				return nil
+			}
+			logger.Info("Event accepted", zap.String("sender", chatMessage.Sender), zap.String("command", chatMessage.Command), zap.Strings("args", chatMessage.Args), zap.Strings("actions", actions))
+			for _, fn := range actions {
+				enqueueEvent(fmt.Sprintf("CHAT %s %s", chatMessage.Sender, fn))
 			}
+			// time until anyone can use the command again
+			vars.Remaining = max(rule.Global, rule.GroupCooldown)
+			sendChatTemplate(ctx, client, logger, chatMessage.Channel, fn.Message, vars)
 		}
+	case pipeproto.TypeRedemption:
+		type Redemption struct {
+			Title    string `json:"title"`
+			Redeemer string `json:"redeemer"`
+			Channel  string `json:"channel"`
+			Input    string `json:"input"`
+			ID       string `json:"id"`
+			RewardID string `json:"reward_id"`
+		}
+		var redeption Redemption
+		if err := json.Unmarshal(event.Data, &redeption); err != nil {
+			return fmt.Errorf("could not deserialize redeption event. %w", err)
+		}
+		// updateRedemption refunds rejected redemptions and completes accepted ones
+		updateRedemption := func(status string) {
+			if !cnf.Twitch.UpdateRedemptions || redeption.ID == "" {
+				return
+			}
+			client.RequestAsync(ctx, logger, pipeproto.TypeRedemptionUpdate, pipeproto.RedemptionUpdate{
+				RewardID:     redeption.RewardID,
+				RedemptionID: redeption.ID,
+				Status:       status,
+			})
+		}
+		logger.Debug("reward triggered", zap.String("redeemer", redeption.Redeemer), zap.String("reward", redeption.Title))
+		if fn, ok := cnf.Twitch.Rewards[strings.ToUpper(redeption.Title)]; ok {
+			actions, err := actiontemplate.ExpandAll(fn, actiontemplate.Vars{User: redeption.Redeemer, Input: redeption.Input})
+			if err != nil {
+				logger.Warn("reward rejected", zap.String("redeemer", redeption.Redeemer), zap.String("reward", redeption.Title), zap.Error(err))
+				updateRedemption(pipeproto.StatusCanceled)
+				return nil
+			}
+			title := strings.ToUpper(redeption.Title)
+			if remaining, ok := app.cooldowns.Try(cnf.cooldownRule("reward:"+title, cnf.Twitch.RewardCooldowns[title]), redeption.Redeemer); !ok {
+				logger.Info("reward on cooldown", zap.String("redeemer", redeption.Redeemer), zap.String("reward", redeption.Title), zap.Duration("remaining", remaining))
+				updateRedemption(pipeproto.StatusCanceled)
+				return nil
+			}
+			logger.Info("handling reward", zap.String("redeemer", redeption.Redeemer), zap.String("reward", redeption.Title), zap.Strings("actions", actions))
+			for _, fn := range actions {
+				enqueueEvent(fmt.Sprintf("REWARD_ADD %s %s", redeption.Redeemer, fn))
+			}
+			updateRedemption(pipeproto.StatusFulfilled)
+		}
+	case pipeproto.TypeBits:
+		type BitsEvent struct {
+			BitsUsed int    `json:"bitsUsed"`
+			User     string `json:"user"`
+			Channel  string `json:"channel"`
+		}
+		var redeption BitsEvent
+		if err := json.Unmarshal(event.Data, &redeption); err != nil {
+			return fmt.Errorf("could not deserialize redeption event. %w", err)
+		}
+		logger.Debug("bits triggered", zap.String("bits_user", redeption.User), zap.Int("bits", redeption.BitsUsed))
+		if fn, ok := cnf.Twitch.Bits[redeption.BitsUsed]; ok {
+			actions, err := actiontemplate.ExpandAll(fn, actiontemplate.Vars{User: redeption.User, Bits: redeption.BitsUsed})
+			if err != nil {
+				logger.Warn("bits rejected", zap.String("bits_user", redeption.User), zap.Int("bits", redeption.BitsUsed), zap.Error(err))
+				return nil
+			}
+			if remaining, ok := app.cooldowns.Try(cnf.cooldownRule(fmt.Sprintf("bits:%d", redeption.BitsUsed), cnf.Twitch.BitsCooldowns[redeption.BitsUsed]), redeption.User); !ok {
+				logger.Info("bits on cooldown", zap.String("bits_user", redeption.User), zap.Int("bits", redeption.BitsUsed), zap.Duration("remaining", remaining))
+				return nil
+			}
+			logger.Info("handling bits", zap.String("bits_user", redeption.User), zap.Int("bits", redeption.BitsUsed), zap.Strings("actions", actions))
+			for _, fn := range actions {
+				enqueueEvent(fmt.Sprintf("BITS_USED %s %s", redeption.User, fn))
+			}
+		}
+	case pipeproto.TypePerk:
+		type Redemption struct {
+			Title    string `json:"title"`
+			Redeemer string `json:"redeemer"`
+			Channel  string `json:"channel"`
+			Input    string `json:"input"`
+		}
+		var redeption Redemption
+		if err := json.Unmarshal(event.Data, &redeption); err != nil {
+			return fmt.Errorf("could not deserialize streamelements-perk event. %w", err)
+		}
+		logger.Debug("StreamElements perk triggered", zap.String("redeemer", redeption.Redeemer), zap.String("perk", redeption.Title))
+		if fn, ok := cnf.StreamElements.Perks[strings.ToUpper(redeption.Title)]; ok {
+			actions, err := actiontemplate.ExpandAll(fn, actiontemplate.Vars{User: redeption.Redeemer, Input: redeption.Input})
+			if err != nil {
+				logger.Warn("StreamElements perk rejected", zap.String("redeemer", redeption.Redeemer), zap.String("perk", redeption.Title), zap.Error(err))
+				return nil
+			}
+			title := strings.ToUpper(redeption.Title)
+			if remaining, ok := app.cooldowns.Try(cnf.cooldownRule("perk:"+title, cnf.StreamElements.PerkCooldowns[title]), redeption.Redeemer); !ok {
+				logger.Info("StreamElements perk on cooldown", zap.String("redeemer", redeption.Redeemer), zap.String("perk", redeption.Title), zap.Duration("remaining", remaining))
+				return nil
+			}
+			logger.Info("handling StreamElements perk", zap.String("redeemer", redeption.Redeemer), zap.String("perk", redeption.Title), zap.Strings("actions", actions))
+			for _, fn := range actions {
+				enqueueEvent(fmt.Sprintf("REWARD_ADD %s %s", redeption.Redeemer, fn))
+			}
+		}
+	}
+	return nil
+}
+
+// sendChatTemplate expands the template and asks the connector to post it to channel.
+// Empty templates are ignored.
+func sendChatTemplate(ctx context.Context, client *connectorClient, logger *zap.Logger, channel, template string, vars actiontemplate.Vars) {
+	if template == "" {
+		return
+	}
+	message, err := actiontemplate.Expand(template, vars)
+	if err != nil {
+		logger.Warn("could not create chat message", zap.String("template", template), zap.Error(err))
+		return
 	}
+	client.RequestAsync(ctx, logger, pipeproto.TypeChatSend, pipeproto.ChatSend{Channel: channel, Message: message})
 }
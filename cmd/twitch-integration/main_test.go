@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kirides/twitch-integration/pipeproto"
+	"github.com/kirides/twitch-integration/transport"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// acceptConnector accepts the integration on l and completes the handshake
+func acceptConnector(t *testing.T, l net.Listener) (net.Conn, *pipeproto.FrameReader, *pipeproto.FrameWriter) {
+	t.Helper()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	reader := pipeproto.NewFrameReader(conn)
+	writer := pipeproto.NewFrameWriter(conn)
+	data, err := reader.Read()
+	require.NoError(t, err)
+	var hello pipeproto.Envelope
+	require.NoError(t, json.Unmarshal(data, &hello))
+	require.Equal(t, pipeproto.TypeHello, hello.Type)
+
+	answer, err := pipeproto.Marshal(pipeproto.TypeHello, 0, pipeproto.Hello{
+		Version:      pipeproto.CurrentVersion,
+		Client:       "connector",
+		MaxFrameSize: pipeproto.DefaultMaxFrameSize,
+	})
+	require.NoError(t, err)
+	require.NoError(t, writer.WriteAndUpgrade(answer, pipeproto.CurrentVersion, pipeproto.DefaultMaxFrameSize))
+	reader.Upgrade(pipeproto.CurrentVersion, pipeproto.DefaultMaxFrameSize)
+	return conn, reader, writer
+}
+
+func TestHandleEventPipeAcksMalformedEvents(t *testing.T) {
+	cnf := defaultConfig()
+	cnf.Transport = transport.Config{Kind: transport.KindUnix, Address: filepath.Join(t.TempDir(), "connector.sock")}
+	prevCnf := activeCnf
+	activeCnf = &cnf
+	t.Cleanup(func() { activeCnf = prevCnf })
+
+	l, err := transport.Listen(cnf.Transport)
+	require.NoError(t, err)
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- handleEventPipe(ctx, app, zap.NewNop()) }()
+	_, reader, writer := acceptConnector(t, l)
+
+	events := []pipeproto.Envelope{
+		{Type: pipeproto.TypeChat, ID: 1001, Data: json.RawMessage(`"not a chat message"`)},
+		{Type: pipeproto.TypeRedemption, ID: 1002, Data: json.RawMessage(`{"title":1}`)},
+		{Type: pipeproto.TypeBits, ID: 1003, Data: json.RawMessage(`{"bitsUsed":"many"}`)},
+		{Type: pipeproto.TypePerk, ID: 1004, Data: json.RawMessage(`[]`)},
+	}
+	// a message that is not an envelope at all must not end the connection either
+	require.NoError(t, writer.Write([]byte(`{"type":`)))
+	for _, evt := range events {
+		data, err := json.Marshal(evt)
+		require.NoError(t, err)
+		require.NoError(t, writer.Write(data))
+	}
+
+	var acked []uint64
+	for len(acked) < len(events) {
+		data, err := reader.Read()
+		require.NoError(t, err)
+		var msg pipeproto.Envelope
+		require.NoError(t, json.Unmarshal(data, &msg))
+		if msg.Type != pipeproto.TypeAck {
+			continue
+		}
+		var ack pipeproto.Ack
+		require.NoError(t, json.Unmarshal(msg.Data, &ack))
+		acked = append(acked, ack.EventIDs...)
+	}
+	assert.Equal(t, []uint64{1001, 1002, 1003, 1004}, acked)
+
+	select {
+	case err := <-done:
+		t.Fatalf("connection ended: %v", err)
+	default:
+	}
+	cancel()
+	<-done
+}
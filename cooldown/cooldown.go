@@ -0,0 +1,95 @@
+// Package cooldown keeps track of how long commands and rewards have to wait before they can be used again.
+package cooldown
+
+import (
+	"sync"
+	"time"
+)
+
+// pruneThreshold is the number of tracked keys after which expired ones are removed
+const pruneThreshold = 1024
+
+// Rule describes the cooldowns of a single command.
+// Zero durations disable the respective cooldown.
+type Rule struct {
+	// Key identifies the command, e.g. "chat:#hp"
+	Key string
+	// Global is the cooldown for everyone after anyone used the command
+	Global time.Duration
+	// PerUser is the cooldown for the user that used the command
+	PerUser time.Duration
+	// Group is shared by related commands, none of them can be used for GroupCooldown after one of them was used
+	Group         string
+	GroupCooldown time.Duration
+}
+
+// Tracker is safe for concurrent use. Its zero value is not usable, use NewTracker.
+type Tracker struct {
+	mtx     sync.Mutex
+	now     func() time.Time
+	expires map[string]time.Time
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		now:     time.Now,
+		expires: make(map[string]time.Time),
+	}
+}
+
+func (r Rule) keys(user string) map[string]time.Duration {
+	keys := make(map[string]time.Duration, 3)
+	if r.Global > 0 {
+		keys["global\x00"+r.Key] = r.Global
+	}
+	if r.PerUser > 0 && user != "" {
+		keys["user\x00"+r.Key+"\x00"+user] = r.PerUser
+	}
+	if r.GroupCooldown > 0 && r.Group != "" {
+		keys["group\x00"+r.Group] = r.GroupCooldown
+	}
+	return keys
+}
+
+// Try reports whether the command may be used by user right now and starts its cooldowns if it may.
+// Otherwise it returns the time until all cooldowns are over.
+func (t *Tracker) Try(rule Rule, user string) (time.Duration, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.now()
+	keys := rule.keys(user)
+
+	var remaining time.Duration
+	for key := range keys {
+		if expires, ok := t.expires[key]; ok && now.Before(expires) {
+			remaining = max(remaining, expires.Sub(now))
+		}
+	}
+	if remaining > 0 {
+		return remaining, false
+	}
+
+	if len(t.expires) >= pruneThreshold {
+		t.prune(now)
+	}
+	for key, d := range keys {
+		t.expires[key] = now.Add(d)
+	}
+	return 0, true
+}
+
+// Reset clears all cooldowns
+func (t *Tracker) Reset() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	clear(t.expires)
+}
+
+func (t *Tracker) prune(now time.Time) {
+	for key, expires := range t.expires {
+		if !now.Before(expires) {
+			delete(t.expires, key)
+		}
+	}
+}
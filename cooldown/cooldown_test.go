@@ -0,0 +1,101 @@
+package cooldown
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTracker() (*Tracker, *time.Time) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t := NewTracker()
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func TestGlobalCooldown(t *testing.T) {
+	tr, now := newTestTracker()
+	rule := Rule{Key: "chat:#hp", Global: time.Second * 10}
+
+	_, ok := tr.Try(rule, "a")
+	assert.True(t, ok)
+
+	*now = now.Add(time.Second * 4)
+	remaining, ok := tr.Try(rule, "b")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second*6, remaining)
+
+	*now = now.Add(time.Second * 6)
+	_, ok = tr.Try(rule, "b")
+	assert.True(t, ok)
+}
+
+func TestPerUserCooldown(t *testing.T) {
+	tr, now := newTestTracker()
+	rule := Rule{Key: "chat:#hp", PerUser: time.Minute}
+
+	_, ok := tr.Try(rule, "a")
+	assert.True(t, ok)
+	_, ok = tr.Try(rule, "b")
+	assert.True(t, ok, "other users are not affected")
+	_, ok = tr.Try(rule, "a")
+	assert.False(t, ok)
+
+	*now = now.Add(time.Minute)
+	_, ok = tr.Try(rule, "a")
+	assert.True(t, ok)
+}
+
+func TestGroupCooldown(t *testing.T) {
+	tr, now := newTestTracker()
+	spawnWolf := Rule{Key: "chat:#wolf", Group: "spawn", GroupCooldown: time.Second * 30}
+	spawnBear := Rule{Key: "reward:BEAR", Group: "spawn", GroupCooldown: time.Second * 30}
+	other := Rule{Key: "chat:#hp", Global: time.Second}
+
+	_, ok := tr.Try(spawnWolf, "a")
+	assert.True(t, ok)
+	remaining, ok := tr.Try(spawnBear, "b")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second*30, remaining)
+	_, ok = tr.Try(other, "b")
+	assert.True(t, ok)
+
+	*now = now.Add(time.Second * 30)
+	_, ok = tr.Try(spawnBear, "b")
+	assert.True(t, ok)
+}
+
+func TestRejectedUseDoesNotExtendCooldown(t *testing.T) {
+	tr, now := newTestTracker()
+	rule := Rule{Key: "chat:#hp", Global: time.Second * 10, PerUser: time.Minute}
+
+	_, ok := tr.Try(rule, "a")
+	assert.True(t, ok)
+
+	*now = now.Add(time.Second * 5)
+	_, ok = tr.Try(rule, "b")
+	assert.False(t, ok)
+
+	*now = now.Add(time.Second * 5)
+	_, ok = tr.Try(rule, "b")
+	assert.True(t, ok, "b never used the command")
+}
+
+func TestNoCooldown(t *testing.T) {
+	tr, _ := newTestTracker()
+	for range 3 {
+		_, ok := tr.Try(Rule{Key: "chat:#hp"}, "a")
+		assert.True(t, ok)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tr, now := newTestTracker()
+	for i := range pruneThreshold {
+		tr.Try(Rule{Key: "k", PerUser: time.Second}, string(rune('a'+i)))
+	}
+	*now = now.Add(time.Second)
+	tr.Try(Rule{Key: "k", PerUser: time.Second}, "new")
+	assert.Len(t, tr.expires, 1)
+}
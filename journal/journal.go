@@ -0,0 +1,253 @@
+// Package journal persists events until they were acknowledged.
+//
+// The journal is an append-only file of JSON lines. Appended events and acks are written as
+// separate records, so a crash at any point loses at most the record being written.
+// Once enough events were acknowledged the file is rewritten with only the pending events.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+// compactThreshold is the number of acknowledged events after which the file is rewritten
+const compactThreshold = 256
+
+// Entry is an event that was not acknowledged yet
+type Entry struct {
+	ID   uint64
+	Data json.RawMessage
+}
+
+type record struct {
+	ID   uint64          `json:"id,omitempty"`
+	Data json.RawMessage `json:"data,omitempty"`
+	Ack  []uint64        `json:"ack,omitempty"`
+	// NextID keeps IDs increasing after compaction removed all events
+	NextID uint64 `json:"next_id,omitempty"`
+}
+
+// Journal is safe for concurrent use
+type Journal struct {
+	mtx        sync.Mutex
+	path       string
+	f          *os.File
+	nextID     uint64
+	pending    map[uint64]json.RawMessage
+	maxPending int
+	acked      int
+}
+
+// Open reads the journal at path, creating it if it does not exist.
+// Once more than maxPending events are pending the oldest ones are dropped, 0 keeps all of them.
+func Open(path string, maxPending int) (*Journal, error) {
+	j := &Journal{
+		path:       path,
+		nextID:     1,
+		pending:    make(map[uint64]json.RawMessage),
+		maxPending: maxPending,
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// open opens the file for appending records
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	return nil
+}
+
+func (j *Journal) replay() error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// the last record may be incomplete after a crash
+			continue
+		}
+		if r.ID != 0 && r.Data != nil {
+			j.pending[r.ID] = r.Data
+			j.nextID = max(j.nextID, r.ID+1)
+		}
+		for _, id := range r.Ack {
+			delete(j.pending, id)
+		}
+		j.nextID = max(j.nextID, r.NextID)
+	}
+	return scanner.Err()
+}
+
+func (j *Journal) write(r record) error {
+	if j.f == nil {
+		// reopening the file after compacting failed
+		if err := j.open(); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// Append stores the event returned by data, which is called with the ID of the new entry.
+// The event must be valid JSON.
+func (j *Journal) Append(data func(id uint64) ([]byte, error)) (Entry, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	id := j.nextID
+	raw, err := data(id)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !json.Valid(raw) {
+		return Entry{}, fmt.Errorf("event %d is not valid JSON", id)
+	}
+	if err := j.write(record{ID: id, Data: raw}); err != nil {
+		return Entry{}, err
+	}
+	j.nextID++
+	j.pending[id] = raw
+
+	if j.maxPending > 0 && len(j.pending) > j.maxPending {
+		// the new event is stored either way, if the oldest one could not be dropped
+		// it stays until the next Append
+		j.ack([]uint64{slices.Min(j.ids())})
+	}
+	return Entry{ID: id, Data: raw}, nil
+}
+
+// Ack removes the events, unknown IDs are ignored
+func (j *Journal) Ack(ids ...uint64) error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	return j.ack(ids)
+}
+
+func (j *Journal) ack(ids []uint64) error {
+	known := ids[:0:0]
+	for _, id := range ids {
+		if _, ok := j.pending[id]; ok {
+			known = append(known, id)
+		}
+	}
+	if len(known) == 0 {
+		return nil
+	}
+	if err := j.write(record{Ack: known}); err != nil {
+		return err
+	}
+	for _, id := range known {
+		delete(j.pending, id)
+	}
+	j.acked += len(known)
+	if j.acked >= compactThreshold {
+		return j.compact()
+	}
+	return nil
+}
+
+func (j *Journal) ids() []uint64 {
+	ids := make([]uint64, 0, len(j.pending))
+	for id := range j.pending {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Pending returns all events that were not acknowledged, ordered by ID
+func (j *Journal) Pending() []Entry {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	entries := make([]Entry, 0, len(j.pending))
+	for _, id := range j.ids() {
+		entries = append(entries, Entry{ID: id, Data: j.pending[id]})
+	}
+	return entries
+}
+
+// compact replaces the file with one containing only the pending events
+func (j *Journal) compact() error {
+	tmpPath := j.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	err = enc.Encode(record{NextID: j.nextID})
+	for _, id := range j.ids() {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(record{ID: id, Data: j.pending[id]})
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cErr := tmp.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not compact journal. %w", err)
+	}
+
+	// windows does not allow replacing open files. The file is reopened whether closing it failed or not,
+	// an old file that is still open makes the rename fail.
+	j.f.Close()
+	j.f = nil
+	renameErr := os.Rename(tmpPath, j.path)
+	if err := j.open(); err != nil {
+		return fmt.Errorf("could not reopen journal. %w", err)
+	}
+	if renameErr != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not compact journal. %w", renameErr)
+	}
+	j.acked = 0
+	return nil
+}
+
+// Close closes the file, the journal must not be used afterwards
+func (j *Journal) Close() error {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if j.f == nil {
+		return nil
+	}
+	return j.f.Close()
+}
@@ -0,0 +1,145 @@
+package journal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func appendEvent(t *testing.T, j *Journal, name string) uint64 {
+	t.Helper()
+	e, err := j.Append(func(id uint64) ([]byte, error) {
+		return fmt.Appendf(nil, `{"id":%d,"name":%q}`, id, name), nil
+	})
+	require.NoError(t, err)
+	return e.ID
+}
+
+func TestJournalRedeliversAfterReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.journal")
+	j, err := Open(path, 0)
+	require.NoError(t, err)
+
+	first := appendEvent(t, j, "a")
+	second := appendEvent(t, j, "b")
+	third := appendEvent(t, j, "c")
+	require.NoError(t, j.Ack(second, 42))
+	require.NoError(t, j.Close())
+
+	j, err = Open(path, 0)
+	require.NoError(t, err)
+	defer j.Close()
+
+	assert.Equal(t, []Entry{
+		{ID: first, Data: []byte(`{"id":1,"name":"a"}`)},
+		{ID: third, Data: []byte(`{"id":3,"name":"c"}`)},
+	}, j.Pending())
+	assert.Equal(t, uint64(4), appendEvent(t, j, "d"))
+}
+
+func TestJournalIgnoresIncompleteRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.journal")
+	j, err := Open(path, 0)
+	require.NoError(t, err)
+	appendEvent(t, j, "a")
+	require.NoError(t, j.Close())
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"id":2,"data":{"na`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	j, err = Open(path, 0)
+	require.NoError(t, err)
+	defer j.Close()
+	require.Len(t, j.Pending(), 1)
+}
+
+func TestJournalCompactionKeepsIDsIncreasing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.journal")
+	j, err := Open(path, 0)
+	require.NoError(t, err)
+
+	var last uint64
+	for i := range compactThreshold {
+		last = appendEvent(t, j, fmt.Sprint(i))
+		require.NoError(t, j.Ack(last))
+	}
+	kept := appendEvent(t, j, "kept")
+	require.NoError(t, j.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("{\"next_id\":%d}\n{\"id\":%d,\"data\":{\"id\":%d,\"name\":\"kept\"}}\n", last+1, kept, kept), string(data))
+
+	j, err = Open(path, 0)
+	require.NoError(t, err)
+	defer j.Close()
+	assert.Len(t, j.Pending(), 1)
+	assert.Equal(t, kept+1, appendEvent(t, j, "next"))
+}
+
+func TestJournalDropsOldestAboveMaxPending(t *testing.T) {
+	j, err := Open(filepath.Join(t.TempDir(), "events.journal"), 2)
+	require.NoError(t, err)
+	defer j.Close()
+
+	appendEvent(t, j, "a")
+	b := appendEvent(t, j, "b")
+	c := appendEvent(t, j, "c")
+
+	pending := j.Pending()
+	require.Len(t, pending, 2)
+	assert.Equal(t, b, pending[0].ID)
+	assert.Equal(t, c, pending[1].ID)
+}
+
+func TestJournalAppendKeepsEventWhenEvictionFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.journal")
+	j, err := Open(path, 1)
+	require.NoError(t, err)
+	defer j.Close()
+
+	// dropping the oldest event compacts the journal, which fails
+	require.NoError(t, os.Mkdir(path+".tmp", 0750))
+	j.acked = compactThreshold - 1
+	appendEvent(t, j, "a")
+	b := appendEvent(t, j, "b")
+
+	pending := j.Pending()
+	require.Len(t, pending, 1)
+	assert.Equal(t, b, pending[0].ID)
+	assert.Equal(t, b+1, appendEvent(t, j, "c"))
+}
+
+func TestJournalReopensFileAfterFailedCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.journal")
+	j, err := Open(path, 0)
+	require.NoError(t, err)
+
+	a := appendEvent(t, j, "a")
+	b := appendEvent(t, j, "b")
+	// a directory in place of the journal fails replacing and reopening it
+	require.NoError(t, os.Rename(path, path+".moved"))
+	require.NoError(t, os.Mkdir(path, 0750))
+	j.acked = compactThreshold - 1
+	assert.Error(t, j.Ack(a))
+
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.Rename(path+".moved", path))
+	c := appendEvent(t, j, "c")
+	require.NoError(t, j.Close())
+
+	j, err = Open(path, 0)
+	require.NoError(t, err)
+	defer j.Close()
+	pending := j.Pending()
+	require.Len(t, pending, 2)
+	assert.Equal(t, b, pending[0].ID)
+	assert.Equal(t, c, pending[1].ID)
+}
@@ -0,0 +1,275 @@
+// Package metrics collects counters and gauges and writes them in the OpenMetrics text format.
+//
+// Metrics are either updated as they happen, see Counter and Gauge, or read from their source
+// when they are written, see Registry.Collect.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType is the content type of the OpenMetrics text format
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Type is the OpenMetrics type of a metric family
+type Type string
+
+const (
+	TypeCounter Type = "counter"
+	TypeGauge   Type = "gauge"
+)
+
+var rxName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// EmitFunc reports the value of a single series, labelValues match the labels of the family
+type EmitFunc func(value float64, labelValues ...string)
+
+type family struct {
+	name   string
+	help   string
+	typ    Type
+	labels []string
+
+	mtx    sync.Mutex
+	series map[string]*value
+	// collect reads the series when the family is written, nil for Counter and Gauge
+	collect func(emit EmitFunc)
+}
+
+// value is a float64 that is updated atomically
+type value struct {
+	labelValues []string
+	bits        atomic.Uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) load() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+func (f *family) with(labelValues []string) *value {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	v, ok := f.series[key]
+	if !ok {
+		v = &value{labelValues: slices.Clone(labelValues)}
+		f.series[key] = v
+	}
+	return v
+}
+
+// Registry is safe for concurrent use
+type Registry struct {
+	mtx      sync.Mutex
+	families []*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register panics on invalid or duplicate names, these are programming errors
+func (r *Registry) register(f *family) {
+	if !rxName.MatchString(f.name) {
+		panic(fmt.Sprintf("metrics: invalid metric name %q", f.name))
+	}
+	for _, l := range f.labels {
+		if !rxName.MatchString(l) || strings.Contains(l, ":") {
+			panic(fmt.Sprintf("metrics: invalid label name %q of %s", l, f.name))
+		}
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	for _, other := range r.families {
+		if other.name == f.name {
+			panic(fmt.Sprintf("metrics: %s registered twice", f.name))
+		}
+	}
+	f.series = make(map[string]*value)
+	r.families = append(r.families, f)
+}
+
+// CounterVec is a counter family, With returns the counter of a label combination
+type CounterVec struct{ f *family }
+
+// Counter only increases
+type Counter struct{ v *value }
+
+// NewCounter registers a counter family. name must not end with "_total", it is appended to the series.
+func (r *Registry) NewCounter(name, help string, labels ...string) *CounterVec {
+	if strings.HasSuffix(name, "_total") {
+		panic(fmt.Sprintf("metrics: counter %s must not end with _total", name))
+	}
+	f := &family{name: name, help: help, typ: TypeCounter, labels: labels}
+	r.register(f)
+	return &CounterVec{f: f}
+}
+
+func (c *CounterVec) With(labelValues ...string) *Counter {
+	return &Counter{v: c.f.with(labelValues)}
+}
+
+func (c *Counter) Inc() {
+	c.v.add(1)
+}
+
+// Add ignores negative deltas
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.v.add(delta)
+	}
+}
+
+// GaugeVec is a gauge family, With returns the gauge of a label combination
+type GaugeVec struct{ f *family }
+
+// Gauge can go up and down
+type Gauge struct{ v *value }
+
+// NewGauge registers a gauge family
+func (r *Registry) NewGauge(name, help string, labels ...string) *GaugeVec {
+	f := &family{name: name, help: help, typ: TypeGauge, labels: labels}
+	r.register(f)
+	return &GaugeVec{f: f}
+}
+
+func (g *GaugeVec) With(labelValues ...string) *Gauge {
+	return &Gauge{v: g.f.with(labelValues)}
+}
+
+func (g *Gauge) Set(v float64) {
+	g.v.bits.Store(math.Float64bits(v))
+}
+
+func (g *Gauge) Add(delta float64) {
+	g.v.add(delta)
+}
+
+// Collect registers a family whose series are reported by collect every time the registry is written.
+// collect is called concurrently if the registry is written concurrently.
+func (r *Registry) Collect(name, help string, typ Type, labels []string, collect func(emit EmitFunc)) {
+	r.register(&family{name: name, help: help, typ: typ, labels: labels, collect: collect})
+}
+
+// WriteTo writes all families in the OpenMetrics text format, terminated by "# EOF"
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mtx.Lock()
+	families := slices.Clone(r.families)
+	r.mtx.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		writeFamily(bw, f)
+	}
+	bw.WriteString("# EOF\n")
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler serves the registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteTo(w)
+	})
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func writeFamily(w *bufio.Writer, f *family) {
+	var samples []sample
+	if f.collect != nil {
+		f.collect(func(value float64, labelValues ...string) {
+			if len(labelValues) != len(f.labels) {
+				return
+			}
+			samples = append(samples, sample{labelValues: labelValues, value: value})
+		})
+	} else {
+		f.mtx.Lock()
+		for _, v := range f.series {
+			samples = append(samples, sample{labelValues: v.labelValues, value: v.load()})
+		}
+		f.mtx.Unlock()
+	}
+	slices.SortFunc(samples, func(x, y sample) int { return slices.Compare(x.labelValues, y.labelValues) })
+
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	if f.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, helpEscaper.Replace(f.help))
+	}
+	name := f.name
+	if f.typ == TypeCounter {
+		name += "_total"
+	}
+	for _, s := range samples {
+		w.WriteString(name)
+		if len(f.labels) > 0 {
+			w.WriteByte('{')
+			for i, l := range f.labels {
+				if i > 0 {
+					w.WriteByte(',')
+				}
+				fmt.Fprintf(w, `%s="%s"`, l, labelEscaper.Replace(s.labelValues[i]))
+			}
+			w.WriteByte('}')
+		}
+		w.WriteByte(' ')
+		w.WriteString(formatFloat(s.value))
+		w.WriteByte('\n')
+	}
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func write(t *testing.T, r *Registry) string {
+	t.Helper()
+	var sb strings.Builder
+	n, err := r.WriteTo(&sb)
+	require.NoError(t, err)
+	assert.Equal(t, int64(sb.Len()), n)
+	return sb.String()
+}
+
+func TestWriteCountersAndGauges(t *testing.T) {
+	r := NewRegistry()
+	events := r.NewCounter("events", "Events received.", "source", "type")
+	queue := r.NewGauge("queue_length", "")
+
+	events.With("irc", "chat").Inc()
+	events.With("irc", "chat").Add(2)
+	events.With("eventsub", "bits").Inc()
+	events.With("eventsub", "bits").Add(-5)
+	queue.With().Set(4)
+	queue.With().Add(-1.5)
+
+	assert.Equal(t, `# TYPE events counter
+# HELP events Events received.
+events_total{source="eventsub",type="bits"} 1
+events_total{source="irc",type="chat"} 3
+# TYPE queue_length gauge
+queue_length 2.5
+# EOF
+`, write(t, r))
+}
+
+func TestCollectIsCalledOnWrite(t *testing.T) {
+	r := NewRegistry()
+	calls := 0
+	r.Collect("dropped", "Dropped events\nper client.", TypeCounter, []string{"client"}, func(emit EmitFunc) {
+		calls++
+		emit(float64(calls), `pipe "1"\`)
+		emit(math.Inf(1), "b")
+		emit(1, "wrong", "label count")
+	})
+
+	write(t, r)
+	assert.Equal(t, `# TYPE dropped counter
+# HELP dropped Dropped events\nper client.
+dropped_total{client="b"} +Inf
+dropped_total{client="pipe \"1\"\\"} 2
+# EOF
+`, write(t, r))
+}
+
+func TestRegisterRejectsInvalidNames(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("valid", "")
+	assert.Panics(t, func() { r.NewGauge("valid", "") })
+	assert.Panics(t, func() { r.NewGauge("1invalid", "") })
+	assert.Panics(t, func() { r.NewGauge("label", "", "in:valid") })
+	assert.Panics(t, func() { r.NewCounter("requests_total", "") })
+	assert.Panics(t, func() { r.NewCounter("requests", "", "a").With() })
+}
+
+func TestHandlerSetsContentType(t *testing.T) {
+	r := NewRegistry()
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, "# EOF\n", rec.Body.String())
+}
@@ -0,0 +1,150 @@
+package pipeproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// WriteFrame writes data with its Version1 length prefix in a single write,
+// so message mode pipes deliver it as one message.
+func WriteFrame(w io.Writer, data []byte) error {
+	return writeFrame(w, Version1, MaxFrameSize, data)
+}
+
+// ReadFrame reads a single Version1 frame into buf and returns its content.
+// buf should be MaxFrameSize bytes long to fit any frame.
+func ReadFrame(r io.Reader, buf []byte) ([]byte, error) {
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint16(buf[:2]))
+	if size > len(buf) {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrFrameTooLarge, size)
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return nil, fmt.Errorf("could not read message. %w", err)
+	}
+	return buf[:size], nil
+}
+
+func headerSize(version int) int {
+	if version >= Version2 {
+		return 4
+	}
+	return 2
+}
+
+func writeFrame(w io.Writer, version, limit int, data []byte) error {
+	if len(data) > limit {
+		return fmt.Errorf("%w (%d bytes, limit %d)", ErrFrameTooLarge, len(data), limit)
+	}
+	n := headerSize(version)
+	frame := make([]byte, n+len(data))
+	if n == 4 {
+		binary.LittleEndian.PutUint32(frame, uint32(len(data)))
+	} else {
+		binary.LittleEndian.PutUint16(frame, uint16(len(data)))
+	}
+	copy(frame[n:], data)
+	for written := 0; written < len(frame); {
+		n, err := w.Write(frame[written:])
+		if err != nil {
+			return err
+		}
+		written += n
+	}
+	return nil
+}
+
+// FrameWriter writes frames using the framing of the negotiated version.
+// It is safe for concurrent use.
+type FrameWriter struct {
+	mtx     sync.Mutex
+	w       io.Writer
+	version int
+	limit   int
+}
+
+// NewFrameWriter returns a writer using Version1 framing
+func NewFrameWriter(w io.Writer) *FrameWriter {
+	return &FrameWriter{w: w, version: Version1, limit: MaxFrameSize}
+}
+
+// Write writes data as a single frame. Frames larger than the peer accepts
+// fail with ErrFrameTooLarge without writing anything.
+func (fw *FrameWriter) Write(data []byte) error {
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+	return writeFrame(fw.w, fw.version, fw.limit, data)
+}
+
+// WriteAndUpgrade writes data with the current framing and switches to version afterwards,
+// no other frame is written in between. peerMaxSize is the largest frame the peer accepts.
+func (fw *FrameWriter) WriteAndUpgrade(data []byte, version, peerMaxSize int) error {
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+	if err := writeFrame(fw.w, fw.version, fw.limit, data); err != nil {
+		return err
+	}
+	fw.version, fw.limit = version, FrameLimit(version, peerMaxSize)
+	return nil
+}
+
+// Upgrade switches to the framing of version
+func (fw *FrameWriter) Upgrade(version, peerMaxSize int) {
+	fw.mtx.Lock()
+	defer fw.mtx.Unlock()
+	fw.version, fw.limit = version, FrameLimit(version, peerMaxSize)
+}
+
+// FrameReader reads frames using the framing of the negotiated version.
+// It must only be used by one goroutine.
+type FrameReader struct {
+	r       io.Reader
+	version int
+	limit   int
+	buf     []byte
+}
+
+// NewFrameReader returns a reader using Version1 framing
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: r, version: Version1, limit: MaxFrameSize}
+}
+
+// Upgrade switches to the framing of version, accepting frames of up to maxSize bytes
+func (fr *FrameReader) Upgrade(version, maxSize int) {
+	fr.version, fr.limit = version, FrameLimit(version, maxSize)
+}
+
+// Read returns the next frame, it is only valid until the next call.
+// Frames above the limit are skipped and reported with ErrFrameTooLarge,
+// the reader stays usable afterwards.
+func (fr *FrameReader) Read() ([]byte, error) {
+	var header [4]byte
+	n := headerSize(fr.version)
+	if _, err := io.ReadFull(fr.r, header[:n]); err != nil {
+		return nil, err
+	}
+	var size int
+	if n == 4 {
+		size = int(binary.LittleEndian.Uint32(header[:]))
+	} else {
+		size = int(binary.LittleEndian.Uint16(header[:]))
+	}
+	if size > fr.limit {
+		if _, err := io.CopyN(io.Discard, fr.r, int64(size)); err != nil {
+			return nil, fmt.Errorf("could not skip message. %w", err)
+		}
+		return nil, fmt.Errorf("%w (%d bytes, limit %d)", ErrFrameTooLarge, size, fr.limit)
+	}
+	if cap(fr.buf) < size {
+		fr.buf = make([]byte, size)
+	}
+	data := fr.buf[:size]
+	if _, err := io.ReadFull(fr.r, data); err != nil {
+		return nil, fmt.Errorf("could not read message. %w", err)
+	}
+	return data, nil
+}
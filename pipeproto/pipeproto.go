@@ -0,0 +1,213 @@
+// Package pipeproto is the protocol spoken between the connector and the game integration.
+//
+// Every message is a JSON Envelope prefixed with its length as little endian integer,
+// uint16 in Version1 and uint32 in Version2.
+// The connector sends events, the integration sends requests. Requests with an ID
+// are answered with a response carrying the same ID, requests without one are fire-and-forget.
+//
+// Connections start with Version1 framing. Clients that support newer versions send a Hello
+// and wait for the connector's Hello before sending anything else. Both sides switch to the
+// negotiated version right after the connector's Hello. Version1 clients never send a Hello.
+package pipeproto
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protocol versions
+const (
+	Version1 = 1
+	Version2 = 2
+	// CurrentVersion is the newest version spoken by this package
+	CurrentVersion = Version2
+)
+
+const (
+	// MaxFrameSize is the largest message that fits the Version1 length prefix
+	MaxFrameSize = math.MaxUint16
+	// DefaultMaxFrameSize is the largest message accepted in Version2, unless configured otherwise
+	DefaultMaxFrameSize = 1 << 20
+)
+
+var ErrFrameTooLarge = errors.New("message too large")
+
+// TypeHello starts the handshake, see Hello
+const TypeHello = "hello"
+
+// Types of messages sent by the connector
+const (
+	TypePing       = "ping"
+	TypeChat       = "chat"
+	TypeRedemption = "redemption"
+	TypeBits       = "bits"
+	TypePerk       = "streamelements-perk"
+	TypeResponse   = "response"
+)
+
+// Types of requests sent by the integration
+const (
+	// TypeChatSend posts a chat message, see ChatSend
+	TypeChatSend = "chat_send"
+	// TypeRedemptionUpdate fulfills or cancels a channel points redemption, see RedemptionUpdate
+	TypeRedemptionUpdate = "redemption_update"
+	// TypeGameState reports arbitrary JSON describing the state of the game
+	TypeGameState = "game_state"
+	// TypeAck confirms that events were handled, see Ack
+	TypeAck = "ack"
+	// TypeStats queries the connector's Stats
+	TypeStats = "stats"
+)
+
+// Envelope wraps every message
+type Envelope struct {
+	Type string `json:"type"`
+	// ID is set by requests that expect a response, the response carries the same ID
+	ID    uint64          `json:"id,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error *Error          `json:"error,omitempty"`
+}
+
+// ErrorCode classifies failed requests
+type ErrorCode string
+
+const (
+	// CodeBadRequest means the request data could not be read
+	CodeBadRequest ErrorCode = "bad_request"
+	// CodeUnknownType means the connector does not know the request type
+	CodeUnknownType ErrorCode = "unknown_type"
+	// CodeUnavailable means the provider for the request is not running, e.g. chat is disabled
+	CodeUnavailable ErrorCode = "unavailable"
+	// CodeFailed means the provider could not complete the request
+	CodeFailed ErrorCode = "failed"
+	// CodeUnsupportedVersion rejects a Hello without a common protocol version
+	CodeUnsupportedVersion ErrorCode = "unsupported_version"
+)
+
+// Error is the reason a request failed
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func Errorf(code ErrorCode, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ChatSend asks the connector to post Message to Channel
+type ChatSend struct {
+	Channel string `json:"channel"`
+	Message string `json:"message"`
+}
+
+// Redemption statuses for RedemptionUpdate
+const (
+	StatusFulfilled = "FULFILLED"
+	// StatusCanceled refunds the channel points
+	StatusCanceled = "CANCELED"
+)
+
+// RedemptionUpdate sets the status of a redemption. Twitch only allows this for rewards
+// created by the same client as the connector's token.
+type RedemptionUpdate struct {
+	RewardID     string `json:"reward_id"`
+	RedemptionID string `json:"redemption_id"`
+	Status       string `json:"status"`
+}
+
+// Ack confirms events by their ID
+type Ack struct {
+	EventIDs []uint64 `json:"event_ids"`
+}
+
+// Stats describe the connector
+type Stats struct {
+	UptimeSec       int64 `json:"uptime_sec"`
+	Clients         int64 `json:"clients"`
+	EventsPublished int64 `json:"events_published"`
+	EventsAcked     int64 `json:"events_acked"`
+	ChatConnected   bool  `json:"chat_connected"`
+	ChatLatencyMs   int64 `json:"chat_latency_ms"`
+	ChatQueued      int   `json:"chat_queued"`
+	ChatDropped     int64 `json:"chat_dropped"`
+	// EventsRejected were dropped because the connector did not keep up
+	EventsRejected int64 `json:"events_rejected,omitempty"`
+	// Queues are the event queues of the connected clients
+	Queues []QueueStats `json:"queues,omitempty"`
+}
+
+// QueueStats describe the event queue of a connected client
+type QueueStats struct {
+	Client    string `json:"client"`
+	Delivered int64  `json:"delivered"`
+	Dropped   int64  `json:"dropped"`
+	Queued    int    `json:"queued"`
+}
+
+// Marshal creates an envelope of type typ containing data
+func Marshal(typ string, id uint64, data any) ([]byte, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{Type: typ, ID: id, Data: raw})
+}
+
+// MarshalResponse creates the response to request id. Errors that are not an *Error are reported as CodeFailed.
+func MarshalResponse(id uint64, data any, err error) ([]byte, error) {
+	if err != nil {
+		return MarshalError(TypeResponse, id, err)
+	}
+	return Marshal(TypeResponse, id, data)
+}
+
+// MarshalError creates an envelope of type typ carrying err. Errors that are not an *Error are reported as CodeFailed.
+func MarshalError(typ string, id uint64, err error) ([]byte, error) {
+	var pErr *Error
+	if !errors.As(err, &pErr) {
+		pErr = &Error{Code: CodeFailed, Message: err.Error()}
+	}
+	return json.Marshal(Envelope{Type: typ, ID: id, Error: pErr})
+}
+
+// Hello is exchanged when a connection starts. The client sends its supported versions,
+// the connector answers with the negotiated Version or an Error with CodeUnsupportedVersion.
+type Hello struct {
+	// Version is the newest supported version, in the connector's answer the negotiated one
+	Version    int `json:"version"`
+	MinVersion int `json:"min_version,omitempty"`
+	// Client names the sender, e.g. for logging
+	Client string `json:"client"`
+	// Events are the event types the sender handles or sends. Clients only receive
+	// events they listed, an empty list receives all events.
+	Events []string `json:"events,omitempty"`
+	// MaxFrameSize is the largest message the sender accepts
+	MaxFrameSize int `json:"max_frame_size"`
+}
+
+// Negotiate returns the newest version supported by both sides
+func Negotiate(local, remote Hello) (int, error) {
+	version := min(local.Version, remote.Version)
+	lowest := max(local.MinVersion, remote.MinVersion, Version1)
+	if version < lowest {
+		return 0, Errorf(CodeUnsupportedVersion, "%s supports versions %d to %d, %s supports %d to %d",
+			local.Client, max(local.MinVersion, Version1), local.Version,
+			remote.Client, max(remote.MinVersion, Version1), remote.Version)
+	}
+	return version, nil
+}
+
+// FrameLimit is the largest message that can be sent to a peer accepting maxSize bytes using version
+func FrameLimit(version, maxSize int) int {
+	if version < Version2 || maxSize <= 0 {
+		return MaxFrameSize
+	}
+	// keeps the limit representable on 32-bit platforms
+	return min(maxSize, math.MaxInt32)
+}
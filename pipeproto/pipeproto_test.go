@@ -0,0 +1,120 @@
+package pipeproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, WriteFrame(&buf, []byte(`{"type":"ping"}`)))
+	require.NoError(t, WriteFrame(&buf, nil))
+
+	assert.Equal(t, []byte{15, 0}, buf.Bytes()[:2])
+
+	rb := make([]byte, MaxFrameSize)
+	data, err := ReadFrame(&buf, rb)
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"ping"}`, string(data))
+
+	data, err = ReadFrame(&buf, rb)
+	require.NoError(t, err)
+	assert.Empty(t, data)
+
+	_, err = ReadFrame(&buf, rb)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFrameLimits(t *testing.T) {
+	assert.ErrorIs(t, WriteFrame(io.Discard, make([]byte, MaxFrameSize+1)), ErrFrameTooLarge)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteFrame(&buf, make([]byte, 100)))
+	_, err := ReadFrame(&buf, make([]byte, 10))
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+}
+
+func TestMarshalResponse(t *testing.T) {
+	data, err := MarshalResponse(7, Stats{Clients: 1}, nil)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"type":"response","id":7,"data":{"uptime_sec":0,"clients":1,"events_published":0,"events_acked":0,"chat_connected":false,"chat_latency_ms":0,"chat_queued":0,"chat_dropped":0}}`, string(data))
+
+	data, err = MarshalResponse(8, nil, Errorf(CodeUnavailable, "chat is disabled"))
+	require.NoError(t, err)
+	var env Envelope
+	require.NoError(t, json.Unmarshal(data, &env))
+	assert.Equal(t, uint64(8), env.ID)
+	assert.Equal(t, &Error{Code: CodeUnavailable, Message: "chat is disabled"}, env.Error)
+
+	data, err = MarshalResponse(9, nil, errors.New("boom"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &env))
+	assert.Equal(t, CodeFailed, env.Error.Code)
+}
+
+func TestFrameUpgrade(t *testing.T) {
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf)
+	require.NoError(t, fw.Write([]byte(`{"type":"ping"}`)))
+	require.NoError(t, fw.WriteAndUpgrade([]byte(`{"type":"hello"}`), Version2, 1<<17))
+	large := bytes.Repeat([]byte("a"), MaxFrameSize+1)
+	require.NoError(t, fw.Write(large))
+	assert.ErrorIs(t, fw.Write(make([]byte, 1<<17+1)), ErrFrameTooLarge)
+
+	fr := NewFrameReader(&buf)
+	data, err := fr.Read()
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"ping"}`, string(data))
+	data, err = fr.Read()
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"hello"}`, string(data))
+
+	fr.Upgrade(Version2, DefaultMaxFrameSize)
+	data, err = fr.Read()
+	require.NoError(t, err)
+	assert.Equal(t, large, data)
+
+	_, err = fr.Read()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFrameReaderSkipsLargeFrames(t *testing.T) {
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf)
+	fw.Upgrade(Version2, DefaultMaxFrameSize)
+	require.NoError(t, fw.Write(make([]byte, 100)))
+	require.NoError(t, fw.Write([]byte("next")))
+
+	fr := NewFrameReader(&buf)
+	fr.Upgrade(Version2, 10)
+	_, err := fr.Read()
+	assert.ErrorIs(t, err, ErrFrameTooLarge)
+
+	data, err := fr.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "next", string(data))
+}
+
+func TestNegotiate(t *testing.T) {
+	connector := Hello{Version: Version2, Client: "connector"}
+
+	v, err := Negotiate(connector, Hello{Version: Version2, MinVersion: Version1, Client: "dll"})
+	require.NoError(t, err)
+	assert.Equal(t, Version2, v)
+
+	v, err = Negotiate(connector, Hello{Version: Version1, Client: "old"})
+	require.NoError(t, err)
+	assert.Equal(t, Version1, v)
+
+	_, err = Negotiate(connector, Hello{Version: 4, MinVersion: 3, Client: "future"})
+	var pErr *Error
+	require.ErrorAs(t, err, &pErr)
+	assert.Equal(t, CodeUnsupportedVersion, pErr.Code)
+	assert.Equal(t, "connector supports versions 1 to 2, future supports 3 to 4", pErr.Message)
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+
+package transport
+
+import (
+	"context"
+	"net"
+)
+
+func listenPipe(address string) (net.Listener, error) {
+	return nil, ErrUnsupported
+}
+
+func dialPipe(ctx context.Context, address string) (net.Conn, error) {
+	return nil, ErrUnsupported
+}
+
+func isClosedPlatform(err error) bool {
+	return false
+}
@@ -0,0 +1,32 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/Microsoft/go-winio"
+)
+
+const (
+	sidEveryone          = `D:(A;;GWGR;;;WD)`
+	sidAllUsers          = `D:(A;;GWGR;;;AU)`
+	sidAllUsersNoNetwork = `D:(A;;GWGR;;;AU)(D;;GA;;;NS)`
+	sidInteractiveUser   = `D:(A;;GWGR;;;IU)`
+)
+
+// pipeSecurityDescriptor allows the interactive user to read and write
+const pipeSecurityDescriptor = sidInteractiveUser
+
+func listenPipe(address string) (net.Listener, error) {
+	return winio.ListenPipe(address, &winio.PipeConfig{MessageMode: true, SecurityDescriptor: pipeSecurityDescriptor})
+}
+
+func dialPipe(ctx context.Context, address string) (net.Conn, error) {
+	return winio.DialPipeAccess(ctx, address, syscall.GENERIC_READ|syscall.GENERIC_WRITE)
+}
+
+func isClosedPlatform(err error) bool {
+	return errors.Is(err, winio.ErrFileClosed)
+}
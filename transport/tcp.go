@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// authMagic starts the secret sent by TCP clients, followed by the secret and a newline
+const authMagic = "TWITCH-INTEGRATION-AUTH "
+
+// authOK is the connector's answer to a valid secret
+const authOK = "OK\n"
+
+// AuthError is returned by Accept of TCP listeners for clients that failed to authenticate.
+// The listener remains usable.
+type AuthError struct {
+	Remote net.Addr
+	Err    error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("client %s failed to authenticate: %v", e.Remote, e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+var errWrongSecret = errors.New("wrong secret")
+
+// tcpListener authenticates every client in its own go-routine,
+// so a client that does not send the secret does not delay the others
+type tcpListener struct {
+	net.Listener
+	secret string
+
+	accepted chan accepted
+	// stopped is closed once the underlying listener failed or was closed, err is the reason
+	stopped chan struct{}
+	err     error
+}
+
+// accepted is an authenticated connection or an *AuthError
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+func listenTCP(address, secret string) (net.Listener, error) {
+	if secret == "" {
+		return nil, errors.New("tcp transport requires a secret")
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("tcp transport must listen on a loopback address, got %q", host)
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	tl := &tcpListener{
+		Listener: l,
+		secret:   secret,
+		accepted: make(chan accepted),
+		stopped:  make(chan struct{}),
+	}
+	go tl.acceptLoop()
+	return tl, nil
+}
+
+func (l *tcpListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.stopped)
+			return
+		}
+		go func() {
+			result := accepted{conn: conn}
+			if err := l.authenticate(conn); err != nil {
+				conn.Close()
+				result = accepted{err: &AuthError{Remote: conn.RemoteAddr(), Err: err}}
+			}
+			select {
+			case l.accepted <- result:
+			case <-l.stopped:
+				if result.conn != nil {
+					result.conn.Close()
+				}
+			}
+		}()
+	}
+}
+
+// Accept returns an *AuthError for clients that did not send the secret in time
+func (l *tcpListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.stopped:
+		return nil, l.err
+	}
+}
+
+func (l *tcpListener) authenticate(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(authTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	// reading byte by byte keeps everything after the secret in the connection
+	line, err := readLine(conn, len(authMagic)+len(l.secret)+1)
+	if err != nil {
+		return err
+	}
+	secret, ok := strings.CutPrefix(line, authMagic)
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(l.secret)) != 1 {
+		return errWrongSecret
+	}
+	_, err = io.WriteString(conn, authOK)
+	return err
+}
+
+// readLine reads up to max bytes until a newline, without reading past it
+func readLine(r io.Reader, max int) (string, error) {
+	var sb strings.Builder
+	b := make([]byte, 1)
+	for sb.Len() <= max {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return sb.String(), nil
+		}
+		sb.WriteByte(b[0])
+	}
+	return "", errWrongSecret
+}
+
+func dialTCP(ctx context.Context, address, secret string) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(authTimeout))
+	}
+	if _, err := io.WriteString(conn, authMagic+secret+"\n"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	answer := make([]byte, len(authOK))
+	if _, err := io.ReadFull(conn, answer); err != nil || string(answer) != authOK {
+		conn.Close()
+		return nil, errors.New("connector rejected the secret")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
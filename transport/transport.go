@@ -0,0 +1,125 @@
+// Package transport connects the connector and the game integration.
+//
+// The connector listens and the integration dials using one of three kinds of transport:
+// Windows named pipes, Unix domain sockets or TCP on the loopback interface.
+// TCP connections start with the shared secret of both sides, the connector drops clients sending a different one.
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Kinds of transport
+const (
+	KindPipe = "pipe"
+	KindUnix = "unix"
+	KindTCP  = "tcp"
+)
+
+const (
+	DefaultPipeAddress = `\\.\pipe\__TwitchIntegration_Kirides_Conn`
+	DefaultTCPAddress  = "127.0.0.1:47110"
+)
+
+// authTimeout limits how long a TCP client may take to send the secret
+const authTimeout = 5 * time.Second
+
+var ErrUnsupported = errors.New("transport is not supported on this platform")
+
+// Config selects the transport, both sides must use the same one
+type Config struct {
+	// Kind is one of "pipe", "unix" or "tcp"
+	Kind string `json:"kind"`
+	// Address is the pipe name, the socket path or host:port of the transport
+	Address string `json:"address"`
+	// Secret is required for "tcp"
+	Secret string `json:"secret,omitempty"`
+}
+
+// Default is a named pipe on Windows and a Unix domain socket in the temp directory on other platforms
+func Default() Config {
+	if runtime.GOOS == "windows" {
+		return Config{Kind: KindPipe, Address: DefaultPipeAddress}
+	}
+	return Config{Kind: KindUnix, Address: filepath.Join(os.TempDir(), "twitch-integration.sock")}
+}
+
+func (c Config) withDefaults() Config {
+	if c.Kind == "" {
+		c.Kind = Default().Kind
+	}
+	if c.Address == "" {
+		switch c.Kind {
+		case KindPipe:
+			c.Address = DefaultPipeAddress
+		case KindUnix:
+			c.Address = Default().Address
+		case KindTCP:
+			c.Address = DefaultTCPAddress
+		}
+	}
+	return c
+}
+
+func (c Config) String() string {
+	c = c.withDefaults()
+	return c.Kind + ":" + c.Address
+}
+
+// Listen creates the listener the connector accepts clients on
+func Listen(c Config) (net.Listener, error) {
+	c = c.withDefaults()
+	switch c.Kind {
+	case KindPipe:
+		return listenPipe(c.Address)
+	case KindUnix:
+		return listenUnix(c.Address)
+	case KindTCP:
+		return listenTCP(c.Address, c.Secret)
+	}
+	return nil, fmt.Errorf("unknown transport %q", c.Kind)
+}
+
+// Dial connects to the connector
+func Dial(ctx context.Context, c Config) (net.Conn, error) {
+	c = c.withDefaults()
+	switch c.Kind {
+	case KindPipe:
+		return dialPipe(ctx, c.Address)
+	case KindUnix:
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", c.Address)
+	case KindTCP:
+		return dialTCP(ctx, c.Address, c.Secret)
+	}
+	return nil, fmt.Errorf("unknown transport %q", c.Kind)
+}
+
+// IsClosed reports whether err was caused by a closed connection or listener
+func IsClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isClosedPlatform(err)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	// a socket left behind by a crashed connector prevents listening
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
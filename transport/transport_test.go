@@ -0,0 +1,139 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// echo accepts a single client and echoes everything it sends
+func echo(t *testing.T, l net.Listener) <-chan error {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+		defer conn.Close()
+		_, err = io.Copy(conn, conn)
+		errs <- err
+	}()
+	return errs
+}
+
+func roundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_, err := conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestUnixTransport(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix domain sockets are not available on all windows versions")
+	}
+	cnf := Config{Kind: KindUnix, Address: filepath.Join(t.TempDir(), "test.sock")}
+	l, err := Listen(cnf)
+	require.NoError(t, err)
+	defer l.Close()
+	echo(t, l)
+
+	conn, err := Dial(context.Background(), cnf)
+	require.NoError(t, err)
+	defer conn.Close()
+	roundTrip(t, conn)
+}
+
+func TestTCPTransport(t *testing.T) {
+	l, err := Listen(Config{Kind: KindTCP, Address: "127.0.0.1:0", Secret: "s3cret"})
+	require.NoError(t, err)
+	defer l.Close()
+	cnf := Config{Kind: KindTCP, Address: l.Addr().String(), Secret: "s3cret"}
+
+	accepted := echo(t, l)
+	conn, err := Dial(context.Background(), cnf)
+	require.NoError(t, err)
+	defer conn.Close()
+	roundTrip(t, conn)
+	conn.Close()
+	assert.NoError(t, <-accepted)
+}
+
+func TestTCPTransportRejectsWrongSecret(t *testing.T) {
+	l, err := Listen(Config{Kind: KindTCP, Address: "127.0.0.1:0", Secret: "s3cret"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	accepted := echo(t, l)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = Dial(ctx, Config{Kind: KindTCP, Address: l.Addr().String(), Secret: "guess"})
+	require.Error(t, err)
+
+	var authErr *AuthError
+	require.ErrorAs(t, <-accepted, &authErr)
+	assert.ErrorIs(t, authErr, errWrongSecret)
+
+	// the listener keeps accepting clients
+	accepted = echo(t, l)
+	conn, err := Dial(context.Background(), Config{Kind: KindTCP, Address: l.Addr().String(), Secret: "s3cret"})
+	require.NoError(t, err)
+	defer conn.Close()
+	roundTrip(t, conn)
+}
+
+func TestTCPTransportAuthenticatesConcurrently(t *testing.T) {
+	l, err := Listen(Config{Kind: KindTCP, Address: "127.0.0.1:0", Secret: "s3cret"})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// a client that never sends the secret must not block others until authTimeout
+	idle, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+
+	accepted := echo(t, l)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := Dial(ctx, Config{Kind: KindTCP, Address: l.Addr().String(), Secret: "s3cret"})
+	require.NoError(t, err)
+	defer conn.Close()
+	roundTrip(t, conn)
+	conn.Close()
+	assert.NoError(t, <-accepted)
+}
+
+func TestTCPTransportAcceptAfterClose(t *testing.T) {
+	l, err := Listen(Config{Kind: KindTCP, Address: "127.0.0.1:0", Secret: "s3cret"})
+	require.NoError(t, err)
+
+	accepted := echo(t, l)
+	require.NoError(t, l.Close())
+	assert.True(t, IsClosed(<-accepted))
+}
+
+func TestTCPTransportRequiresLoopbackAndSecret(t *testing.T) {
+	_, err := Listen(Config{Kind: KindTCP, Address: "0.0.0.0:0", Secret: "s3cret"})
+	assert.ErrorContains(t, err, "loopback")
+
+	_, err = Listen(Config{Kind: KindTCP, Address: "127.0.0.1:0"})
+	assert.ErrorContains(t, err, "secret")
+}
+
+func TestIsClosed(t *testing.T) {
+	assert.True(t, IsClosed(io.EOF))
+	assert.True(t, IsClosed(net.ErrClosed))
+	assert.False(t, IsClosed(io.ErrUnexpectedEOF))
+}
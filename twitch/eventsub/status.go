@@ -0,0 +1,87 @@
+package eventsub
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SubscriptionStatus is a subscription requested on the current session
+type SubscriptionStatus struct {
+	ID      string `json:"id,omitempty"`
+	Type    string `json:"type"`
+	Version string `json:"version"`
+	// Status is reported by twitch, e.g. "enabled" or "authorization_revoked", "failed" if the request failed
+	Status    string    `json:"status"`
+	Cost      int       `json:"cost"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Status is a snapshot of the connection
+type Status struct {
+	Connected     bool      `json:"connected"`
+	SessionID     string    `json:"session_id,omitempty"`
+	LastKeepalive time.Time `json:"last_keepalive,omitzero"`
+	// KeepaliveLatencyMs is the delay between twitch sending the last keepalive and receiving it
+	KeepaliveLatencyMs int64 `json:"keepalive_latency_ms"`
+	// Reconnects counts connections after the first one
+	Reconnects int `json:"reconnects"`
+	// TotalCost and MaxTotalCost are reported by twitch when subscribing
+	TotalCost     int                  `json:"total_cost"`
+	MaxTotalCost  int                  `json:"max_total_cost"`
+	Subscriptions []SubscriptionStatus `json:"subscriptions"`
+}
+
+// connectionState is written by the read loop and read by Status
+type connectionState struct {
+	mtx           sync.Mutex
+	connected     bool
+	sessionID     string
+	lastKeepalive time.Time
+	latency       time.Duration
+	dialed        bool
+	reconnects    int
+	totalCost     int
+	maxTotalCost  int
+	subscriptions map[string]SubscriptionStatus
+}
+
+func (s *connectionState) update(fn func(s *connectionState)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	fn(s)
+}
+
+// setSubscription replaces the subscription of the same type
+func (s *connectionState) setSubscription(sub SubscriptionStatus) {
+	s.update(func(s *connectionState) {
+		if s.subscriptions == nil {
+			s.subscriptions = make(map[string]SubscriptionStatus)
+		}
+		s.subscriptions[sub.Type] = sub
+	})
+}
+
+// Status returns the state of the connection and its subscriptions, ordered by type
+func (c *WebsocketConnection) Status() Status {
+	s := &c.state
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	status := Status{
+		Connected:          s.connected,
+		SessionID:          s.sessionID,
+		LastKeepalive:      s.lastKeepalive,
+		KeepaliveLatencyMs: s.latency.Milliseconds(),
+		Reconnects:         s.reconnects,
+		TotalCost:          s.totalCost,
+		MaxTotalCost:       s.maxTotalCost,
+		Subscriptions:      make([]SubscriptionStatus, 0, len(s.subscriptions)),
+	}
+	for _, sub := range s.subscriptions {
+		status.Subscriptions = append(status.Subscriptions, sub)
+	}
+	slices.SortFunc(status.Subscriptions, func(x, y SubscriptionStatus) int { return strings.Compare(x.Type, y.Type) })
+	return status
+}
@@ -40,6 +40,8 @@ type WebsocketConnection struct {
 	session struct {
 		ID string
 	}
+
+	state connectionState
 }
 
 func (c *WebsocketConnection) Close() error {
@@ -53,6 +55,7 @@ func (c *WebsocketConnection) Close() error {
 		}
 	}
 	c.readCtx, c.cancelReadFn = context.WithCancel(context.Background())
+	c.state.update(func(s *connectionState) { s.connected = false })
 	return nil
 }
 
@@ -157,6 +160,16 @@ func (c *WebsocketConnection) reconnect(ctx context.Context, url string) error {
 	c.logger.LogAttrs(ctx, slog.LevelInfo, "(Re-)Connected", attrs...)
 
 	c.conn = conn
+	// subscriptions belong to the session, they are requested again after the welcome message
+	c.state.update(func(s *connectionState) {
+		if s.dialed {
+			s.reconnects++
+		}
+		s.dialed = true
+		s.connected = true
+		s.sessionID = ""
+		s.subscriptions = nil
+	})
 	return nil
 }
 func (c *WebsocketConnection) doSubscribe(ctx context.Context) error {
@@ -174,6 +187,7 @@ func (c *WebsocketConnection) doSubscribe(ctx context.Context) error {
 				SessionID: c.session.ID,
 			},
 		}); err != nil {
+			c.state.setSubscription(SubscriptionStatus{Type: k, Version: version, Status: "failed", Error: err.Error()})
 			c.logger.ErrorContext(ctx, "failed to subscribe", slog.String("type", k), slog.Any("err", err))
 			// return fmt.Errorf("failed to subscribe to %q. %w", k, err)
 		}
@@ -185,6 +199,7 @@ func (c *WebsocketConnection) run(ctx context.Context) error {
 	for ctx.Err() == nil {
 		t, d, err := c.conn.Read(ctx)
 		if err != nil {
+			c.state.update(func(s *connectionState) { s.connected = false })
 			if errors.Is(err, context.Canceled) {
 				return nil
 			}
@@ -208,6 +223,7 @@ func (c *WebsocketConnection) run(ctx context.Context) error {
 				continue
 			}
 			c.session.ID = evt.Session.ID
+			c.state.update(func(s *connectionState) { s.sessionID = evt.Session.ID })
 			c.logger.Info("Welcome",
 				slog.String("session.id", evt.Session.ID),
 				slog.String("session.status", evt.Session.Status),
@@ -224,6 +240,11 @@ func (c *WebsocketConnection) run(ctx context.Context) error {
 		case "session_keepalive":
 			c.logger.Debug("Keepalive received")
 			c.lastKeepalive = time.Now()
+			c.state.update(func(s *connectionState) {
+				s.lastKeepalive = c.lastKeepalive
+				// clocks may differ slightly
+				s.latency = max(c.lastKeepalive.Sub(msg.Metadata.MessageTimestamp), 0)
+			})
 			c.keepaliveCh <- c.lastKeepalive
 		case "session_reconnect":
 			var evt EventReconnect
@@ -248,6 +269,17 @@ func (c *WebsocketConnection) run(ctx context.Context) error {
 				continue
 			}
 			c.handler.Delegate(evt.Subscription.Type, msg.Payload)
+		case "revocation":
+			var evt RawSubscriptionPayload
+			if err := json.Unmarshal(msg.Payload, &evt); err != nil {
+				c.logger.Warn("could not unmarshal payload", slog.Any("err", err))
+				continue
+			}
+			sub := evt.Subscription
+			c.logger.Warn("Subscription revoked", slog.String("type", sub.Type), slog.String("status", sub.Status))
+			c.state.setSubscription(SubscriptionStatus{
+				ID: sub.ID, Type: sub.Type, Version: sub.Version, Status: sub.Status, Cost: sub.Cost, CreatedAt: sub.CreatedAt,
+			})
 		}
 	}
 	return nil
@@ -286,6 +318,43 @@ func (c *WebsocketConnection) DeleteSubscription(id string) error {
 	return nil
 }
 
+// UpdateRedemptionStatus sets the status of a redemption to FULFILLED or CANCELED.
+// Requires the channel:manage:redemptions scope and only works for rewards created with the same client ID.
+func (c *WebsocketConnection) UpdateRedemptionStatus(ctx context.Context, broadcasterID, rewardID, redemptionID, status string) error {
+	values := url.Values{}
+	values.Set("broadcaster_id", broadcasterID)
+	values.Set("reward_id", rewardID)
+	values.Set("id", redemptionID)
+
+	data, err := json.Marshal(struct {
+		Status string `json:"status"`
+	}{Status: status})
+	if err != nil {
+		return err
+	}
+	req, err := c.NewAuthdRequest(http.MethodPatch, twitch.QueryRedemptionsURL(values), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		responseText := ""
+		if err == nil {
+			responseText = string(data)
+		}
+		return fmt.Errorf("response error: %s (%d): %s", resp.Status, resp.StatusCode, responseText)
+	}
+	return nil
+}
+
 func (c *WebsocketConnection) Subscribe(ctx context.Context, info SubscriptionInfo) error {
 	data, err := json.Marshal(info)
 	if err != nil {
@@ -329,5 +398,13 @@ func (c *WebsocketConnection) Subscribe(ctx context.Context, info SubscriptionIn
 	if len(respData.Data) == 0 || len(respData.Data) > 1 {
 		return fmt.Errorf("too much response data")
 	}
+	sub := respData.Data[0]
+	c.state.setSubscription(SubscriptionStatus{
+		ID: sub.ID, Type: sub.Type, Version: sub.Version, Status: sub.Status, Cost: sub.Cost, CreatedAt: sub.CreatedAt,
+	})
+	c.state.update(func(s *connectionState) {
+		s.totalCost = respData.TotalCost
+		s.maxTotalCost = respData.MaxTotalCost
+	})
 	return nil
 }
@@ -0,0 +1,178 @@
+package irc
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Twitch allows 20 JOIN attempts per 10 seconds for regular accounts
+const (
+	joinRateLimitBurst    = 20
+	joinRateLimitInterval = time.Second * 10
+)
+
+func newJoinLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Every(joinRateLimitInterval/joinRateLimitBurst), joinRateLimitBurst)
+}
+
+// ChannelState is the last known state of a joined channel,
+// built from ROOMSTATE and USERSTATE messages.
+type ChannelState struct {
+	Channel string
+	RoomID  string
+
+	EmoteOnly bool
+	// FollowersOnly is negative if the mode is disabled,
+	// otherwise the time a user has to follow before being able to chat.
+	FollowersOnly time.Duration
+	R9K           bool
+	// Slow is the time a user has to wait between messages, zero if disabled.
+	Slow     time.Duration
+	SubsOnly bool
+
+	// IsMod, IsVIP, IsBroadcaster and Badges describe the connected user in this channel
+	IsMod         bool
+	IsVIP         bool
+	IsBroadcaster bool
+	Badges        map[string]string
+}
+
+// IsOp reports whether the connected user is allowed to send messages at the elevated rate limit.
+func (s ChannelState) IsOp() bool {
+	return s.IsMod || s.IsBroadcaster
+}
+
+func (s *ChannelState) applyRoomState(rs RoomState) {
+	if rs.RoomID != "" {
+		s.RoomID = rs.RoomID
+	}
+	if rs.EmoteOnly != nil {
+		s.EmoteOnly = *rs.EmoteOnly
+	}
+	if rs.FollowersOnly != nil {
+		s.FollowersOnly = *rs.FollowersOnly
+	}
+	if rs.R9K != nil {
+		s.R9K = *rs.R9K
+	}
+	if rs.Slow != nil {
+		s.Slow = *rs.Slow
+	}
+	if rs.SubsOnly != nil {
+		s.SubsOnly = *rs.SubsOnly
+	}
+}
+
+func (s *ChannelState) applyUserState(us UserState) {
+	s.IsMod = us.IsMod
+	s.IsVIP = us.IsVIP
+	s.IsBroadcaster = us.IsBroadcaster
+	s.Badges = us.Badges
+}
+
+// updateChannelState keeps track of ROOMSTATE and USERSTATE for every channel.
+func (c *ChatClient) updateChannelState(msg *Message) {
+	if msg.Command != CommandRoomState && msg.Command != CommandUserState {
+		return
+	}
+	channel := normalizeChannel(msg.Channel)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	state, ok := c.channelStates[channel]
+	if !ok {
+		state = &ChannelState{Channel: channel, FollowersOnly: -1}
+		c.channelStates[channel] = state
+	}
+	switch msg.Command {
+	case CommandRoomState:
+		state.applyRoomState(newRoomState(msg))
+	case CommandUserState:
+		state.applyUserState(newUserState(msg))
+	}
+}
+
+// ChannelState returns the last known state of the channel.
+func (c *ChatClient) ChannelState(channel string) (ChannelState, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	state, ok := c.channelStates[normalizeChannel(channel)]
+	if !ok {
+		return ChannelState{}, false
+	}
+	result := *state
+	result.Badges = maps.Clone(state.Badges)
+	return result, true
+}
+
+// Channels returns all joined channels.
+func (c *ChatClient) Channels() []string {
+	return c.joinedChannels()
+}
+
+func (c *ChatClient) removeChannel(channel string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	delete(c.channels, channel)
+	delete(c.channelStates, channel)
+}
+
+// JoinAllContext joins all channels, respecting twitch's JOIN rate limit.
+// All channels are attempted, the first error is returned.
+func (c *ChatClient) JoinAllContext(ctx context.Context, channels ...string) error {
+	var firstErr error
+	for _, channel := range channels {
+		if err := c.JoinContext(ctx, channel); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to join %q. %w", channel, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// PartContext leaves the channel and waits for twitch to confirm it.
+// The channel will not be joined again after reconnecting.
+func (c *ChatClient) PartContext(ctx context.Context, channel string) error {
+	channel = normalizeChannel(channel)
+	c.removeChannel(channel)
+
+	hand := c.newMessageHandler(HandlerOptions{})
+	c.addHandlerInternal(hand)
+	defer c.removeHandlerInternal(hand)
+
+	if err := c.sendLine(ctx, NewLine(CommandPart, "#"+channel)); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(time.Second * 30)
+	defer timer.Stop()
+
+	expectedPrefix := fmt.Sprintf("%s!%s@%s.tmi.twitch.tv", c.Nick, c.Nick, c.Nick)
+
+	for {
+		select {
+		case msg, ok := <-hand.ch:
+			if !ok {
+				return c.connectionLost()
+			}
+			if msg.Prefix == expectedPrefix &&
+				msg.Command == CommandPart &&
+				slices.Equal(msg.Args, []string{"#" + channel}) {
+				return nil
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("PART cancelled. %w", ctx.Err())
+		case <-timer.C:
+			return fmt.Errorf("waiting for PART response timeout exceeded")
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelStateIsMerged(t *testing.T) {
+	c := &ChatClient{channelStates: make(map[string]*ChannelState)}
+
+	_, ok := c.ChannelState("dallas")
+	assert.False(t, ok)
+
+	c.updateChannelState(mustMessage(t, `@emote-only=0;followers-only=-1;r9k=0;room-id=12345678;slow=0;subs-only=0 :tmi.twitch.tv ROOMSTATE #dallas`))
+	c.updateChannelState(mustMessage(t, `@badge-info=;badges=moderator/1;color=#0D4200;display-name=ronni;emote-sets=0;mod=1;subscriber=0;user-type=mod :tmi.twitch.tv USERSTATE #dallas`))
+	c.updateChannelState(mustMessage(t, `@room-id=12345678;slow=10 :tmi.twitch.tv ROOMSTATE #dallas`))
+	c.updateChannelState(mustMessage(t, `@emote-only=1;room-id=87654321 :tmi.twitch.tv ROOMSTATE #other`))
+
+	state, ok := c.ChannelState("#Dallas")
+	require.True(t, ok)
+	assert.Equal(t, "dallas", state.Channel)
+	assert.Equal(t, "12345678", state.RoomID)
+	assert.Equal(t, 10*time.Second, state.Slow)
+	assert.False(t, state.EmoteOnly)
+	assert.Less(t, state.FollowersOnly, time.Duration(0))
+	assert.True(t, state.IsMod)
+	assert.True(t, state.IsOp())
+
+	other, ok := c.ChannelState("other")
+	require.True(t, ok)
+	assert.True(t, other.EmoteOnly)
+	assert.False(t, other.IsOp())
+	assert.Equal(t, time.Duration(0), other.Slow)
+}
@@ -0,0 +1,383 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CommandPrivMsg    = "PRIVMSG"
+	CommandJoin       = "JOIN"
+	CommandPart       = "PART"
+	CommandNotice     = "NOTICE"
+	CommandUserNotice = "USERNOTICE"
+	CommandClearChat  = "CLEARCHAT"
+	CommandClearMsg   = "CLEARMSG"
+	CommandRoomState  = "ROOMSTATE"
+	CommandUserState  = "USERSTATE"
+	CommandWhisper    = "WHISPER"
+	CommandReconnect  = "RECONNECT"
+)
+
+// msg-id values of USERNOTICE messages
+const (
+	UserNoticeSub            = "sub"
+	UserNoticeResub          = "resub"
+	UserNoticeSubGift        = "subgift"
+	UserNoticeSubMysteryGift = "submysterygift"
+	UserNoticeRaid           = "raid"
+	UserNoticeAnnouncement   = "announcement"
+	UserNoticeBitsBadgeTier  = "bitsbadgetier"
+)
+
+// SubPlan is the tier of a subscription, "Prime", "1000", "2000" or "3000"
+type SubPlan string
+
+const (
+	SubPlanPrime SubPlan = "Prime"
+	SubPlanTier1 SubPlan = "1000"
+	SubPlanTier2 SubPlan = "2000"
+	SubPlanTier3 SubPlan = "3000"
+)
+
+// UserNotice is sent when a user subscribes, gifts subscriptions, raids the channel, ...
+//
+// Depending on MsgID exactly one of the detail fields is set.
+type UserNotice struct {
+	Message     *Message
+	Channel     string
+	MsgID       string
+	Login       string
+	DisplayName string
+	UserID      string
+	// SystemMsg is the message twitch shows in chat for this event
+	SystemMsg string
+	// Text is the optional message the user attached
+	Text string
+
+	// set for sub and resub
+	Sub *SubNotice
+	// set for subgift
+	SubGift *SubGiftNotice
+	// set for submysterygift
+	MysteryGift *MysteryGiftNotice
+	// set for raid
+	Raid *RaidNotice
+	// set for announcement
+	Announcement *AnnouncementNotice
+	// set for bitsbadgetier
+	BitsBadgeTier *BitsBadgeTierNotice
+}
+
+type SubNotice struct {
+	CumulativeMonths  int
+	StreakMonths      int
+	ShouldShareStreak bool
+	Plan              SubPlan
+	PlanName          string
+}
+
+type SubGiftNotice struct {
+	Months               int
+	GiftMonths           int
+	RecipientID          string
+	RecipientLogin       string
+	RecipientDisplayName string
+	Plan                 SubPlan
+	PlanName             string
+}
+
+type MysteryGiftNotice struct {
+	GiftCount   int
+	SenderCount int
+	Plan        SubPlan
+}
+
+type RaidNotice struct {
+	Login       string
+	DisplayName string
+	ViewerCount int
+}
+
+type AnnouncementNotice struct {
+	Color string
+}
+
+type BitsBadgeTierNotice struct {
+	Threshold int
+}
+
+// ClearChat is sent when all messages of a channel or a single user are removed.
+type ClearChat struct {
+	Message *Message
+	Channel string
+	// TargetUser is empty if the whole chat was cleared
+	TargetUser   string
+	TargetUserID string
+	// BanDuration is zero for permanent bans
+	BanDuration time.Duration
+}
+
+// Permanent reports whether the target user was banned permanently.
+func (c ClearChat) Permanent() bool {
+	return c.TargetUser != "" && c.BanDuration == 0
+}
+
+// ClearMsg is sent when a single message was removed.
+type ClearMsg struct {
+	Message         *Message
+	Channel         string
+	Login           string
+	TargetMessageID string
+	Text            string
+}
+
+// RoomState contains the chat settings of a channel.
+//
+// Twitch only sends the settings that changed, all other fields are nil.
+type RoomState struct {
+	Message   *Message
+	Channel   string
+	RoomID    string
+	EmoteOnly *bool
+	// FollowersOnly is negative if the mode is disabled,
+	// otherwise the time a user has to follow before being able to chat.
+	FollowersOnly *time.Duration
+	R9K           *bool
+	// Slow is the time a user has to wait between messages, zero if disabled.
+	Slow     *time.Duration
+	SubsOnly *bool
+}
+
+// UserState is sent after joining a channel or sending a message.
+// It describes the connected user in that channel.
+type UserState struct {
+	Message       *Message
+	Channel       string
+	DisplayName   string
+	Color         string
+	Badges        map[string]string
+	EmoteSets     []string
+	IsMod         bool
+	IsVIP         bool
+	IsBroadcaster bool
+	IsSubscriber  bool
+}
+
+// Whisper is a private message sent to the connected user.
+type Whisper struct {
+	Message     *Message
+	From        string
+	DisplayName string
+	UserID      string
+	To          string
+	MessageID   string
+	ThreadID    string
+	Text        string
+}
+
+func (m *Message) tagOptBool(key string) *bool {
+	v, ok := m.Tags[key]
+	if !ok {
+		return nil
+	}
+	b := v == "1"
+	return &b
+}
+
+func (m *Message) tagOptDuration(key string, unit time.Duration) *time.Duration {
+	v, ok := m.Tags[key]
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return nil
+	}
+	d := time.Duration(n) * unit
+	return &d
+}
+
+// text returns the trailing argument if the command has more than just the channel argument.
+func (m *Message) text() string {
+	if len(m.Args) < 2 {
+		return ""
+	}
+	return m.Args[len(m.Args)-1]
+}
+
+func newUserNotice(msg *Message) UserNotice {
+	result := UserNotice{
+		Message:     msg,
+		Channel:     msg.Channel,
+		MsgID:       msg.Tags["msg-id"],
+		Login:       msg.Tags["login"],
+		DisplayName: msg.Tags[TagDisplayName],
+		UserID:      msg.UserID(),
+		SystemMsg:   msg.Tags["system-msg"],
+		Text:        msg.text(),
+	}
+	switch result.MsgID {
+	case UserNoticeSub, UserNoticeResub:
+		result.Sub = &SubNotice{
+			CumulativeMonths:  msg.tagInt("msg-param-cumulative-months"),
+			StreakMonths:      msg.tagInt("msg-param-streak-months"),
+			ShouldShareStreak: msg.tagFlag("msg-param-should-share-streak"),
+			Plan:              SubPlan(msg.Tags["msg-param-sub-plan"]),
+			PlanName:          msg.Tags["msg-param-sub-plan-name"],
+		}
+	case UserNoticeSubGift:
+		result.SubGift = &SubGiftNotice{
+			Months:               msg.tagInt("msg-param-months"),
+			GiftMonths:           msg.tagInt("msg-param-gift-months"),
+			RecipientID:          msg.Tags["msg-param-recipient-id"],
+			RecipientLogin:       msg.Tags["msg-param-recipient-user-name"],
+			RecipientDisplayName: msg.Tags["msg-param-recipient-display-name"],
+			Plan:                 SubPlan(msg.Tags["msg-param-sub-plan"]),
+			PlanName:             msg.Tags["msg-param-sub-plan-name"],
+		}
+	case UserNoticeSubMysteryGift:
+		result.MysteryGift = &MysteryGiftNotice{
+			GiftCount:   msg.tagInt("msg-param-mass-gift-count"),
+			SenderCount: msg.tagInt("msg-param-sender-count"),
+			Plan:        SubPlan(msg.Tags["msg-param-sub-plan"]),
+		}
+	case UserNoticeRaid:
+		result.Raid = &RaidNotice{
+			Login:       msg.Tags["msg-param-login"],
+			DisplayName: msg.Tags["msg-param-displayName"],
+			ViewerCount: msg.tagInt("msg-param-viewerCount"),
+		}
+	case UserNoticeAnnouncement:
+		result.Announcement = &AnnouncementNotice{
+			Color: msg.Tags["msg-param-color"],
+		}
+	case UserNoticeBitsBadgeTier:
+		result.BitsBadgeTier = &BitsBadgeTierNotice{
+			Threshold: msg.tagInt("msg-param-threshold"),
+		}
+	}
+	return result
+}
+
+func newClearChat(msg *Message) ClearChat {
+	return ClearChat{
+		Message:      msg,
+		Channel:      msg.Channel,
+		TargetUser:   msg.text(),
+		TargetUserID: msg.Tags["target-user-id"],
+		BanDuration:  time.Duration(msg.tagInt("ban-duration")) * time.Second,
+	}
+}
+
+func newClearMsg(msg *Message) ClearMsg {
+	return ClearMsg{
+		Message:         msg,
+		Channel:         msg.Channel,
+		Login:           msg.Tags["login"],
+		TargetMessageID: msg.Tags["target-msg-id"],
+		Text:            msg.text(),
+	}
+}
+
+func newRoomState(msg *Message) RoomState {
+	return RoomState{
+		Message:       msg,
+		Channel:       msg.Channel,
+		RoomID:        msg.RoomID(),
+		EmoteOnly:     msg.tagOptBool("emote-only"),
+		FollowersOnly: msg.tagOptDuration("followers-only", time.Minute),
+		R9K:           msg.tagOptBool("r9k"),
+		Slow:          msg.tagOptDuration("slow", time.Second),
+		SubsOnly:      msg.tagOptBool("subs-only"),
+	}
+}
+
+func newUserState(msg *Message) UserState {
+	var emoteSets []string
+	if v := msg.Tags["emote-sets"]; v != "" {
+		emoteSets = strings.Split(v, ",")
+	}
+	return UserState{
+		Message:       msg,
+		Channel:       msg.Channel,
+		DisplayName:   msg.Tags[TagDisplayName],
+		Color:         msg.Tags[TagColor],
+		Badges:        msg.Badges(),
+		EmoteSets:     emoteSets,
+		IsMod:         msg.IsMod(),
+		IsVIP:         msg.IsVIP(),
+		IsBroadcaster: msg.IsBroadcaster(),
+		IsSubscriber:  msg.IsSubscriber(),
+	}
+}
+
+func newWhisper(msg *Message) Whisper {
+	to := ""
+	if len(msg.Args) > 0 {
+		to = msg.Args[0]
+	}
+	return Whisper{
+		Message:     msg,
+		From:        msg.Sender,
+		DisplayName: msg.DisplayName(),
+		UserID:      msg.UserID(),
+		To:          to,
+		MessageID:   msg.Tags["message-id"],
+		ThreadID:    msg.Tags["thread-id"],
+		Text:        msg.text(),
+	}
+}
+
+// onCommand calls handler for every received message with the given command.
+func (c *ChatClient) onCommand(command string, handler func(msg *Message)) {
+	hand := c.newMessageHandler(HandlerOptions{}, command)
+	c.addHandler(hand)
+	go func() {
+		defer c.removeHandler(hand)
+		for msg := range hand.ch {
+			handler(msg)
+		}
+	}()
+}
+
+// OnUserNotice is called for subscriptions, gifted subscriptions, raids, announcements, ...
+func (c *ChatClient) OnUserNotice(handler func(UserNotice)) {
+	c.onCommand(CommandUserNotice, func(msg *Message) { handler(newUserNotice(msg)) })
+}
+
+// OnClearChat is called when the chat or all messages of a user are removed.
+func (c *ChatClient) OnClearChat(handler func(ClearChat)) {
+	c.onCommand(CommandClearChat, func(msg *Message) { handler(newClearChat(msg)) })
+}
+
+// OnClearMsg is called when a single message is removed.
+func (c *ChatClient) OnClearMsg(handler func(ClearMsg)) {
+	c.onCommand(CommandClearMsg, func(msg *Message) { handler(newClearMsg(msg)) })
+}
+
+// OnRoomState is called when joining a channel and whenever the chat settings change.
+func (c *ChatClient) OnRoomState(handler func(RoomState)) {
+	c.onCommand(CommandRoomState, func(msg *Message) { handler(newRoomState(msg)) })
+}
+
+// OnUserState is called after joining a channel or sending a message.
+func (c *ChatClient) OnUserState(handler func(UserState)) {
+	c.onCommand(CommandUserState, func(msg *Message) { handler(newUserState(msg)) })
+}
+
+// OnWhisper is called when the connected user receives a whisper.
+func (c *ChatClient) OnWhisper(handler func(Whisper)) {
+	c.onCommand(CommandWhisper, func(msg *Message) { handler(newWhisper(msg)) })
+}
+
+// OnNotice is called for NOTICE messages, e.g. when a command failed.
+func (c *ChatClient) OnNotice(handler func(*Message)) {
+	c.onCommand(CommandNotice, handler)
+}
+
+// OnReconnect is called when twitch is about to terminate the connection for maintenance.
+func (c *ChatClient) OnReconnect(handler func()) {
+	c.onCommand(CommandReconnect, func(*Message) { handler() })
+}
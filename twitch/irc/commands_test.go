@@ -0,0 +1,125 @@
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustMessage(t *testing.T, raw string) *Message {
+	t.Helper()
+	im, err := parseIRCv3(raw)
+	require.NoError(t, err)
+	msg, err := newMessage(&im)
+	require.NoError(t, err)
+	return msg
+}
+
+func TestUserNoticeResub(t *testing.T) {
+	msg := mustMessage(t, `@badge-info=;badges=staff/1,broadcaster/1,turbo/1;color=#008000;display-name=ronni;emotes=;id=db25007f-7a18-43eb-9379-80131e44d633;login=ronni;mod=0;msg-id=resub;msg-param-cumulative-months=6;msg-param-streak-months=2;msg-param-should-share-streak=1;msg-param-sub-plan=Prime;msg-param-sub-plan-name=Prime;room-id=12345678;subscriber=1;system-msg=ronni\shas\ssubscribed\sfor\s6\smonths!;tmi-sent-ts=1507246572675;turbo=1;user-id=87654321;user-type=staff :tmi.twitch.tv USERNOTICE #dallas :Great stream -- keep it up!`)
+
+	n := newUserNotice(msg)
+	assert.Equal(t, "dallas", n.Channel)
+	assert.Equal(t, UserNoticeResub, n.MsgID)
+	assert.Equal(t, "ronni", n.Login)
+	assert.Equal(t, "87654321", n.UserID)
+	assert.Equal(t, "ronni has subscribed for 6 months!", n.SystemMsg)
+	assert.Equal(t, "Great stream -- keep it up!", n.Text)
+	require.NotNil(t, n.Sub)
+	assert.Equal(t, 6, n.Sub.CumulativeMonths)
+	assert.Equal(t, 2, n.Sub.StreakMonths)
+	assert.True(t, n.Sub.ShouldShareStreak)
+	assert.Equal(t, SubPlanPrime, n.Sub.Plan)
+	assert.Nil(t, n.Raid)
+}
+
+func TestUserNoticeRaidWithoutText(t *testing.T) {
+	msg := mustMessage(t, `@badge-info=;badges=turbo/1;color=#9ACD32;display-name=TestChannel;emotes=;id=3d830f12-795c-447d-af3c-ea05e40fbddb;login=testchannel;mod=0;msg-id=raid;msg-param-displayName=TestChannel;msg-param-login=testchannel;msg-param-viewerCount=15;room-id=33332222;subscriber=0;system-msg=15\sraiders\sfrom\sTestChannel\shave\sjoined\n!;tmi-sent-ts=1507246572675;turbo=1;user-id=123456;user-type= :tmi.twitch.tv USERNOTICE #othertestchannel`)
+
+	n := newUserNotice(msg)
+	assert.Equal(t, "othertestchannel", n.Channel)
+	assert.Equal(t, "", n.Text)
+	require.NotNil(t, n.Raid)
+	assert.Equal(t, "testchannel", n.Raid.Login)
+	assert.Equal(t, "TestChannel", n.Raid.DisplayName)
+	assert.Equal(t, 15, n.Raid.ViewerCount)
+	assert.Nil(t, n.Sub)
+}
+
+func TestUserNoticeSubGift(t *testing.T) {
+	msg := mustMessage(t, `@badge-info=;badges=staff/1,premium/1;color=#0000FF;display-name=TWW2;emotes=;id=e9176cd8-5e22-4684-ad40-ce53c2561c5e;login=tww2;mod=0;msg-id=subgift;msg-param-months=1;msg-param-recipient-display-name=Mr_Woodchuck;msg-param-recipient-id=55554444;msg-param-recipient-user-name=mr_woodchuck;msg-param-sub-plan-name=House\sof\sNyoro~n;msg-param-sub-plan=1000;room-id=19571752;subscriber=0;system-msg=TWW2\sgifted\sa\sTier\s1\ssub\sto\sMr_Woodchuck!;tmi-sent-ts=1521159445153;turbo=0;user-id=87654321;user-type=staff :tmi.twitch.tv USERNOTICE #forstycup`)
+
+	n := newUserNotice(msg)
+	require.NotNil(t, n.SubGift)
+	assert.Equal(t, "mr_woodchuck", n.SubGift.RecipientLogin)
+	assert.Equal(t, "Mr_Woodchuck", n.SubGift.RecipientDisplayName)
+	assert.Equal(t, "55554444", n.SubGift.RecipientID)
+	assert.Equal(t, SubPlanTier1, n.SubGift.Plan)
+	assert.Equal(t, "House of Nyoro~n", n.SubGift.PlanName)
+}
+
+func TestClearChat(t *testing.T) {
+	ban := newClearChat(mustMessage(t, `@ban-duration=350;room-id=12345678;target-user-id=87654321;tmi-sent-ts=1642715756806 :tmi.twitch.tv CLEARCHAT #dallas :ronni`))
+	assert.Equal(t, "dallas", ban.Channel)
+	assert.Equal(t, "ronni", ban.TargetUser)
+	assert.Equal(t, "87654321", ban.TargetUserID)
+	assert.Equal(t, 350*time.Second, ban.BanDuration)
+	assert.False(t, ban.Permanent())
+
+	clear := newClearChat(mustMessage(t, `@room-id=12345678;tmi-sent-ts=1642715695392 :tmi.twitch.tv CLEARCHAT #dallas`))
+	assert.Equal(t, "", clear.TargetUser)
+	assert.False(t, clear.Permanent())
+}
+
+func TestClearMsg(t *testing.T) {
+	n := newClearMsg(mustMessage(t, `@login=foo;room-id=;target-msg-id=94e6c7ff-bf98-4faa-af5d-7ad633a158a9;tmi-sent-ts=1642720582342 :tmi.twitch.tv CLEARMSG #bar :what a great day`))
+	assert.Equal(t, "bar", n.Channel)
+	assert.Equal(t, "foo", n.Login)
+	assert.Equal(t, "94e6c7ff-bf98-4faa-af5d-7ad633a158a9", n.TargetMessageID)
+	assert.Equal(t, "what a great day", n.Text)
+}
+
+func TestRoomState(t *testing.T) {
+	full := newRoomState(mustMessage(t, `@emote-only=0;followers-only=-1;r9k=0;room-id=12345678;slow=0;subs-only=0 :tmi.twitch.tv ROOMSTATE #bar`))
+	assert.Equal(t, "bar", full.Channel)
+	require.NotNil(t, full.EmoteOnly)
+	assert.False(t, *full.EmoteOnly)
+	require.NotNil(t, full.FollowersOnly)
+	assert.Less(t, *full.FollowersOnly, time.Duration(0))
+	require.NotNil(t, full.Slow)
+	assert.Equal(t, time.Duration(0), *full.Slow)
+
+	partial := newRoomState(mustMessage(t, `@room-id=12345678;slow=10 :tmi.twitch.tv ROOMSTATE #bar`))
+	assert.Nil(t, partial.EmoteOnly)
+	assert.Nil(t, partial.FollowersOnly)
+	require.NotNil(t, partial.Slow)
+	assert.Equal(t, 10*time.Second, *partial.Slow)
+}
+
+func TestUserState(t *testing.T) {
+	n := newUserState(mustMessage(t, `@badge-info=;badges=staff/1;color=#0D4200;display-name=ronni;emote-sets=0,33,50,237,793,2126,3517,4578,5569,9400,10337,12239;mod=1;subscriber=1;turbo=1;user-type=staff :tmi.twitch.tv USERSTATE #dallas`))
+	assert.Equal(t, "dallas", n.Channel)
+	assert.Equal(t, "ronni", n.DisplayName)
+	assert.True(t, n.IsMod)
+	assert.True(t, n.IsSubscriber)
+	assert.False(t, n.IsVIP)
+	assert.Len(t, n.EmoteSets, 12)
+}
+
+func TestWhisper(t *testing.T) {
+	n := newWhisper(mustMessage(t, `@badges=staff/1,bits-charity/1;color=#8A2BE2;display-name=PetsgomOO;emotes=;message-id=306;thread-id=12345678_87654321;turbo=0;user-id=87654321;user-type=staff :petsgomoo!petsgomoo@petsgomoo.tmi.twitch.tv WHISPER foo :hello`))
+	assert.Equal(t, "petsgomoo", n.From)
+	assert.Equal(t, "PetsgomOO", n.DisplayName)
+	assert.Equal(t, "foo", n.To)
+	assert.Equal(t, "306", n.MessageID)
+	assert.Equal(t, "hello", n.Text)
+}
+
+func TestInvalidChannelCommand(t *testing.T) {
+	im, err := parseIRCv3(`:tmi.twitch.tv ROOMSTATE`)
+	require.NoError(t, err)
+	_, err = newMessage(&im)
+	assert.Error(t, err)
+}
@@ -6,10 +6,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unicode"
 
 	"slices"
 
@@ -18,12 +19,20 @@ import (
 	"golang.org/x/time/rate"
 )
 
-var ErrRateExceeded = errors.New("ratelimit exceeded")
+var (
+	ErrRateExceeded = errors.New("ratelimit exceeded")
+	ErrNotConnected = errors.New("not connected")
+	ErrReadOnly     = errors.New("anonymous connections are read-only")
+	// ErrMissingScope is returned when sending with a token that lacks the "chat:edit" scope
+	ErrMissingScope = errors.New(`OAuth token does not contain "chat:edit" scope`)
 
-type messageHandler chan *Message
+	errReconnectRequested = errors.New("server requested a reconnect")
+)
 
 const (
 	defaultMessageBufferSize = 20
+	// writeTimeout bounds a single write, the connection is closed if it stalls longer
+	writeTimeout = 10 * time.Second
 )
 
 // Message ...
@@ -40,20 +49,43 @@ type Message struct {
 // ChatClient ...
 type ChatClient struct {
 	conn                    *websocket.Conn
-	messageHandlers         map[messageHandler]struct{}
-	doneListening           chan struct{}
-	rateLimitOp             *rate.Limiter
-	rateLimit               *rate.Limiter
-	messageHandlersInternal map[messageHandler]struct{}
+	messageHandlers         map[*messageHandler]struct{}
+	listenDone              chan struct{}
+	listenErr               error
+	channels                map[string]struct{}
+	channelStates           map[string]*ChannelState
+	joinLimiter             *rate.Limiter
+	queue                   *sendQueue
+	messageHandlersInternal map[*messageHandler]struct{}
+	droppedMessages         atomic.Uint64
+	rateLimited             atomic.Uint64
+	reconnects              atomic.Uint64
+	health                  Health
+	ping                    *pendingPing
 	Nick                    string
 	token                   string
+	readOnly                bool
+	cannotEdit              bool
 	defaultTimeout          time.Duration
 	mtx                     sync.Mutex
 	handlerMtx              sync.Mutex
-
-	OnSend     func(command string)
-	OnReceived func(command string)
-	OnError    func(format string, args ...interface{})
+	// writeMtx serializes writes, it is not held together with mtx so a stalled write does not block readers
+	writeMtx sync.Mutex
+
+	// MinReconnectDelay and MaxReconnectDelay bound the exponential backoff used by RunContext
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+
+	// PingInterval is the time between PINGs sent to detect dead connections, zero disables them.
+	// A connection is closed if no PONG is received within PongTimeout.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// OnSend is called for every line that was written to the connection
+	OnSend        func(command string)
+	OnReceived    func(command string)
+	OnError       func(format string, args ...interface{})
+	OnStateChange func(StateChange)
 }
 
 // New ...
@@ -70,99 +102,111 @@ func New(token string) (*ChatClient, error) {
 		return nil, fmt.Errorf("OAuth token does not contain %q scope", "chat:read")
 	}
 
-	return &ChatClient{
-		Nick:                    resp.Login,
-		token:                   token,
-		messageHandlersInternal: make(map[messageHandler]struct{}),
-		messageHandlers:         make(map[messageHandler]struct{}),
-		doneListening:           make(chan struct{}, 1),
-		defaultTimeout:          time.Second * 20,
-
-		rateLimitOp: rate.NewLimiter(3, 1),                                // 3 per second
-		rateLimit:   rate.NewLimiter(rate.Every(time.Millisecond*500), 1), // 0.5 per second
-	}, nil
+	c := newClient(resp.Login, token)
+	// the client can still read chat, sending fails with ErrMissingScope
+	c.cannotEdit = !slices.Contains(resp.Scopes, "chat:edit")
+	return c, nil
 }
 
-func (c *ChatClient) isOp(user, channel string) bool {
-	return strings.EqualFold(user, channel)
+// NewAnonymous creates a read-only client which does not require an OAuth token.
+// Sending messages fails with ErrReadOnly.
+func NewAnonymous() *ChatClient {
+	c := newClient(fmt.Sprintf("justinfan%d", 1000+rand.IntN(89000)), "")
+	c.readOnly = true
+	return c
 }
 
-// Add ...
-func (c *ChatClient) rateLimited(channel string) bool {
-	if c.isOp(c.Nick, channel) {
-		if !c.rateLimitOp.Allow() {
-			return true
-		}
-	} else if !c.rateLimit.Allow() {
-		return true
+func newClient(nick, token string) *ChatClient {
+	return &ChatClient{
+		Nick:                    nick,
+		token:                   token,
+		messageHandlersInternal: make(map[*messageHandler]struct{}),
+		messageHandlers:         make(map[*messageHandler]struct{}),
+		channels:                make(map[string]struct{}),
+		channelStates:           make(map[string]*ChannelState),
+		joinLimiter:             newJoinLimiter(),
+		queue:                   newSendQueue(),
+		defaultTimeout:          time.Second * 20,
+		MinReconnectDelay:       time.Second,
+		MaxReconnectDelay:       time.Minute * 2,
+		PingInterval:            defaultPingInterval,
+		PongTimeout:             defaultPongTimeout,
 	}
-	return false
 }
 
-var noTimeout = time.Time{}
-
-// Send
-func (c *ChatClient) Send(channel, content string) error {
-	if c.rateLimited(channel) {
-		return ErrRateExceeded
-	}
-	err := c.conn.Write(context.TODO(), websocket.MessageText, []byte(fmt.Sprintf("PRIVMSG #%s :%s\n", channel, content)))
+// ReadOnly reports whether the client is connected anonymously and can not send messages.
+func (c *ChatClient) ReadOnly() bool {
+	return c.readOnly
+}
 
-	return err
+// CanSend reports whether the client may send messages, it is neither anonymous nor lacks the "chat:edit" scope.
+func (c *ChatClient) CanSend() bool {
+	return !c.readOnly && !c.cannotEdit
 }
 
-// SendTimeout
-func (c *ChatClient) SendTimeout(channel, content string, timeout time.Duration) error {
-	if c.rateLimited(channel) {
-		return ErrRateExceeded
+func (c *ChatClient) isOp(user, channel string) bool {
+	if state, ok := c.ChannelState(channel); ok && state.IsOp() {
+		return true
 	}
-
-	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
-	defer cancel()
-	err := c.conn.Write(ctx, websocket.MessageText, []byte(fmt.Sprintf("PRIVMSG #%s :%s\n", channel, content)))
-	return err
+	return strings.EqualFold(user, channel)
 }
 
-// OpenContext ...
-func (c *ChatClient) OpenContext(ctx context.Context, url string) error {
+// OpenContext connects to url, requests the capabilities and authenticates.
+// A previously opened connection is closed.
+func (c *ChatClient) OpenContext(ctx context.Context, url string) (err error) {
+	c.closeConn()
 	c.resetHandlers()
 
-	if c.conn != nil {
-		c.conn.Close(websocket.StatusNormalClosure, "")
-	}
 	wsc, _, err := websocket.Dial(ctx, url, &websocket.DialOptions{})
 	if err != nil {
 		return err
 	}
 	// resp.Body.Close()
 
-	c.conn = wsc
-
-	hand := make(chan *Message, defaultMessageBufferSize)
+	hand := c.newMessageHandler(HandlerOptions{})
 
 	c.addHandlerInternal(hand)
 	defer c.removeHandlerInternal(hand)
-	c.listenContext(ctx)
 
-	if err := c.send("CAP REQ :twitch.tv/tags"); err != nil {
+	c.mtx.Lock()
+	c.conn = wsc
+	c.listenDone = make(chan struct{})
+	c.listenErr = nil
+	c.mtx.Unlock()
+	defer func() {
+		if err != nil {
+			c.closeConn()
+		}
+	}()
+	c.listenContext(ctx, wsc, c.listenDone)
+
+	if err := c.sendLine(ctx, NewLine("CAP", "REQ", "twitch.tv/tags twitch.tv/commands")); err != nil {
 		return err
 	}
 
-	if err := c.waitForCaps(hand, ctx, c.defaultTimeout); err != nil {
+	if err := c.waitForCaps(hand.ch, ctx, c.defaultTimeout); err != nil {
 		return err
 	}
 
-	if err := c.send(fmt.Sprintf("PASS oauth:%s", c.token)); err != nil {
-		return err
+	if !c.readOnly {
+		if err := c.sendLine(ctx, NewLine("PASS", "oauth:"+c.token)); err != nil {
+			return err
+		}
 	}
-	if err := c.send(fmt.Sprintf("NICK %s", c.Nick)); err != nil {
+	if err := c.sendLine(ctx, NewLine("NICK", c.Nick)); err != nil {
 		return err
 	}
 
-	if err := c.waitForAuthentication(hand, ctx, c.defaultTimeout); err != nil {
+	if err := c.waitForAuthentication(hand.ch, ctx, c.defaultTimeout); err != nil {
 		return fmt.Errorf("could not authenticate: %w", err)
 	}
 
+	c.mtx.Lock()
+	c.health.ConnectedAt = time.Now()
+	done := c.listenDone
+	c.mtx.Unlock()
+	go c.keepalive(ctx, wsc, done)
+
 	return nil
 }
 
@@ -172,13 +216,14 @@ func (c *ChatClient) waitForAuthentication(hand <-chan *Message, ctx context.Con
 	for {
 		select {
 		case msg, ok := <-hand:
-			if ok {
-				if msg.Command == "376" {
-					return nil
-				}
-				if msg.Command == "NOTICE" && strings.Contains(msg.Trailer, "failed") {
-					return fmt.Errorf("received failed response. %s", msg.Trailer)
-				}
+			if !ok {
+				return c.connectionLost()
+			}
+			if msg.Command == "376" {
+				return nil
+			}
+			if msg.Command == "NOTICE" && strings.Contains(msg.Trailer, "failed") {
+				return fmt.Errorf("received failed response. %s", msg.Trailer)
 			}
 
 		case <-ctx.Done():
@@ -194,7 +239,10 @@ func (c *ChatClient) waitForCaps(hand <-chan *Message, ctx context.Context, time
 	defer timer.Stop()
 	for {
 		select {
-		case msg := <-hand:
+		case msg, ok := <-hand:
+			if !ok {
+				return c.connectionLost()
+			}
 			if msg.Command == "CAP" &&
 				len(msg.Args) > 1 &&
 				msg.Args[1] == "ACK" {
@@ -208,21 +256,42 @@ func (c *ChatClient) waitForCaps(hand <-chan *Message, ctx context.Context, time
 	}
 }
 
-// Close ...
+// Close closes the connection, drops all queued messages and stops all registered handlers.
 func (c *ChatClient) Close() error {
-	if c.conn == nil {
-		return fmt.Errorf("no connection")
-	}
+	c.queue.stop()
+	err := c.closeConn()
 
-	if err := c.conn.Close(websocket.StatusNormalClosure, ""); err != nil {
-		return err
+	c.handlerMtx.Lock()
+	defer c.handlerMtx.Unlock()
+	for hand := range c.messageHandlers {
+		close(hand.ch)
 	}
+	clear(c.messageHandlers)
+
+	return err
+}
+
+// closeConn closes the current connection and waits for the listening go-routine to exit.
+// Registered handlers are kept, so they continue to work after reconnecting.
+func (c *ChatClient) closeConn() error {
+	c.mtx.Lock()
+	conn := c.conn
+	done := c.listenDone
 	c.conn = nil
+	c.mtx.Unlock()
+
+	if conn == nil {
+		return fmt.Errorf("no connection")
+	}
+
+	// errors are expected here if the connection was already lost
+	conn.Close(websocket.StatusNormalClosure, "")
+
 	timer := time.NewTimer(c.defaultTimeout)
 	defer timer.Stop()
 
 	select {
-	case <-c.doneListening:
+	case <-done:
 	case <-timer.C:
 		return fmt.Errorf("waiting for listening go-routine failed")
 	}
@@ -230,77 +299,131 @@ func (c *ChatClient) Close() error {
 	return nil
 }
 
-// OnMessage ...
+// connectionLost returns the reason the listening go-routine exited.
+func (c *ChatClient) connectionLost() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.listenErr != nil {
+		return fmt.Errorf("connection lost. %w", c.listenErr)
+	}
+	return fmt.Errorf("connection lost")
+}
+
+// OnMessage is called for every chat message (PRIVMSG).
+// If handler does not keep up, the oldest queued messages are dropped.
 func (c *ChatClient) OnMessage(handler func(msg *Message) error) {
-	hand := make(messageHandler, defaultMessageBufferSize)
+	c.OnMessageWithOptions(handler, HandlerOptions{})
+}
+
+// OnMessageWithOptions is called for every chat message (PRIVMSG),
+// opts control how many messages are queued and what happens if handler does not keep up.
+// Returning an error from handler stops it.
+func (c *ChatClient) OnMessageWithOptions(handler func(msg *Message) error, opts HandlerOptions) HandlerStats {
+	hand := c.newMessageHandler(opts, CommandPrivMsg)
 	c.addHandler(hand)
 	go func() {
 		defer c.removeHandler(hand)
-		for msg := range hand {
+		for msg := range hand.ch {
 			if err := handler(msg); err != nil {
 				return
 			}
 		}
 	}()
+	return HandlerStats{h: hand}
 }
 
 func (c *ChatClient) resetHandlers() {
 	c.handlerMtx.Lock()
 	defer c.handlerMtx.Unlock()
 
-	c.messageHandlersInternal = make(map[messageHandler]struct{})
-	// c.messageHandlers = make(map[messageHandler]struct{})
+	c.messageHandlersInternal = make(map[*messageHandler]struct{})
 }
 
-func (c *ChatClient) addHandler(hand messageHandler) {
+// addHandler registers hand to receive all messages with one of its commands
+func (c *ChatClient) addHandler(hand *messageHandler) {
 	c.handlerMtx.Lock()
 	defer c.handlerMtx.Unlock()
 	c.messageHandlers[hand] = struct{}{}
 }
 
-func (c *ChatClient) removeHandler(hand messageHandler) {
+func (c *ChatClient) removeHandler(hand *messageHandler) {
 	c.handlerMtx.Lock()
 	defer c.handlerMtx.Unlock()
 	delete(c.messageHandlers, hand)
 }
 
-func (c *ChatClient) addHandlerInternal(hand messageHandler) {
+func (c *ChatClient) addHandlerInternal(hand *messageHandler) {
 	c.handlerMtx.Lock()
 	defer c.handlerMtx.Unlock()
 	c.messageHandlersInternal[hand] = struct{}{}
 
 }
-func (c *ChatClient) removeHandlerInternal(hand messageHandler) {
+func (c *ChatClient) removeHandlerInternal(hand *messageHandler) {
 	c.handlerMtx.Lock()
 	defer c.handlerMtx.Unlock()
 	delete(c.messageHandlersInternal, hand)
 }
 
-func (c *ChatClient) send(txt string) error {
+// sendLine encodes the line and sends it, rejecting lines that would break the protocol.
+func (c *ChatClient) sendLine(ctx context.Context, line Line) error {
+	txt, err := line.Encode()
+	if err != nil {
+		return err
+	}
+	return c.send(ctx, txt)
+}
+
+// send writes txt, OnSend is called once it was written
+func (c *ChatClient) send(ctx context.Context, txt string) error {
+	c.mtx.Lock()
+	conn := c.conn
+	c.mtx.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	c.writeMtx.Lock()
+	defer c.writeMtx.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+	if err := conn.Write(ctx, websocket.MessageText, []byte(txt+"\r\n")); err != nil {
+		return err
+	}
 	if c.OnSend != nil {
 		c.OnSend(txt)
 	}
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-	err := c.conn.Write(context.TODO(), websocket.MessageText, []byte(txt))
-	return err
+	return nil
 }
 
+// JoinContext joins the channel and waits for twitch to confirm it.
+// Joined channels are joined again after RunContext reconnected.
+//
+// JOINs are throttled to stay within twitch's rate limit.
 func (c *ChatClient) JoinContext(ctx context.Context, channel string) error {
-	hand := make(messageHandler, defaultMessageBufferSize)
+	channel = normalizeChannel(channel)
+	if err := c.joinLimiter.Wait(ctx); err != nil {
+		return fmt.Errorf("JOIN cancelled. %w", err)
+	}
+
+	hand := c.newMessageHandler(HandlerOptions{})
 	c.addHandlerInternal(hand)
 	defer c.removeHandlerInternal(hand)
 
-	c.send(fmt.Sprintf("JOIN #%s\n", channel))
+	if err := c.sendLine(ctx, NewLine(CommandJoin, "#"+channel)); err != nil {
+		return err
+	}
 
-	timer := time.NewTimer(time.Second * 30)
+	timer := time.NewTimer(c.defaultTimeout)
 	defer timer.Stop()
 
 	expectedPrefix := fmt.Sprintf("%s!%s@%s.tmi.twitch.tv", c.Nick, c.Nick, c.Nick)
 
 	for {
 		select {
-		case msg := <-hand:
+		case msg, ok := <-hand.ch:
+			if !ok {
+				return c.connectionLost()
+			}
 			if msg.Prefix == expectedPrefix &&
 				msg.Command == "JOIN" &&
 				len(msg.Args) > 0 {
@@ -309,6 +432,7 @@ func (c *ChatClient) JoinContext(ctx context.Context, channel string) error {
 					if msg.Args[0][0] == '#' {
 						if msg.Args[0][1:] == channel {
 							c.removeHandlerInternal(hand)
+							c.addChannel(channel)
 							return nil
 						}
 					}
@@ -322,24 +446,79 @@ func (c *ChatClient) JoinContext(ctx context.Context, channel string) error {
 	}
 }
 
-const (
-	// TagBadgeInfo ...
-	TagBadgeInfo string = "badge-info"
-	// TagBadges ...
-	TagBadges string = "badges"
-	// TagColor ...
-	TagColor string = "color"
-	// TagDisplayName ...
-	TagDisplayName string = "display-name"
-	// TagEmotes ...
-	TagEmotes string = "emotes"
-	// TagFlags ...
-	TagFlags string = "flags"
-	// TagSubscriber 1 if the user has a subscriber badge; otherwise, 0.
-	//
-	// [deprecated] use badges
-	TagSubscriber string = "subscriber"
-)
+func channelArg(im *ircv3Message, msg *Message) error {
+	if len(im.Command.Args) < 1 ||
+		len(im.Command.Args[0]) < 2 {
+		return fmt.Errorf("invalid aruments for %s received", msg.Command)
+	}
+	msg.Channel = im.Command.Args[0][1:]
+	return nil
+}
+
+func senderFromPrefix(msg *Message) error {
+	if !strings.ContainsRune(msg.Prefix, '!') {
+		return fmt.Errorf("could not determine sender for %s", msg.Command)
+	}
+	msg.Sender = msg.Prefix[:strings.IndexRune(msg.Prefix, '!')]
+	return nil
+}
+
+var commandHandlers = map[string]func(*ircv3Message, *Message) error{
+	CommandPrivMsg: func(im *ircv3Message, msg *Message) error {
+		if len(im.Command.Args) < 2 {
+			return fmt.Errorf("invalid aruments for %s received", msg.Command)
+		}
+		if err := channelArg(im, msg); err != nil {
+			return err
+		}
+		return senderFromPrefix(msg)
+	},
+	CommandJoin: channelArg,
+	CommandPart: channelArg,
+	CommandNotice: func(im *ircv3Message, msg *Message) error {
+		if len(im.Command.Args) > 0 &&
+			len(im.Command.Args[0]) > 1 {
+			msg.Channel = im.Command.Args[0][1:]
+		}
+		return nil
+	},
+	CommandUserNotice: channelArg,
+	CommandClearChat:  channelArg,
+	CommandClearMsg:   channelArg,
+	CommandRoomState:  channelArg,
+	CommandUserState:  channelArg,
+	CommandWhisper: func(im *ircv3Message, msg *Message) error {
+		if len(im.Command.Args) < 2 {
+			return fmt.Errorf("invalid aruments for %s received", msg.Command)
+		}
+		return senderFromPrefix(msg)
+	},
+}
+
+// newMessage converts a parsed irc line into a Message
+// and fills in the command specific fields.
+func newMessage(im *ircv3Message) (*Message, error) {
+	msg := &Message{
+		Tags: make(map[string]string, len(im.Tags)),
+	}
+	msg.Prefix = im.Prefix
+	msg.Sender = "[SYSTEM]"
+	msg.Command = im.Command.Name
+	msg.Args = im.Command.Args
+	if len(msg.Args) > 0 {
+		msg.Trailer = msg.Args[len(msg.Args)-1]
+	}
+	for _, v := range im.Tags {
+		msg.Tags[v.Key] = v.Value
+	}
+
+	if h, ok := commandHandlers[im.Command.Name]; ok {
+		if err := h(im, msg); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
 
 func (c *ChatClient) onError(format string, args ...interface{}) {
 	if c.OnError != nil {
@@ -351,57 +530,29 @@ func (c *ChatClient) onReceived(rawMsg string) {
 		c.OnReceived(rawMsg)
 	}
 }
-func (c *ChatClient) listenContext(ctx context.Context) {
-	isDigitCode := func(code string) bool {
-		for _, c := range code {
-			if !unicode.IsDigit(c) {
-				return false
-			}
-		}
-		return true
-	}
-
-	commandHandlers := map[string]func(*ircv3Message, *Message) error{
-		"PRIVMSG": func(im *ircv3Message, msg *Message) error {
-			if len(im.Command.Args) < 2 ||
-				len(im.Command.Args[0]) < 2 {
-				return fmt.Errorf("invalid aruments for %s received", msg.Command)
-			}
-			if !strings.ContainsRune(msg.Prefix, '!') {
-				return fmt.Errorf("could not determine sender for %s", msg.Command)
-			}
-			msg.Channel = im.Command.Args[0][1:]
-			msg.Sender = msg.Prefix[:strings.IndexRune(msg.Prefix, '!')]
-			return nil
-		},
-		"JOIN": func(im *ircv3Message, msg *Message) error {
-			if len(im.Command.Args) < 1 {
-				return fmt.Errorf("invalid aruments for %s received", msg.Command)
-			}
-			return nil
-		},
-		"NOTICE": func(im *ircv3Message, msg *Message) error {
-			if len(im.Command.Args) > 0 &&
-				len(im.Command.Args[0]) > 1 {
-				msg.Channel = im.Command.Args[0][1:]
-			}
-			return nil
-		},
-	}
 
+// listenContext reads from conn until the connection is closed and closes done afterwards.
+// The reason the connection ended is stored in listenErr.
+func (c *ChatClient) listenContext(ctx context.Context, conn *websocket.Conn, done chan<- struct{}) {
 	go func() {
+		var exitErr error
+		defer close(done)
 		defer func() {
-			c.doneListening <- struct{}{}
+			c.mtx.Lock()
+			// keepalive may already have stored why it closed the connection
+			if c.listenErr == nil {
+				c.listenErr = exitErr
+			}
+			c.ping = nil
+			c.mtx.Unlock()
 		}()
 		defer func() {
 			c.handlerMtx.Lock()
 			defer c.handlerMtx.Unlock()
-			for c := range c.messageHandlers {
-				close(c)
-			}
-			for c := range c.messageHandlersInternal {
-				close(c)
+			for h := range c.messageHandlersInternal {
+				close(h.ch)
 			}
+			clear(c.messageHandlersInternal)
 		}()
 
 		keepGoing := func(scn *bufio.Scanner) bool {
@@ -413,12 +564,19 @@ func (c *ChatClient) listenContext(ctx context.Context) {
 			}
 		}
 		br := bytes.NewReader(nil)
-		for mt, data, err := c.conn.Read(ctx); mt == websocket.MessageText && err == nil; mt, data, err = c.conn.Read(ctx) {
+		mt, data, err := conn.Read(ctx)
+		defer func() {
+			if exitErr == nil {
+				exitErr = err
+			}
+		}()
+		for ; mt == websocket.MessageText && err == nil; mt, data, err = conn.Read(ctx) {
 			br.Reset(data)
 
 			scn := bufio.NewScanner(br)
 			for keepGoing(scn) {
 				rawMsg := scn.Text()
+				c.received(time.Now())
 				ircMsg, err := parseIRCv3(rawMsg)
 				if err != nil {
 					c.onError("Could not parse message %q. %v", rawMsg, err)
@@ -428,6 +586,7 @@ func (c *ChatClient) listenContext(ctx context.Context) {
 					if len(ircMsg.Command.Args) > 1 {
 						if ircMsg.Command.Args[1] == "Improperly formatted auth" {
 							c.onError("(%s). Missing OAuth information", rawMsg)
+							exitErr = fmt.Errorf("missing OAuth information")
 							return
 						}
 					}
@@ -437,64 +596,35 @@ func (c *ChatClient) listenContext(ctx context.Context) {
 					if len(ircMsg.Command.Args) == 0 || // No Args
 						len(ircMsg.Command.Args[0]) == 0 || ircMsg.Command.Args[0] == "" {
 						c.onError("invalid PING received. (%s) %#v", rawMsg, ircMsg.Command)
+						exitErr = fmt.Errorf("invalid PING received")
 						return
 					}
-					if err := c.send("PONG :" + ircMsg.Command.Args[0] + "\n"); err != nil {
+					if err := c.sendLine(ctx, NewLine("PONG", ircMsg.Command.Args[0])); err != nil {
 						c.onError("Could not send pong. %v", err)
+						exitErr = fmt.Errorf("could not send pong. %w", err)
 						return
 					}
 					continue
 				}
 
-				msg := &Message{
-					Tags: map[string]string{},
-				}
-				msg.Prefix = ircMsg.Prefix
-				msg.Sender = "[SYSTEM]"
-				msg.Command = ircMsg.Command.Name
-				msg.Args = ircMsg.Command.Args
-				if len(msg.Args) > 0 {
-					msg.Trailer = msg.Args[len(msg.Args)-1]
-				}
-				for _, v := range ircMsg.Tags {
-					msg.Tags[v.Key] = v.Value
+				msg, err := newMessage(&ircMsg)
+				if err != nil {
+					c.onError("invalid command %q. %v", rawMsg, err)
+					continue
 				}
 
-				isPublicMessage := false
-				if h, ok := commandHandlers[ircMsg.Command.Name]; ok {
-					if err := h(&ircMsg, msg); err != nil {
-						c.onError("invalid command %q. %v", rawMsg, err)
-						continue
-					}
-					if ircMsg.Command.Name == "PRIVMSG" {
-						isPublicMessage = true
-					}
-				} else if ircMsg.Command.Name == "PRIVMSG" {
-					isPublicMessage = true
-				} else {
-					if isDigitCode(msg.Command) {
-						if len(ircMsg.Command.Args) > 0 {
-							msg.Trailer = ircMsg.Command.Args[len(ircMsg.Command.Args)-1]
-							msg.Args = ircMsg.Command.Args
-						}
-					}
+				if msg.Command == "PONG" {
+					c.pongReceived(msg.Trailer, time.Now())
 				}
+				c.updateChannelState(msg)
 
-				c.handlerMtx.Lock()
-				if isPublicMessage {
-					for c := range c.messageHandlersInternal {
-						c <- msg
-					}
-					for c := range c.messageHandlers {
-						c <- msg
-					}
-				} else {
-					for c := range c.messageHandlersInternal {
-						c <- msg
-					}
-				}
-				c.handlerMtx.Unlock()
+				c.dispatch(msg)
 				c.onReceived(rawMsg)
+
+				if msg.Command == CommandReconnect {
+					exitErr = errReconnectRequested
+					return
+				}
 			}
 		}
 	}()
@@ -0,0 +1,356 @@
+package irc
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kirides/twitch-integration/twitch/irc/irctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnonymousClientIsReadOnly(t *testing.T) {
+	c := NewAnonymous()
+
+	assert.True(t, c.ReadOnly())
+	assert.True(t, strings.HasPrefix(c.Nick, "justinfan"), c.Nick)
+	assert.ErrorIs(t, c.Send("channel", "hello"), ErrReadOnly)
+	assert.False(t, c.CanSend())
+}
+
+func TestClientWithoutEditScopeCanNotSend(t *testing.T) {
+	c := newClient("bot", "token")
+	c.cannotEdit = true
+
+	assert.False(t, c.ReadOnly())
+	assert.False(t, c.CanSend())
+	assert.ErrorIs(t, c.Send("channel", "hello"), ErrMissingScope)
+	assert.Zero(t, c.QueueLength())
+}
+
+func newTestServer(t *testing.T) (*irctest.Server, context.Context) {
+	t.Helper()
+	srv := irctest.NewServer()
+	t.Cleanup(srv.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	t.Cleanup(cancel)
+	return srv, ctx
+}
+
+func newTestClient(t *testing.T) *ChatClient {
+	t.Helper()
+	c := newClient("bot", "token")
+	c.defaultTimeout = time.Second * 2
+	c.MinReconnectDelay = time.Millisecond * 10
+	c.MaxReconnectDelay = time.Millisecond * 50
+	c.OnError = func(format string, args ...interface{}) {
+		t.Logf(format, args...)
+	}
+	return c
+}
+
+func TestOpenContextAuthenticates(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	defer c.Close()
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+
+	assert.Equal(t, []string{
+		"CAP REQ :twitch.tv/tags twitch.tv/commands",
+		"PASS oauth:token",
+		"NICK bot",
+	}, srv.Lines())
+}
+
+func TestPendingWriteDoesNotBlockHealth(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	defer c.Close()
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+
+	// a write that stalls holds the write lock
+	c.writeMtx.Lock()
+	health := make(chan Health, 1)
+	go func() {
+		c.received(time.Now())
+		health <- c.Health()
+	}()
+	select {
+	case h := <-health:
+		assert.True(t, h.Connected)
+	case <-time.After(time.Second):
+		t.Fatal("Health blocked by a pending write")
+	}
+	c.writeMtx.Unlock()
+}
+
+func TestOpenContextAnonymous(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := NewAnonymous()
+	defer c.Close()
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+
+	lines := srv.Lines()
+	require.Len(t, lines, 2)
+	assert.Equal(t, "NICK "+c.Nick, lines[1])
+}
+
+func TestOpenContextAuthFailure(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	srv.SetBehaviour(irctest.Behaviour{AuthFailure: true})
+	c := newTestClient(t)
+	defer c.Close()
+
+	err := c.OpenContext(ctx, srv.URL)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Login authentication failed")
+}
+
+func TestOpenContextCapsTimeout(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	srv.SetBehaviour(irctest.Behaviour{IgnoreCaps: true})
+	c := newTestClient(t)
+	c.defaultTimeout = time.Millisecond * 100
+	defer c.Close()
+
+	err := c.OpenContext(ctx, srv.URL)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "CAP")
+}
+
+func TestJoinContextTracksChannelState(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	defer c.Close()
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+	require.NoError(t, c.JoinAllContext(ctx, "#First", "second"))
+
+	assert.Equal(t, []string{"first", "second"}, c.Channels())
+	require.NoError(t, srv.WaitFor(ctx, func(*irctest.Server) bool {
+		_, ok := c.ChannelState("second")
+		return ok
+	}))
+	state, _ := c.ChannelState("second")
+	assert.Equal(t, "12345678", state.RoomID)
+	assert.False(t, state.IsOp())
+
+	require.NoError(t, c.PartContext(ctx, "first"))
+	assert.Equal(t, []string{"second"}, c.Channels())
+	_, ok := c.ChannelState("first")
+	assert.False(t, ok)
+}
+
+func TestPingIsAnswered(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	defer c.Close()
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+	srv.Ping()
+
+	line, err := srv.WaitForLine(ctx, "PONG")
+	require.NoError(t, err)
+	assert.Equal(t, "PONG tmi.twitch.tv", line)
+}
+
+func TestMessagesAreDispatched(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	defer c.Close()
+
+	messages := make(chan *Message, 1)
+	c.OnMessage(func(msg *Message) error {
+		messages <- msg
+		return nil
+	})
+	notices := make(chan UserNotice, 1)
+	c.OnUserNotice(func(un UserNotice) {
+		notices <- un
+	})
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+	srv.Privmsg("channel", "viewer", "#hp 5")
+	srv.Send(`@msg-id=raid;msg-param-login=raider;msg-param-viewerCount=3 :tmi.twitch.tv USERNOTICE #channel`)
+
+	select {
+	case msg := <-messages:
+		assert.Equal(t, "channel", msg.Channel)
+		assert.Equal(t, "viewer", msg.Sender)
+		assert.Equal(t, "#hp 5", msg.Trailer)
+	case <-ctx.Done():
+		t.Fatal("no message received")
+	}
+	select {
+	case un := <-notices:
+		require.NotNil(t, un.Raid)
+		assert.Equal(t, 3, un.Raid.ViewerCount)
+	case <-ctx.Done():
+		t.Fatal("no user notice received")
+	}
+}
+
+func TestSendIsDelivered(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	defer c.Close()
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+	require.NoError(t, c.SendTimeout("channel", "hello world", time.Second*5))
+
+	line, err := srv.WaitForLine(ctx, "PRIVMSG")
+	require.NoError(t, err)
+	assert.Equal(t, "PRIVMSG #channel :hello world", line)
+}
+
+func TestRunContextReconnectsAndRejoins(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+
+	var mtx sync.Mutex
+	var states []ConnectionState
+	joined := make(chan struct{}, 3)
+	c.OnStateChange = func(sc StateChange) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		states = append(states, sc.State)
+		if sc.State == StateJoined {
+			joined <- struct{}{}
+		}
+	}
+	joins := func(s *irctest.Server) int {
+		n := 0
+		for _, l := range s.Lines() {
+			if l == "JOIN #channel" {
+				n++
+			}
+		}
+		return n
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- c.RunContext(runCtx, srv.URL, "#Channel") }()
+
+	require.NoError(t, srv.WaitFor(ctx, func(s *irctest.Server) bool { return joins(s) == 1 }))
+
+	srv.Reconnect()
+	require.NoError(t, srv.WaitFor(ctx, func(s *irctest.Server) bool { return joins(s) == 2 }))
+
+	srv.Disconnect()
+	require.NoError(t, srv.WaitFor(ctx, func(s *irctest.Server) bool { return joins(s) == 3 }))
+	assert.Equal(t, 3, srv.Connections())
+	assert.Equal(t, uint64(2), c.Reconnects())
+
+	for range 3 {
+		select {
+		case <-joined:
+		case <-ctx.Done():
+			t.Fatal("channel was not joined")
+		}
+	}
+	cancel()
+	require.NoError(t, <-done)
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []ConnectionState{
+		StateConnecting, StateConnected, StateJoined, StateDisconnected,
+		StateConnecting, StateConnected, StateJoined, StateDisconnected,
+		StateConnecting, StateConnected, StateJoined, StateDisconnected,
+	}, states)
+}
+
+func TestKeepaliveMeasuresLatency(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	c.PingInterval = time.Millisecond * 20
+	defer c.Close()
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+	_, err := srv.WaitForLine(ctx, "PING")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return !c.Health().LastPong.IsZero() }, time.Second*5, time.Millisecond*10)
+
+	health := c.Health()
+	assert.True(t, health.Connected)
+	assert.Positive(t, health.Latency)
+	assert.False(t, health.LastReceived.IsZero())
+	assert.Zero(t, health.PongTimeouts)
+}
+
+func TestKeepaliveReconnectsWithoutPong(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	srv.SetBehaviour(irctest.Behaviour{IgnorePings: true})
+	c := newTestClient(t)
+	c.PingInterval = time.Millisecond * 20
+	c.PongTimeout = time.Millisecond * 50
+
+	disconnected := make(chan error, 10)
+	c.OnStateChange = func(sc StateChange) {
+		if sc.State == StateDisconnected {
+			disconnected <- sc.Err
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- c.RunContext(runCtx, srv.URL) }()
+
+	select {
+	case err := <-disconnected:
+		assert.ErrorIs(t, err, ErrPongTimeout)
+	case <-ctx.Done():
+		t.Fatal("connection was not closed")
+	}
+	require.NoError(t, srv.WaitFor(ctx, func(s *irctest.Server) bool { return s.Connections() >= 2 }))
+	assert.Positive(t, c.Health().PongTimeouts)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestRunContextRetriesFailedJoin(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	srv.SetBehaviour(irctest.Behaviour{IgnoreJoins: true})
+	c := newTestClient(t)
+	c.defaultTimeout = time.Millisecond * 100
+
+	joined := make(chan string, 1)
+	c.OnStateChange = func(sc StateChange) {
+		if sc.State == StateJoined {
+			joined <- sc.Channel
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- c.RunContext(runCtx, srv.URL, "#Channel") }()
+
+	// the JOIN is sent again while the connection stays up
+	require.NoError(t, srv.WaitFor(ctx, func(s *irctest.Server) bool {
+		n := 0
+		for _, l := range s.Lines() {
+			if l == "JOIN #channel" {
+				n++
+			}
+		}
+		return n >= 2
+	}))
+	srv.SetBehaviour(irctest.Behaviour{})
+
+	select {
+	case channel := <-joined:
+		assert.Equal(t, "channel", channel)
+	case <-ctx.Done():
+		t.Fatal("channel was not joined")
+	}
+	assert.Equal(t, 1, srv.Connections())
+	cancel()
+	require.NoError(t, <-done)
+}
@@ -0,0 +1,150 @@
+package irc
+
+import (
+	"slices"
+	"sync/atomic"
+)
+
+// OverflowPolicy decides what happens when a handler does not keep up with incoming messages
+type OverflowPolicy int
+
+const (
+	// OverflowDropOldest discards the oldest queued message to make room for the new one
+	OverflowDropOldest OverflowPolicy = iota
+	// OverflowDropNewest discards the new message
+	OverflowDropNewest
+	// OverflowDisconnect removes the handler, it does not receive any further messages
+	OverflowDisconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// HandlerOptions control how messages are queued for a handler
+type HandlerOptions struct {
+	// QueueSize is the number of messages buffered for the handler, defaults to 20
+	QueueSize int
+	Overflow  OverflowPolicy
+}
+
+// HandlerStats reports the state of a registered handler
+type HandlerStats struct {
+	h *messageHandler
+}
+
+// Dropped returns the number of messages that were discarded because the handler did not keep up.
+func (s HandlerStats) Dropped() uint64 {
+	return s.h.dropped.Load()
+}
+
+// Queued returns the number of messages waiting to be handled.
+func (s HandlerStats) Queued() int {
+	return len(s.h.ch)
+}
+
+// messageHandler is a bounded queue of messages for a single consumer.
+// Messages are only ever added by the listening go-routine while holding handlerMtx,
+// so delivering never blocks reading from the connection.
+type messageHandler struct {
+	ch       chan *Message
+	commands []string
+	overflow OverflowPolicy
+	dropped  atomic.Uint64
+	// total is shared by all handlers of a client
+	total *atomic.Uint64
+}
+
+func (c *ChatClient) newMessageHandler(opts HandlerOptions, commands ...string) *messageHandler {
+	size := opts.QueueSize
+	if size <= 0 {
+		size = defaultMessageBufferSize
+	}
+	return &messageHandler{
+		ch:       make(chan *Message, size),
+		commands: commands,
+		overflow: opts.Overflow,
+		total:    &c.droppedMessages,
+	}
+}
+
+// wants reports whether the handler registered for the message's command.
+// Handlers without commands receive everything.
+func (h *messageHandler) wants(msg *Message) bool {
+	return len(h.commands) == 0 || slices.Contains(h.commands, msg.Command)
+}
+
+func (h *messageHandler) drop() {
+	h.dropped.Add(1)
+	h.total.Add(1)
+}
+
+// deliver queues msg without blocking.
+// It returns false if the handler has to be removed because of OverflowDisconnect,
+// in that case the channel is already closed.
+func (h *messageHandler) deliver(msg *Message) bool {
+	select {
+	case h.ch <- msg:
+		return true
+	default:
+	}
+
+	switch h.overflow {
+	case OverflowDropNewest:
+		h.drop()
+	case OverflowDisconnect:
+		h.drop()
+		close(h.ch)
+		return false
+	default:
+		// the consumer may have taken a message in the meantime
+		select {
+		case <-h.ch:
+			h.drop()
+		default:
+		}
+		select {
+		case h.ch <- msg:
+		default:
+			h.drop()
+		}
+	}
+	return true
+}
+
+// dispatch hands msg to all interested handlers. Handlers that overflowed with
+// OverflowDisconnect are removed.
+func (c *ChatClient) dispatch(msg *Message) {
+	var removed []*messageHandler
+	c.handlerMtx.Lock()
+	for h := range c.messageHandlersInternal {
+		if !h.deliver(msg) {
+			delete(c.messageHandlersInternal, h)
+		}
+	}
+	for h := range c.messageHandlers {
+		if h.wants(msg) && !h.deliver(msg) {
+			delete(c.messageHandlers, h)
+			removed = append(removed, h)
+		}
+	}
+	c.handlerMtx.Unlock()
+
+	// OnError may register handlers itself
+	for _, h := range removed {
+		c.onError("handler for %v disconnected, it did not keep up with incoming messages", h.commands)
+	}
+}
+
+// DroppedMessages returns the number of messages discarded across all handlers.
+func (c *ChatClient) DroppedMessages() uint64 {
+	return c.droppedMessages.Load()
+}
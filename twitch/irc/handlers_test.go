@@ -0,0 +1,131 @@
+package irc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fillHandler(t *testing.T, h *messageHandler, n int) {
+	t.Helper()
+	for i := range n {
+		h.deliver(&Message{Command: CommandPrivMsg, Trailer: fmt.Sprint(i)})
+	}
+}
+
+func drainHandler(h *messageHandler) []string {
+	var result []string
+	for {
+		select {
+		case msg, ok := <-h.ch:
+			if !ok {
+				return result
+			}
+			result = append(result, msg.Trailer)
+		default:
+			return result
+		}
+	}
+}
+
+func TestHandlerOverflow(t *testing.T) {
+	tests := []struct {
+		policy  OverflowPolicy
+		want    []string
+		dropped uint64
+	}{
+		{OverflowDropOldest, []string{"3", "4"}, 3},
+		{OverflowDropNewest, []string{"0", "1"}, 3},
+		{OverflowDisconnect, []string{"0", "1"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			c := newClient("bot", "token")
+			h := c.newMessageHandler(HandlerOptions{QueueSize: 2, Overflow: tt.policy})
+			if tt.policy == OverflowDisconnect {
+				fillHandler(t, h, 2)
+				assert.False(t, h.deliver(&Message{Trailer: "2"}))
+			} else {
+				fillHandler(t, h, 5)
+			}
+
+			assert.Equal(t, tt.want, drainHandler(h))
+			assert.Equal(t, tt.dropped, HandlerStats{h: h}.Dropped())
+			assert.Equal(t, tt.dropped, c.DroppedMessages())
+		})
+	}
+}
+
+func TestDispatchRemovesDisconnectedHandlers(t *testing.T) {
+	c := newClient("bot", "token")
+	h := c.newMessageHandler(HandlerOptions{QueueSize: 1, Overflow: OverflowDisconnect}, CommandPrivMsg)
+	other := c.newMessageHandler(HandlerOptions{QueueSize: 1}, CommandNotice)
+	c.addHandler(h)
+	c.addHandler(other)
+
+	c.dispatch(&Message{Command: CommandPrivMsg})
+	c.dispatch(&Message{Command: CommandPrivMsg})
+
+	c.handlerMtx.Lock()
+	_, ok := c.messageHandlers[h]
+	c.handlerMtx.Unlock()
+	assert.False(t, ok)
+	assert.Len(t, other.ch, 0)
+
+	_, ok = <-h.ch
+	require.True(t, ok)
+	_, ok = <-h.ch
+	assert.False(t, ok, "channel should be closed")
+}
+
+func TestDispatchReportsWithoutHandlerLock(t *testing.T) {
+	c := newClient("bot", "token")
+	var reported []string
+	c.OnError = func(format string, args ...interface{}) {
+		// registering a handler takes the handler lock
+		c.addHandler(c.newMessageHandler(HandlerOptions{}, CommandNotice))
+		reported = append(reported, fmt.Sprintf(format, args...))
+	}
+	h := c.newMessageHandler(HandlerOptions{QueueSize: 1, Overflow: OverflowDisconnect}, CommandPrivMsg)
+	c.addHandler(h)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.dispatch(&Message{Command: CommandPrivMsg})
+		c.dispatch(&Message{Command: CommandPrivMsg})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch deadlocked")
+	}
+	assert.Equal(t, []string{"handler for [PRIVMSG] disconnected, it did not keep up with incoming messages"}, reported)
+}
+
+func TestSlowHandlerDoesNotBlockPong(t *testing.T) {
+	srv, ctx := newTestServer(t)
+	c := newTestClient(t)
+	defer c.Close()
+
+	block := make(chan struct{})
+	defer close(block)
+	stats := c.OnMessageWithOptions(func(*Message) error {
+		<-block
+		return nil
+	}, HandlerOptions{QueueSize: 5, Overflow: OverflowDropNewest})
+
+	require.NoError(t, c.OpenContext(ctx, srv.URL))
+	for i := range 50 {
+		srv.Privmsg("channel", "viewer", fmt.Sprint(i))
+	}
+	srv.Ping()
+
+	_, err := srv.WaitForLine(ctx, "PONG")
+	require.NoError(t, err)
+	assert.Positive(t, stats.Dropped())
+	assert.LessOrEqual(t, stats.Queued(), 5)
+}
@@ -0,0 +1,318 @@
+// Package irctest provides an in-process fake of twitch's IRC websocket endpoint
+// to test chat clients without network access.
+package irctest
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/coder/websocket"
+)
+
+const host = "tmi.twitch.tv"
+
+// Behaviour changes how the server responds to clients
+type Behaviour struct {
+	// AuthFailure makes the server reject the login with a NOTICE
+	AuthFailure bool
+	// IgnoreCaps makes the server never acknowledge CAP REQ
+	IgnoreCaps bool
+	// IgnorePings makes the server never answer client PINGs
+	IgnorePings bool
+	// IgnoreJoins makes the server never confirm a JOIN
+	IgnoreJoins bool
+}
+
+// Server speaks enough of twitch's IRC dialect to connect, authenticate, join and chat.
+type Server struct {
+	// URL is the websocket URL clients connect to, e.g. ws://127.0.0.1:1234
+	URL string
+
+	srv *httptest.Server
+
+	mtx         sync.Mutex
+	behaviour   Behaviour
+	conns       map[*conn]struct{}
+	lines       []string
+	changed     chan struct{}
+	connections int
+}
+
+type conn struct {
+	ws     *websocket.Conn
+	mtx    sync.Mutex
+	nick   string
+	cancel context.CancelFunc
+}
+
+// NewServer starts a server listening on localhost. It has to be closed using Close.
+func NewServer() *Server {
+	s := &Server{
+		conns:   make(map[*conn]struct{}),
+		changed: make(chan struct{}),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = "ws" + strings.TrimPrefix(s.srv.URL, "http")
+	return s
+}
+
+// SetBehaviour changes how the server responds, it can be called at any time.
+func (s *Server) SetBehaviour(b Behaviour) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.behaviour = b
+}
+
+// Close disconnects all clients and stops the server.
+func (s *Server) Close() {
+	s.Disconnect()
+	s.srv.Close()
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	c := &conn{ws: ws, cancel: cancel}
+	s.mtx.Lock()
+	s.conns[c] = struct{}{}
+	s.connections++
+	s.notify()
+	s.mtx.Unlock()
+
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, c)
+		s.notify()
+		s.mtx.Unlock()
+		ws.CloseNow()
+	}()
+
+	for {
+		mt, data, err := ws.Read(ctx)
+		if err != nil {
+			return
+		}
+		if mt != websocket.MessageText {
+			continue
+		}
+		for line := range strings.SplitSeq(string(data), "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if line == "" {
+				continue
+			}
+			s.mtx.Lock()
+			s.lines = append(s.lines, line)
+			s.notify()
+			s.mtx.Unlock()
+			s.respond(ctx, c, line)
+		}
+	}
+}
+
+// notify wakes up everyone waiting in WaitFor. s.mtx has to be held.
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// splitLine splits a client line into its command and parameters
+func splitLine(line string) (string, []string) {
+	var trailer *string
+	if idx := strings.Index(line, " :"); idx != -1 {
+		t := line[idx+2:]
+		trailer = &t
+		line = line[:idx]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if trailer != nil {
+		params = append(params, *trailer)
+	}
+	return strings.ToUpper(fields[0]), params
+}
+
+func (s *Server) respond(ctx context.Context, c *conn, line string) {
+	s.mtx.Lock()
+	b := s.behaviour
+	s.mtx.Unlock()
+
+	nick := c.getNick()
+	command, params := splitLine(line)
+	param := func(i int) string {
+		if i < len(params) {
+			return params[i]
+		}
+		return ""
+	}
+
+	switch command {
+	case "CAP":
+		if param(0) == "REQ" && !b.IgnoreCaps {
+			c.write(ctx, fmt.Sprintf(":%s CAP * ACK :%s", host, param(1)))
+		}
+	case "NICK":
+		nick = strings.ToLower(param(0))
+		c.setNick(nick)
+		if b.AuthFailure {
+			c.write(ctx, fmt.Sprintf(":%s NOTICE * :Login authentication failed", host))
+			return
+		}
+		for _, l := range []string{
+			":%[1]s 001 %[2]s :Welcome, GLHF!",
+			":%[1]s 002 %[2]s :Your host is %[1]s",
+			":%[1]s 003 %[2]s :This server is rather new",
+			":%[1]s 004 %[2]s :-",
+			":%[1]s 375 %[2]s :-",
+			":%[1]s 372 %[2]s :You are in a maze of twisty passages, all alike.",
+			":%[1]s 376 %[2]s :>",
+		} {
+			c.write(ctx, fmt.Sprintf(l, host, nick))
+		}
+	case "JOIN":
+		if b.IgnoreJoins {
+			return
+		}
+		for channel := range strings.SplitSeq(param(0), ",") {
+			c.write(ctx, fmt.Sprintf(":%[1]s!%[1]s@%[1]s.%[2]s JOIN %[3]s", nick, host, channel))
+			c.write(ctx, fmt.Sprintf("@badge-info=;badges=;color=;display-name=%[1]s;emote-sets=0;mod=0;subscriber=0;user-type= :%[2]s USERSTATE %[3]s", nick, host, channel))
+			c.write(ctx, fmt.Sprintf("@emote-only=0;followers-only=-1;r9k=0;room-id=12345678;slow=0;subs-only=0 :%s ROOMSTATE %s", host, channel))
+			c.write(ctx, fmt.Sprintf(":%[1]s.%[2]s 353 %[1]s = %[3]s :%[1]s", nick, host, channel))
+			c.write(ctx, fmt.Sprintf(":%[1]s.%[2]s 366 %[1]s %[3]s :End of /NAMES list", nick, host, channel))
+		}
+	case "PART":
+		c.write(ctx, fmt.Sprintf(":%[1]s!%[1]s@%[1]s.%[2]s PART %[3]s", nick, host, param(0)))
+	case "PING":
+		if !b.IgnorePings {
+			c.write(ctx, fmt.Sprintf(":%[1]s PONG %[1]s :%[2]s", host, param(0)))
+		}
+	case "PRIVMSG":
+		c.write(ctx, fmt.Sprintf("@badge-info=;badges=;color=;display-name=%[1]s;emote-sets=0;mod=0;subscriber=0;user-type= :%[2]s USERSTATE %[3]s", nick, host, param(0)))
+	}
+}
+
+func (c *conn) setNick(nick string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.nick = nick
+}
+
+func (c *conn) getNick() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.nick
+}
+
+func (c *conn) write(ctx context.Context, line string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.ws.Write(ctx, websocket.MessageText, []byte(line+"\r\n"))
+}
+
+func (s *Server) clients() []*conn {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		result = append(result, c)
+	}
+	return result
+}
+
+// Send writes the raw line to all connected clients.
+// "{nick}" is replaced with the nick of the respective client.
+func (s *Server) Send(line string) {
+	for _, c := range s.clients() {
+		c.write(context.Background(), strings.ReplaceAll(line, "{nick}", c.getNick()))
+	}
+}
+
+// Privmsg sends a chat message from user to all connected clients.
+func (s *Server) Privmsg(channel, user, text string) {
+	s.Send(fmt.Sprintf("@badges=;display-name=%[1]s;mod=0;room-id=12345678;tmi-sent-ts=1639767497984;user-id=521149409 :%[1]s!%[1]s@%[1]s.%[2]s PRIVMSG #%[3]s :%[4]s", user, host, channel, text))
+}
+
+// Ping sends a PING to all connected clients.
+func (s *Server) Ping() {
+	s.Send(fmt.Sprintf("PING :%s", host))
+}
+
+// Reconnect tells all clients that the server is about to go down.
+func (s *Server) Reconnect() {
+	s.Send(fmt.Sprintf(":%s RECONNECT", host))
+}
+
+// Disconnect drops all connections without a closing handshake.
+func (s *Server) Disconnect() {
+	for _, c := range s.clients() {
+		c.cancel()
+		c.ws.CloseNow()
+	}
+}
+
+// Lines returns every line received from clients.
+func (s *Server) Lines() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return slices.Clone(s.lines)
+}
+
+// Connected returns the number of currently connected clients.
+func (s *Server) Connected() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.conns)
+}
+
+// Connections returns the number of connections accepted since the server started.
+func (s *Server) Connections() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.connections
+}
+
+// WaitFor blocks until cond returns true or ctx is done.
+// cond is evaluated whenever a client connects, disconnects or sends a line.
+func (s *Server) WaitFor(ctx context.Context, cond func(s *Server) bool) error {
+	for {
+		s.mtx.Lock()
+		changed := s.changed
+		s.mtx.Unlock()
+
+		if cond(s) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// WaitForLine blocks until a client sent a line with the given prefix and returns it.
+func (s *Server) WaitForLine(ctx context.Context, prefix string) (string, error) {
+	var result string
+	err := s.WaitFor(ctx, func(s *Server) bool {
+		for _, l := range s.Lines() {
+			if strings.HasPrefix(l, prefix) {
+				result = l
+				return true
+			}
+		}
+		return false
+	})
+	return result, err
+}
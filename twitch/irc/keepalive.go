@@ -0,0 +1,146 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	defaultPingInterval = time.Minute
+	defaultPongTimeout  = time.Second * 10
+)
+
+// ErrPongTimeout is the reason a connection was closed because the server did not answer a PING in time
+var ErrPongTimeout = errors.New("no PONG received in time")
+
+// Health describes the current connection
+type Health struct {
+	Connected bool
+	// ConnectedAt is the time the current connection was authenticated
+	ConnectedAt time.Time
+	// LastReceived is the time the last line was received
+	LastReceived time.Time
+	LastPing     time.Time
+	LastPong     time.Time
+	// Latency is the round-trip time of the last answered PING
+	Latency time.Duration
+	// PongTimeouts counts connections that were closed because a PING was not answered
+	PongTimeouts int
+}
+
+type pendingPing struct {
+	token string
+	sent  time.Time
+	pong  chan struct{}
+}
+
+// Health returns the health of the current connection.
+func (c *ChatClient) Health() Health {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	h := c.health
+	if c.conn != nil {
+		select {
+		case <-c.listenDone:
+		default:
+			h.Connected = true
+		}
+	}
+	return h
+}
+
+// received records that a line was read from the connection
+func (c *ChatClient) received(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.health.LastReceived = now
+}
+
+// pongReceived completes the pending PING if token matches
+func (c *ChatClient) pongReceived(token string, now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.ping == nil || c.ping.token != token {
+		return
+	}
+	c.health.LastPong = now
+	c.health.Latency = now.Sub(c.ping.sent)
+	close(c.ping.pong)
+	c.ping = nil
+}
+
+// keepalive sends a PING every PingInterval until done is closed.
+// If the server does not answer within PongTimeout, conn is closed, which ends the listening go-routine
+// with ErrPongTimeout and lets RunContext reconnect.
+func (c *ChatClient) keepalive(ctx context.Context, conn *websocket.Conn, done <-chan struct{}) {
+	if c.PingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(c.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		ping := &pendingPing{
+			token: strconv.FormatInt(now.UnixNano(), 10),
+			sent:  now,
+			pong:  make(chan struct{}),
+		}
+		c.mtx.Lock()
+		c.ping = ping
+		c.health.LastPing = now
+		c.mtx.Unlock()
+
+		// a failed write breaks the connection, which the listening go-routine notices on its own
+		sendCtx, cancel := context.WithTimeout(ctx, c.PongTimeout)
+		err := c.sendLine(sendCtx, NewLine("PING", ping.token))
+		cancel()
+		if err != nil {
+			c.onError("Could not send ping. %v", err)
+			return
+		}
+
+		timer := time.NewTimer(c.PongTimeout)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-done:
+			timer.Stop()
+			return
+		case <-ping.pong:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		c.mtx.Lock()
+		if c.conn != conn {
+			// the connection was replaced in the meantime
+			c.mtx.Unlock()
+			return
+		}
+		if c.listenErr == nil {
+			c.listenErr = ErrPongTimeout
+		}
+		c.health.PongTimeouts++
+		c.ping = nil
+		c.mtx.Unlock()
+
+		c.onError("No PONG received within %v, closing connection", c.PongTimeout)
+		conn.CloseNow()
+		return
+	}
+}
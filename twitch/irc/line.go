@@ -0,0 +1,148 @@
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrInvalidTag     = errors.New("invalid tag")
+	ErrInvalidPrefix  = errors.New("invalid prefix")
+	ErrInvalidCommand = errors.New("invalid command")
+	ErrInvalidParam   = errors.New("invalid parameter")
+)
+
+// Tag is a single IRCv3 message tag with its unescaped value.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Line is a single IRCv3 protocol line.
+//
+// Lines produced by Encode always parse back to the same Line using ParseLine.
+type Line struct {
+	Tags    []Tag
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// NewLine creates a line without tags and prefix.
+func NewLine(command string, params ...string) Line {
+	return Line{
+		Command: command,
+		Params:  params,
+	}
+}
+
+// WithTag returns a copy of the line with an additional tag.
+func (l Line) WithTag(key, value string) Line {
+	tags := make([]Tag, len(l.Tags), len(l.Tags)+1)
+	copy(tags, l.Tags)
+	l.Tags = append(tags, Tag{Key: key, Value: value})
+	return l
+}
+
+// ParseLine parses a single line without the trailing CR LF.
+func ParseLine(line string) (Line, error) {
+	msg, err := parseIRCv3(line)
+	if err != nil {
+		return Line{}, err
+	}
+	result := Line{
+		Prefix:  msg.Prefix,
+		Command: msg.Command.Name,
+		Params:  msg.Command.Args,
+	}
+	for _, v := range msg.Tags {
+		result.Tags = append(result.Tags, Tag(v))
+	}
+	return result, nil
+}
+
+var tagValueEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	";", `\:`,
+	" ", `\s`,
+	"\r", `\r`,
+	"\n", `\n`,
+)
+
+// escapeTagValue applies the IRCv3 tag value escaping.
+// See https://ircv3.net/specs/extensions/message-tags.html#escaping-values
+func escapeTagValue(value string) string {
+	return tagValueEscaper.Replace(value)
+}
+
+func isValidCommand(command string) bool {
+	if len(command) == 0 {
+		return false
+	}
+	isNumeric := true
+	isAlpha := true
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		isNumeric = isNumeric && c >= '0' && c <= '9'
+		isAlpha = isAlpha && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z')
+	}
+	return isAlpha || (isNumeric && len(command) == 3)
+}
+
+// Encode validates the line and returns its wire representation without the trailing CR LF.
+func (l Line) Encode() (string, error) {
+	sb := strings.Builder{}
+
+	if len(l.Tags) > 0 {
+		sb.WriteByte('@')
+		for i, t := range l.Tags {
+			if t.Key == "" || strings.ContainsAny(t.Key, "= ;\r\n\x00") {
+				return "", fmt.Errorf("%w: key %q", ErrInvalidTag, t.Key)
+			}
+			if strings.ContainsRune(t.Value, 0) {
+				return "", fmt.Errorf("%w: value of %q contains NUL", ErrInvalidTag, t.Key)
+			}
+			if i > 0 {
+				sb.WriteByte(';')
+			}
+			sb.WriteString(t.Key)
+			sb.WriteByte('=')
+			sb.WriteString(escapeTagValue(t.Value))
+		}
+		sb.WriteByte(' ')
+	}
+
+	if l.Prefix != "" {
+		if strings.ContainsAny(l.Prefix, " \r\n\x00") {
+			return "", fmt.Errorf("%w: %q", ErrInvalidPrefix, l.Prefix)
+		}
+		sb.WriteByte(':')
+		sb.WriteString(l.Prefix)
+		sb.WriteByte(' ')
+	}
+
+	if !isValidCommand(l.Command) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidCommand, l.Command)
+	}
+	sb.WriteString(l.Command)
+
+	for i, p := range l.Params {
+		if strings.ContainsAny(p, "\r\n\x00") {
+			return "", fmt.Errorf("%w: %d contains CR, LF or NUL", ErrInvalidParam, i)
+		}
+		sb.WriteByte(' ')
+		needsTrailer := p == "" || p[0] == ':' || strings.ContainsRune(p, ' ')
+		if !needsTrailer {
+			sb.WriteString(p)
+			continue
+		}
+		if i != len(l.Params)-1 {
+			return "", fmt.Errorf("%w: %d must not be empty, contain spaces or start with ':'", ErrInvalidParam, i)
+		}
+		sb.WriteByte(':')
+		sb.WriteString(p)
+	}
+
+	return sb.String(), nil
+}
@@ -0,0 +1,127 @@
+package irc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeLine(t *testing.T) {
+	tests := []struct {
+		line     Line
+		expected string
+	}{
+		{NewLine("PING"), "PING"},
+		{NewLine("JOIN", "#channel"), "JOIN #channel"},
+		{NewLine("PRIVMSG", "#channel", "hello"), "PRIVMSG #channel hello"},
+		{NewLine("PRIVMSG", "#channel", "hello world"), "PRIVMSG #channel :hello world"},
+		{NewLine("PRIVMSG", "#channel", ":)"), "PRIVMSG #channel ::)"},
+		{NewLine("PRIVMSG", "#channel", ""), "PRIVMSG #channel :"},
+		{NewLine("CAP", "REQ", "twitch.tv/tags twitch.tv/commands"), "CAP REQ :twitch.tv/tags twitch.tv/commands"},
+		{Line{Prefix: "tmi.twitch.tv", Command: "376", Params: []string{"nick", ">"}}, ":tmi.twitch.tv 376 nick >"},
+		{
+			NewLine("PRIVMSG", "#channel", "hi").WithTag("reply-parent-msg-id", "b34ccfc7").WithTag("system-msg", `a b;c\d`),
+			`@reply-parent-msg-id=b34ccfc7;system-msg=a\sb\:c\\d PRIVMSG #channel hi`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expected, func(t *testing.T) {
+			actual, err := tt.line.Encode()
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
+
+func TestEncodeLineRejectsInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		line Line
+		err  error
+	}{
+		{"CRLF in trailer", NewLine("PRIVMSG", "#channel", "hi\r\nPRIVMSG #other :spam"), ErrInvalidParam},
+		{"LF in middle", NewLine("PRIVMSG", "#chan\nnel", "hi"), ErrInvalidParam},
+		{"space in middle", NewLine("PRIVMSG", "#chan nel", "hi"), ErrInvalidParam},
+		{"empty middle", NewLine("PRIVMSG", "", "hi"), ErrInvalidParam},
+		{"colon in middle", NewLine("PRIVMSG", ":x", "hi"), ErrInvalidParam},
+		{"NUL", NewLine("PRIVMSG", "#channel", "a\x00b"), ErrInvalidParam},
+		{"empty command", NewLine(""), ErrInvalidCommand},
+		{"command with space", NewLine("PRIVMSG #x"), ErrInvalidCommand},
+		{"mixed command", NewLine("AB1"), ErrInvalidCommand},
+		{"prefix with space", Line{Prefix: "a b", Command: "PING"}, ErrInvalidPrefix},
+		{"tag key with equals", NewLine("PING").WithTag("a=b", "c"), ErrInvalidTag},
+		{"empty tag key", NewLine("PING").WithTag("", "c"), ErrInvalidTag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.line.Encode()
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	line, err := ParseLine(`@badges=;display-name=A\sB :demo!demo@demo.tmi.twitch.tv PRIVMSG #channel :This is a sample message`)
+	require.NoError(t, err)
+	assert.Equal(t, Line{
+		Tags:    []Tag{{Key: "badges", Value: ""}, {Key: "display-name", Value: "A B"}},
+		Prefix:  "demo!demo@demo.tmi.twitch.tv",
+		Command: "PRIVMSG",
+		Params:  []string{"#channel", "This is a sample message"},
+	}, line)
+}
+
+func normalizeLine(l Line) Line {
+	if len(l.Tags) == 0 {
+		l.Tags = nil
+	}
+	if len(l.Params) == 0 {
+		l.Params = nil
+	}
+	return l
+}
+
+func FuzzLineRoundTrip(f *testing.F) {
+	f.Add("display-name", `A B;\`, "demo!demo@demo.tmi.twitch.tv", "PRIVMSG", "#channel", "hello world")
+	f.Add("", "", "", "PING", "tmi.twitch.tv", "")
+	f.Add("k", "\r\n", "tmi.twitch.tv", "376", "nick", ":)")
+	f.Fuzz(func(t *testing.T, tagKey, tagValue, prefix, command, middle, trailer string) {
+		line := Line{Prefix: prefix, Command: command}
+		if tagKey != "" {
+			line = line.WithTag(tagKey, tagValue)
+		}
+		if middle != "" {
+			line.Params = append(line.Params, middle)
+		}
+		line.Params = append(line.Params, trailer)
+
+		encoded, err := line.Encode()
+		if err != nil {
+			return
+		}
+		parsed, err := ParseLine(encoded)
+		require.NoError(t, err, encoded)
+		assert.Equal(t, normalizeLine(line), normalizeLine(parsed), encoded)
+	})
+}
+
+func FuzzParseLine(f *testing.F) {
+	f.Add(`PING :tmi.twitch.tv`)
+	f.Add(`:demo!demo@demo.tmi.twitch.tv PRIVMSG #channel :This is a sample message`)
+	f.Add(`@badge-info=;badges=premium/1;color=;display-name=Demo;emotes=;first-msg=0 :demo!demo@demo.tmi.twitch.tv PRIVMSG #channel :haha ;D`)
+	f.Add(`@msg-id=raid;system-msg=15\sraiders\:\\ :tmi.twitch.tv USERNOTICE #channel`)
+	f.Fuzz(func(t *testing.T, raw string) {
+		line, err := ParseLine(raw)
+		if err != nil {
+			return
+		}
+		encoded, err := line.Encode()
+		if err != nil {
+			return
+		}
+		reparsed, err := ParseLine(encoded)
+		require.NoError(t, err, encoded)
+		assert.Equal(t, normalizeLine(line), normalizeLine(reparsed), encoded)
+	})
+}
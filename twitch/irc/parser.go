@@ -41,7 +41,7 @@ func parseTags(msg string) ([]ircTag, error) {
 		if idxSemi == -1 {
 			idxSemi = len(msg)
 		}
-		value := msg[:idxSemi]
+		value := unescapeTagValue(msg[:idxSemi])
 		result = append(result, ircTag{
 			Key:   key,
 			Value: value,
@@ -2,6 +2,7 @@ package irc
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -116,3 +117,62 @@ func TestParsePrivMsgWithTagsEndingEmpty(t *testing.T) {
 	assertTag(t, msg.Tags[14], "user-id", "521149409")
 	assertTag(t, msg.Tags[15], "user-type", "")
 }
+
+func TestParseTagsUnescapesValues(t *testing.T) {
+
+	msg, err := parseIRCv3(`@display-name=A\sB;system-msg=5\sraiders\sfrom\sdemo\:\shi\\there\r\n;reply-parent-msg-body=trailing\;broken=a\qb :tmi.twitch.tv USERNOTICE #channel`)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	assertTag(t, msg.Tags[0], "display-name", "A B")
+	assertTag(t, msg.Tags[1], "system-msg", "5 raiders from demo; hi\\there\r\n")
+	assertTag(t, msg.Tags[2], "reply-parent-msg-body", "trailing")
+	assertTag(t, msg.Tags[3], "broken", "aqb")
+}
+
+func TestMessageTagAccessors(t *testing.T) {
+
+	msg := &Message{
+		Sender: "demo",
+		Tags: map[string]string{
+			TagBadgeInfo:   "subscriber/14",
+			TagBadges:      "moderator/1,subscriber/12,vip/1",
+			TagBits:        "100",
+			TagEmotes:      "25:0-4,12-16/1902:6-10",
+			TagFirstMsg:    "1",
+			TagMod:         "1",
+			TagRoomID:      "67027439",
+			TagTmiSentTs:   "1639767497984",
+			TagUserID:      "521149409",
+			TagDisplayName: "",
+		},
+	}
+
+	assert.Equal(t, map[string]string{"moderator": "1", "subscriber": "12", "vip": "1"}, msg.Badges())
+	assert.Equal(t, map[string]string{"subscriber": "14"}, msg.BadgeInfo())
+	assert.Equal(t, []EmoteRange{
+		{ID: "25", Start: 0, End: 4},
+		{ID: "25", Start: 12, End: 16},
+		{ID: "1902", Start: 6, End: 10},
+	}, msg.Emotes())
+	assert.Equal(t, 100, msg.Bits())
+	assert.Equal(t, "521149409", msg.UserID())
+	assert.Equal(t, "67027439", msg.RoomID())
+	assert.Equal(t, "demo", msg.DisplayName())
+	assert.Equal(t, time.UnixMilli(1639767497984), msg.SentAt())
+	assert.True(t, msg.IsMod())
+	assert.True(t, msg.IsSubscriber())
+	assert.True(t, msg.IsVIP())
+	assert.True(t, msg.IsFirstMessage())
+	assert.False(t, msg.IsBroadcaster())
+
+	empty := &Message{Tags: map[string]string{}}
+	assert.Empty(t, empty.Badges())
+	assert.Nil(t, empty.Emotes())
+	assert.Equal(t, 0, empty.Bits())
+	assert.True(t, empty.SentAt().IsZero())
+	assert.False(t, empty.IsMod())
+	assert.False(t, empty.IsSubscriber())
+	assert.False(t, empty.IsVIP())
+}
@@ -0,0 +1,177 @@
+package irc
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ConnectionState is the state of a supervised connection, see RunContext
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateConnected
+	StateJoined
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateJoined:
+		return "joined"
+	}
+	return "unknown"
+}
+
+// StateChange is reported through OnStateChange
+type StateChange struct {
+	State ConnectionState
+	// Channel is set for StateJoined
+	Channel string
+	// Attempt is the number of the current connection attempt, set for StateConnecting
+	Attempt int
+	// Err is the reason for StateDisconnected
+	Err error
+	// RetryIn is the time until the next connection attempt, set for StateDisconnected
+	RetryIn time.Duration
+}
+
+func normalizeChannel(channel string) string {
+	return strings.ToLower(strings.TrimPrefix(channel, "#"))
+}
+
+func (c *ChatClient) addChannel(channel string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.channels[channel] = struct{}{}
+}
+
+// joinedChannels returns all channels that should be joined after (re-)connecting
+func (c *ChatClient) joinedChannels() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	result := make([]string, 0, len(c.channels))
+	for channel := range c.channels {
+		result = append(result, channel)
+	}
+	slices.Sort(result)
+	return result
+}
+
+func (c *ChatClient) setState(change StateChange) {
+	if c.OnStateChange != nil {
+		c.OnStateChange(change)
+	}
+}
+
+// reconnectDelay returns the exponential backoff for the attempt with up to 50% jitter.
+func (c *ChatClient) reconnectDelay(attempt int) time.Duration {
+	delay := c.MinReconnectDelay
+	for i := 1; i < attempt && delay < c.MaxReconnectDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.MaxReconnectDelay)
+	if delay <= 0 {
+		return 0
+	}
+	half := delay / 2
+	return half + rand.N(half+1)
+}
+
+// Reconnects returns the number of times RunContext connected again after a connection was lost.
+func (c *ChatClient) Reconnects() uint64 {
+	return c.reconnects.Load()
+}
+
+// RunContext connects to url, joins all channels and keeps the connection alive until ctx is cancelled.
+//
+// Lost connections and RECONNECT requests by twitch are handled by reconnecting with exponential backoff,
+// requesting the capabilities, authenticating and joining all previously joined channels again.
+// The client is closed once RunContext returns.
+func (c *ChatClient) RunContext(ctx context.Context, url string, channels ...string) error {
+	for _, channel := range channels {
+		c.addChannel(normalizeChannel(channel))
+	}
+	defer c.Close()
+
+	attempt := 0
+	connected := false
+	for {
+		attempt++
+		c.setState(StateChange{State: StateConnecting, Attempt: attempt})
+
+		err := c.OpenContext(ctx, url)
+		if err == nil {
+			if connected {
+				c.reconnects.Add(1)
+			}
+			connected = true
+			attempt = 0
+			c.setState(StateChange{State: StateConnected})
+			err = c.waitForDisconnect(ctx, c.rejoin(ctx, c.joinedChannels()))
+		}
+		if ctx.Err() != nil {
+			c.setState(StateChange{State: StateDisconnected, Err: ctx.Err()})
+			return nil
+		}
+
+		delay := c.reconnectDelay(max(attempt, 1))
+		c.setState(StateChange{State: StateDisconnected, Err: err, RetryIn: delay})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+	}
+}
+
+// rejoin joins channels and returns the ones that could not be joined
+func (c *ChatClient) rejoin(ctx context.Context, channels []string) []string {
+	var failed []string
+	for _, channel := range channels {
+		if err := c.JoinContext(ctx, channel); err != nil {
+			c.onError("failed to join %q. %v", channel, err)
+			failed = append(failed, channel)
+			continue
+		}
+		c.setState(StateChange{State: StateJoined, Channel: channel})
+	}
+	return failed
+}
+
+// waitForDisconnect blocks until the current connection is lost and returns the reason.
+// Meanwhile the channels that could not be joined are joined again using the reconnect backoff.
+func (c *ChatClient) waitForDisconnect(ctx context.Context, failed []string) error {
+	c.mtx.Lock()
+	done := c.listenDone
+	c.mtx.Unlock()
+
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+	for attempt := 1; ; attempt++ {
+		retry.Stop()
+		if len(failed) > 0 {
+			retry.Reset(c.reconnectDelay(attempt))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-done:
+			return c.connectionLost()
+		case <-retry.C:
+			failed = c.rejoin(ctx, failed)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	c := &ChatClient{
+		MinReconnectDelay: time.Second,
+		MaxReconnectDelay: time.Second * 30,
+	}
+
+	for attempt, expected := range map[int]time.Duration{
+		1:  time.Second,
+		2:  time.Second * 2,
+		3:  time.Second * 4,
+		5:  time.Second * 16,
+		6:  time.Second * 30,
+		50: time.Second * 30,
+	} {
+		for range 20 {
+			delay := c.reconnectDelay(attempt)
+			assert.GreaterOrEqual(t, delay, expected/2, "attempt %d", attempt)
+			assert.LessOrEqual(t, delay, expected, "attempt %d", attempt)
+		}
+	}
+}
+
+func TestNormalizeChannel(t *testing.T) {
+	assert.Equal(t, "channel", normalizeChannel("#Channel"))
+	assert.Equal(t, "channel", normalizeChannel("channel"))
+}
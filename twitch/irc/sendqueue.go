@@ -0,0 +1,482 @@
+package irc
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrQueueFull      = errors.New("send queue is full")
+	ErrMessageExpired = errors.New("message expired before it could be sent")
+	ErrClientClosed   = errors.New("client closed")
+)
+
+// Priority of queued messages, higher priorities are sent first.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+const (
+	// MaxMessageLength is the maximum number of characters twitch allows per message.
+	// Longer messages are split into multiple messages.
+	MaxMessageLength = 500
+
+	// twitch allows 20 messages per 30 seconds, or 100 in channels where the user is moderator or broadcaster
+	rateLimitWindow   = time.Second * 30
+	rateLimitUser     = 20
+	rateLimitOp       = 100
+	rateLimitChannel  = time.Second
+	duplicateWindow   = time.Second * 30
+	maxQueueSize      = 100
+	maxQueueAge       = time.Minute * 2
+	notConnectedRetry = time.Second
+
+	// appended to a message that is identical to the previous one,
+	// twitch would drop it otherwise. Chat clients do not render it.
+	duplicateSuffix = " \U000E0000"
+)
+
+// SendOptions control how a message is queued
+type SendOptions struct {
+	Priority Priority
+	// OnResult is called from the sending go-routine for every part of the message
+	// once it was sent or dropped. It must not block.
+	OnResult func(SendResult)
+}
+
+// SendResult is the outcome of sending a single message part
+type SendResult struct {
+	Channel string
+	// Content is the content that was sent, it may be modified to avoid duplicate message rejection.
+	Content string
+	// Part is the 1-based index of this part, Parts the number of parts the message was split into
+	Part  int
+	Parts int
+	Err   error
+}
+
+type queuedMessage struct {
+	id       uint64
+	channel  string
+	content  string
+	part     int
+	parts    int
+	priority Priority
+	queuedAt time.Time
+	onResult func(SendResult)
+	// reservations are the rate limit tokens taken by next, they are returned if sending fails to connect
+	reservations []*rate.Reservation
+}
+
+type lastSent struct {
+	content string
+	at      time.Time
+}
+
+// sendQueue sends PRIVMSGs at the rate twitch accepts them.
+type sendQueue struct {
+	mtx     sync.Mutex
+	items   []*queuedMessage
+	lastID  uint64
+	wake    chan struct{}
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	userLimiter     *rate.Limiter
+	opLimiter       *rate.Limiter
+	channelLimiters map[string]*rate.Limiter
+	lastSent        map[string]lastSent
+}
+
+func newSendQueue() *sendQueue {
+	return &sendQueue{
+		wake:            make(chan struct{}, 1),
+		userLimiter:     rate.NewLimiter(rate.Every(rateLimitWindow/rateLimitUser), rateLimitUser),
+		opLimiter:       rate.NewLimiter(rate.Every(rateLimitWindow/rateLimitOp), rateLimitOp),
+		channelLimiters: make(map[string]*rate.Limiter),
+		lastSent:        make(map[string]lastSent),
+	}
+}
+
+// splitMessage splits content into parts of at most MaxMessageLength characters,
+// preferably at spaces.
+func splitMessage(content string) []string {
+	var parts []string
+	for utf8.RuneCountInString(content) > MaxMessageLength {
+		// byte offset of the first rune that no longer fits
+		cut := 0
+		for i := 0; i < MaxMessageLength; i++ {
+			_, size := utf8.DecodeRuneInString(content[cut:])
+			cut += size
+		}
+		if idx := strings.LastIndexByte(content[:cut], ' '); idx > 0 {
+			parts = append(parts, content[:idx])
+			content = strings.TrimLeft(content[idx:], " ")
+			continue
+		}
+		parts = append(parts, content[:cut])
+		content = content[cut:]
+	}
+	if content != "" || len(parts) == 0 {
+		parts = append(parts, content)
+	}
+	return parts
+}
+
+// Send queues the message for channel. Messages are sent as soon as twitch's rate limits allow it.
+func (c *ChatClient) Send(channel, content string) error {
+	return c.SendWithOptions(channel, content, SendOptions{})
+}
+
+// SendWithOptions queues the message for channel with the given priority.
+// Messages longer than MaxMessageLength are split.
+func (c *ChatClient) SendWithOptions(channel, content string, opts SendOptions) error {
+	_, err := c.enqueue(channel, content, opts)
+	return err
+}
+
+// enqueue queues all parts of the message under a common id
+func (c *ChatClient) enqueue(channel, content string, opts SendOptions) (uint64, error) {
+	if c.readOnly {
+		return 0, ErrReadOnly
+	}
+	if c.cannotEdit {
+		return 0, ErrMissingScope
+	}
+	channel = normalizeChannel(channel)
+	if _, err := NewLine(CommandPrivMsg, "#"+channel, content).Encode(); err != nil {
+		return 0, err
+	}
+
+	q := c.queue
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	parts := splitMessage(content)
+	if len(q.items)+len(parts) > maxQueueSize {
+		c.rateLimited.Add(1)
+		return 0, ErrQueueFull
+	}
+
+	q.lastID++
+	id := q.lastID
+	now := time.Now()
+	for i, part := range parts {
+		item := &queuedMessage{
+			id:       id,
+			channel:  channel,
+			content:  part,
+			part:     i + 1,
+			parts:    len(parts),
+			priority: opts.Priority,
+			queuedAt: now,
+			onResult: opts.OnResult,
+		}
+		q.insert(item)
+	}
+
+	if !q.running {
+		q.running = true
+		ctx, cancel := context.WithCancel(context.Background())
+		q.cancel = cancel
+		q.done = make(chan struct{})
+		go c.runSendQueue(ctx, q.done)
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return id, nil
+}
+
+// SendTimeout queues the message and waits until all parts were sent.
+// If that takes longer than timeout, the remaining parts are dropped and ErrRateExceeded is returned.
+func (c *ChatClient) SendTimeout(channel, content string, timeout time.Duration) error {
+	// every part reports exactly once, so this never blocks the sending go-routine
+	results := make(chan SendResult, len(splitMessage(content)))
+	id, err := c.enqueue(channel, content, SendOptions{
+		Priority: PriorityHigh,
+		OnResult: func(sr SendResult) { results <- sr },
+	})
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case sr := <-results:
+			if sr.Err != nil {
+				return sr.Err
+			}
+			if sr.Part == sr.Parts {
+				return nil
+			}
+		case <-timer.C:
+			c.queue.removeWhere(func(item *queuedMessage) bool { return item.id == id })
+			c.rateLimited.Add(1)
+			return ErrRateExceeded
+		}
+	}
+}
+
+// RateLimited returns the number of messages that were rejected or dropped
+// because the rate limits did not allow sending them in time.
+func (c *ChatClient) RateLimited() uint64 {
+	return c.rateLimited.Load()
+}
+
+// QueueLength returns the number of messages waiting to be sent.
+func (c *ChatClient) QueueLength() int {
+	c.queue.mtx.Lock()
+	defer c.queue.mtx.Unlock()
+	return len(c.queue.items)
+}
+
+// insert keeps the queue ordered by priority, FIFO within the same priority. q.mtx must be held.
+func (q *sendQueue) insert(item *queuedMessage) {
+	idx := len(q.items)
+	for idx > 0 && item.before(q.items[idx-1]) {
+		idx--
+	}
+	q.items = slices.Insert(q.items, idx, item)
+}
+
+// before reports whether item is sent before other
+func (item *queuedMessage) before(other *queuedMessage) bool {
+	if item.priority != other.priority {
+		return item.priority > other.priority
+	}
+	if item.id != other.id {
+		return item.id < other.id
+	}
+	return item.part < other.part
+}
+
+func (q *sendQueue) removeWhere(fn func(*queuedMessage) bool) []*queuedMessage {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	var removed []*queuedMessage
+	kept := q.items[:0]
+	for _, item := range q.items {
+		if fn(item) {
+			removed = append(removed, item)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	clear(q.items[len(kept):])
+	q.items = kept
+	return removed
+}
+
+// stop ends the sending go-routine and drops all pending messages.
+func (q *sendQueue) stop() {
+	q.mtx.Lock()
+	running := q.running
+	cancel, done := q.cancel, q.done
+	q.running = false
+	q.mtx.Unlock()
+
+	if running {
+		cancel()
+		<-done
+	}
+	for _, item := range q.removeWhere(func(*queuedMessage) bool { return true }) {
+		item.report("", ErrClientClosed)
+	}
+}
+
+func (item *queuedMessage) report(content string, err error) {
+	if item.onResult == nil {
+		return
+	}
+	if content == "" {
+		content = item.content
+	}
+	item.onResult(SendResult{
+		Channel: item.channel,
+		Content: content,
+		Part:    item.part,
+		Parts:   item.parts,
+		Err:     err,
+	})
+}
+
+// channelLimiter returns the per channel limiter, slow mode is respected for regular users.
+func (c *ChatClient) channelLimiter(channel string) *rate.Limiter {
+	interval := rateLimitChannel
+	if state, ok := c.ChannelState(channel); ok && state.Slow > interval {
+		interval = state.Slow
+	}
+	limiter, ok := c.queue.channelLimiters[channel]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Every(interval), 1)
+		c.queue.channelLimiters[channel] = limiter
+	} else if limiter.Limit() != rate.Every(interval) {
+		limiter.SetLimit(rate.Every(interval))
+	}
+	return limiter
+}
+
+// reserve returns how long the message has to wait before it may be sent.
+// If no waiting is required, the rate limit tokens are consumed and kept in item.reservations.
+func (c *ChatClient) reserve(item *queuedMessage, now time.Time) time.Duration {
+	limiters := []*rate.Limiter{c.queue.opLimiter}
+	if !c.isOp(c.Nick, item.channel) {
+		limiters = append(limiters, c.queue.userLimiter, c.channelLimiter(item.channel))
+	}
+
+	var delay time.Duration
+	reservations := make([]*rate.Reservation, 0, len(limiters))
+	for _, l := range limiters {
+		r := l.ReserveN(now, 1)
+		reservations = append(reservations, r)
+		delay = max(delay, r.DelayFrom(now))
+	}
+	if delay > 0 {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+		return delay
+	}
+	item.reservations = reservations
+	return 0
+}
+
+// requeue puts item back into the queue and returns the rate limit tokens it took
+func (c *ChatClient) requeue(item *queuedMessage, now time.Time) {
+	for _, r := range item.reservations {
+		r.CancelAt(now)
+	}
+	item.reservations = nil
+	q := c.queue
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.insert(item)
+}
+
+// connected reports whether there is a connection to send messages to
+func (c *ChatClient) connected() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.conn != nil
+}
+
+// dedupe modifies content if it is identical to the last message in the channel.
+// Content at MaxMessageLength loses its last characters to make room for duplicateSuffix.
+func (q *sendQueue) dedupe(channel, content string, now time.Time) string {
+	last, ok := q.lastSent[channel]
+	if ok && now.Sub(last.at) < duplicateWindow && last.content == content {
+		if limit := MaxMessageLength - utf8.RuneCountInString(duplicateSuffix); utf8.RuneCountInString(content) > limit {
+			cut := 0
+			for range limit {
+				_, size := utf8.DecodeRuneInString(content[cut:])
+				cut += size
+			}
+			content = content[:cut]
+		}
+		return content + duplicateSuffix
+	}
+	return content
+}
+
+// next removes and returns the first message that may be sent right now.
+// Otherwise it returns the time to wait for the next message to become ready, or -1 if the queue is empty.
+func (c *ChatClient) next(now time.Time) (*queuedMessage, time.Duration) {
+	c.expire(now)
+
+	q := c.queue
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	wait := time.Duration(-1)
+	for i, item := range q.items {
+		delay := c.reserve(item, now)
+		if delay == 0 {
+			q.items = slices.Delete(q.items, i, i+1)
+			return item, 0
+		}
+		if wait < 0 || delay < wait {
+			wait = delay
+		}
+	}
+	return nil, wait
+}
+
+// expire drops messages that waited longer than maxQueueAge
+func (c *ChatClient) expire(now time.Time) {
+	expired := c.queue.removeWhere(func(item *queuedMessage) bool {
+		return now.Sub(item.queuedAt) > maxQueueAge
+	})
+	for _, item := range expired {
+		c.rateLimited.Add(1)
+		item.report("", ErrMessageExpired)
+	}
+}
+
+func (c *ChatClient) runSendQueue(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	q := c.queue
+
+	for {
+		var item *queuedMessage
+		wait := notConnectedRetry
+		if c.connected() {
+			item, wait = c.next(time.Now())
+		} else {
+			// no rate limit tokens are taken until the connection is back
+			c.expire(time.Now())
+			if c.QueueLength() == 0 {
+				wait = -1
+			}
+		}
+		if item == nil {
+			if wait < 0 {
+				// nothing queued, wait for new messages
+				wait = maxQueueAge
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-q.wake:
+			case <-timer.C:
+			}
+			timer.Stop()
+			continue
+		}
+
+		now := time.Now()
+		q.mtx.Lock()
+		content := q.dedupe(item.channel, item.content, now)
+		q.mtx.Unlock()
+
+		err := c.sendLine(ctx, NewLine(CommandPrivMsg, "#"+item.channel, content))
+		if errors.Is(err, ErrNotConnected) {
+			// the connection was lost meanwhile, keep the message until it is back or the message expires
+			c.requeue(item, time.Now())
+			continue
+		}
+		if err == nil {
+			q.mtx.Lock()
+			q.lastSent[item.channel] = lastSent{content: content, at: now}
+			q.mtx.Unlock()
+		}
+		item.report(content, err)
+	}
+}
@@ -0,0 +1,215 @@
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newQueueTestClient returns a client whose queue is processed manually using next
+func newQueueTestClient() *ChatClient {
+	c := newClient("bot", "token")
+	c.queue.running = true
+	return c
+}
+
+func TestSplitMessage(t *testing.T) {
+	assert.Equal(t, []string{"hello"}, splitMessage("hello"))
+	assert.Equal(t, []string{""}, splitMessage(""))
+
+	words := strings.Repeat("word ", 150) // 750 characters
+	parts := splitMessage(words)
+	require.Len(t, parts, 2)
+	for _, p := range parts {
+		assert.LessOrEqual(t, utf8.RuneCountInString(p), MaxMessageLength)
+		assert.False(t, strings.HasPrefix(p, " "))
+		assert.True(t, strings.HasPrefix(p, "word"))
+	}
+
+	// no spaces, multi-byte runes must not be cut in half
+	long := strings.Repeat("ä", 1200)
+	parts = splitMessage(long)
+	require.Len(t, parts, 3)
+	assert.Equal(t, MaxMessageLength, utf8.RuneCountInString(parts[0]))
+	assert.Equal(t, MaxMessageLength, utf8.RuneCountInString(parts[1]))
+	assert.Equal(t, 200, utf8.RuneCountInString(parts[2]))
+	assert.Equal(t, long, strings.Join(parts, ""))
+}
+
+func TestSendQueueOrdersByPriority(t *testing.T) {
+	c := newQueueTestClient()
+	require.NoError(t, c.SendWithOptions("a", "low", SendOptions{Priority: PriorityLow}))
+	require.NoError(t, c.Send("b", "normal 1"))
+	require.NoError(t, c.SendWithOptions("c", "high", SendOptions{Priority: PriorityHigh}))
+	require.NoError(t, c.Send("d", "normal 2"))
+	assert.Equal(t, 4, c.QueueLength())
+
+	now := time.Now()
+	var order []string
+	for {
+		item, _ := c.next(now)
+		if item == nil {
+			break
+		}
+		order = append(order, item.content)
+	}
+	assert.Equal(t, []string{"high", "normal 1", "normal 2", "low"}, order)
+}
+
+func TestSendQueueChannelRateLimit(t *testing.T) {
+	c := newQueueTestClient()
+	require.NoError(t, c.Send("channel", "first"))
+	require.NoError(t, c.Send("channel", "second"))
+	require.NoError(t, c.Send("other", "third"))
+
+	now := time.Now()
+	item, _ := c.next(now)
+	require.NotNil(t, item)
+	assert.Equal(t, "first", item.content)
+
+	// the channel is limited to one message per second, other channels are not affected
+	item, _ = c.next(now)
+	require.NotNil(t, item)
+	assert.Equal(t, "third", item.content)
+
+	item, wait := c.next(now)
+	assert.Nil(t, item)
+	assert.Greater(t, wait, time.Duration(0))
+	assert.LessOrEqual(t, wait, rateLimitChannel)
+
+	item, _ = c.next(now.Add(rateLimitChannel))
+	require.NotNil(t, item)
+	assert.Equal(t, "second", item.content)
+}
+
+func TestSendQueueOpIsNotLimitedPerChannel(t *testing.T) {
+	c := newQueueTestClient()
+	require.NoError(t, c.Send("bot", "first"))
+	require.NoError(t, c.Send("bot", "second"))
+
+	now := time.Now()
+	for _, expected := range []string{"first", "second"} {
+		item, _ := c.next(now)
+		require.NotNil(t, item)
+		assert.Equal(t, expected, item.content)
+	}
+}
+
+func TestSendQueueDedupe(t *testing.T) {
+	q := newSendQueue()
+	now := time.Now()
+
+	assert.Equal(t, "hello", q.dedupe("channel", "hello", now))
+	q.lastSent["channel"] = lastSent{content: "hello", at: now}
+	assert.Equal(t, "hello"+duplicateSuffix, q.dedupe("channel", "hello", now.Add(time.Second)))
+	assert.Equal(t, "hello", q.dedupe("other", "hello", now.Add(time.Second)))
+	assert.Equal(t, "hello", q.dedupe("channel", "hello", now.Add(duplicateWindow)))
+
+	q.lastSent["channel"] = lastSent{content: "hello" + duplicateSuffix, at: now}
+	assert.Equal(t, "hello", q.dedupe("channel", "hello", now.Add(time.Second)))
+}
+
+func TestSendQueueDedupeKeepsLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		kept    string
+	}{
+		{name: "short", content: "hello", kept: "hello"},
+		{name: "below limit", content: strings.Repeat("a", MaxMessageLength-2), kept: strings.Repeat("a", MaxMessageLength-2)},
+		{name: "at limit", content: strings.Repeat("a", MaxMessageLength), kept: strings.Repeat("a", MaxMessageLength-2)},
+		{name: "multi-byte runes", content: strings.Repeat("ä", MaxMessageLength), kept: strings.Repeat("ä", MaxMessageLength-2)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newSendQueue()
+			now := time.Now()
+			q.lastSent["channel"] = lastSent{content: tt.content, at: now}
+
+			content := q.dedupe("channel", tt.content, now.Add(time.Second))
+			assert.Equal(t, tt.kept+duplicateSuffix, content)
+			assert.LessOrEqual(t, utf8.RuneCountInString(content), MaxMessageLength)
+		})
+	}
+}
+
+func TestSendQueueDuplicateSplitPart(t *testing.T) {
+	c := newQueueTestClient()
+	part := strings.Repeat("a", MaxMessageLength)
+	require.NoError(t, c.Send("channel", part+part))
+
+	now := time.Now()
+	first, _ := c.next(now)
+	require.NotNil(t, first)
+	sent := c.queue.dedupe(first.channel, first.content, now)
+	assert.Equal(t, part, sent)
+	c.queue.lastSent[first.channel] = lastSent{content: sent, at: now}
+
+	second, _ := c.next(now.Add(rateLimitChannel))
+	require.NotNil(t, second)
+	sent = c.queue.dedupe(second.channel, second.content, now.Add(rateLimitChannel))
+	assert.NotEqual(t, part, sent)
+	assert.Equal(t, MaxMessageLength, utf8.RuneCountInString(sent))
+}
+
+func TestSendQueueRejectsInvalidContent(t *testing.T) {
+	c := newQueueTestClient()
+	assert.ErrorIs(t, c.Send("channel", "hi\r\nJOIN #other"), ErrInvalidParam)
+	assert.Equal(t, 0, c.QueueLength())
+}
+
+func TestSendQueueFull(t *testing.T) {
+	c := newQueueTestClient()
+	for range maxQueueSize {
+		require.NoError(t, c.Send("channel", "spam"))
+	}
+	assert.ErrorIs(t, c.Send("channel", "spam"), ErrQueueFull)
+	assert.Equal(t, uint64(1), c.RateLimited())
+}
+
+func TestSendQueueRequeueKeepsOrderAndRateLimit(t *testing.T) {
+	c := newQueueTestClient()
+	require.NoError(t, c.Send("channel", "normal 1"))
+	require.NoError(t, c.SendWithOptions("channel", "high", SendOptions{Priority: PriorityHigh}))
+	require.NoError(t, c.Send("channel", "normal 2"))
+	require.NoError(t, c.SendWithOptions("channel", "low", SendOptions{Priority: PriorityLow}))
+
+	now := time.Now()
+	var order []string
+	for {
+		item, _ := c.next(now)
+		if item == nil {
+			break
+		}
+		// the connection was lost while sending, the channel's rate limit allows sending it again right away
+		c.requeue(item, now)
+		item, _ = c.next(now)
+		require.NotNil(t, item)
+		order = append(order, item.content)
+		now = now.Add(rateLimitChannel)
+	}
+	assert.Equal(t, []string{"high", "normal 1", "normal 2", "low"}, order)
+
+	// messages queued meanwhile with a higher priority are sent first
+	require.NoError(t, c.Send("other", "normal 3"))
+	item, _ := c.next(now)
+	require.NotNil(t, item)
+	require.NoError(t, c.SendWithOptions("other", "high 2", SendOptions{Priority: PriorityHigh}))
+	c.requeue(item, now)
+	item, _ = c.next(now)
+	require.NotNil(t, item)
+	assert.Equal(t, "high 2", item.content)
+}
+
+func TestSendNotConnected(t *testing.T) {
+	c := newClient("bot", "token")
+	var sent []string
+	c.OnSend = func(command string) { sent = append(sent, command) }
+
+	assert.ErrorIs(t, c.sendLine(t.Context(), NewLine(CommandPrivMsg, "#channel", "hello")), ErrNotConnected)
+	assert.Empty(t, sent)
+}
@@ -0,0 +1,244 @@
+package irc
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TagBadgeInfo ...
+	TagBadgeInfo string = "badge-info"
+	// TagBadges ...
+	TagBadges string = "badges"
+	// TagBits amount of bits cheered with the message
+	TagBits string = "bits"
+	// TagColor ...
+	TagColor string = "color"
+	// TagDisplayName ...
+	TagDisplayName string = "display-name"
+	// TagEmotes ...
+	TagEmotes string = "emotes"
+	// TagFirstMsg 1 if this is the first message the user has ever sent in the channel; otherwise, 0.
+	TagFirstMsg string = "first-msg"
+	// TagFlags ...
+	TagFlags string = "flags"
+	// TagID unique id of the message
+	TagID string = "id"
+	// TagMod 1 if the user is a moderator; otherwise, 0.
+	TagMod string = "mod"
+	// TagRoomID id of the channel the message was sent in
+	TagRoomID string = "room-id"
+	// TagSubscriber 1 if the user has a subscriber badge; otherwise, 0.
+	//
+	// [deprecated] use badges
+	TagSubscriber string = "subscriber"
+	// TagTmiSentTs unix timestamp in milliseconds of when the message was sent
+	TagTmiSentTs string = "tmi-sent-ts"
+	// TagUserID id of the user that sent the message
+	TagUserID string = "user-id"
+	// TagVIP is only present (with value 1) if the user is a VIP
+	TagVIP string = "vip"
+)
+
+const (
+	BadgeBroadcaster = "broadcaster"
+	BadgeFounder     = "founder"
+	BadgeModerator   = "moderator"
+	BadgeSubscriber  = "subscriber"
+	BadgeVIP         = "vip"
+)
+
+// EmoteRange is the position of a single emote occurrence inside the message text.
+// Start and End are inclusive rune offsets.
+type EmoteRange struct {
+	ID    string
+	Start int
+	End   int
+}
+
+// unescapeTagValue reverses the IRCv3 tag value escaping.
+// See https://ircv3.net/specs/extensions/message-tags.html#escaping-values
+func unescapeTagValue(value string) string {
+	if !strings.ContainsRune(value, '\\') {
+		return value
+	}
+	sb := strings.Builder{}
+	sb.Grow(len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			sb.WriteByte(value[i])
+			continue
+		}
+		i++
+		if i == len(value) {
+			// a trailing backslash is dropped
+			break
+		}
+		switch value[i] {
+		case ':':
+			sb.WriteByte(';')
+		case 's':
+			sb.WriteByte(' ')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'n':
+			sb.WriteByte('\n')
+		default:
+			// covers "\\" as well as invalid escapes, which drop the backslash
+			sb.WriteByte(value[i])
+		}
+	}
+	return sb.String()
+}
+
+// parseBadges parses a list of "badge/version" pairs as used in
+// the badges and badge-info tags.
+func parseBadges(value string) map[string]string {
+	result := make(map[string]string)
+	if value == "" {
+		return result
+	}
+	for badge := range strings.SplitSeq(value, ",") {
+		name, version, _ := strings.Cut(badge, "/")
+		if name == "" {
+			continue
+		}
+		result[name] = version
+	}
+	return result
+}
+
+// Tag returns the value of the tag and whether it was present.
+func (m *Message) Tag(key string) (string, bool) {
+	v, ok := m.Tags[key]
+	return v, ok
+}
+
+func (m *Message) tagFlag(key string) bool {
+	return m.Tags[key] == "1"
+}
+
+func (m *Message) tagInt(key string) int {
+	v, err := strconv.Atoi(m.Tags[key])
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// Badges returns the badges of the sender mapped to their version.
+func (m *Message) Badges() map[string]string {
+	return parseBadges(m.Tags[TagBadges])
+}
+
+// BadgeInfo returns additional badge information, e.g. the exact number of subscribed months.
+func (m *Message) BadgeInfo() map[string]string {
+	return parseBadges(m.Tags[TagBadgeInfo])
+}
+
+// HasBadge reports whether the sender has the given badge.
+func (m *Message) HasBadge(badge string) bool {
+	_, ok := m.Badges()[badge]
+	return ok
+}
+
+// Emotes returns every emote occurrence in the message text.
+func (m *Message) Emotes() []EmoteRange {
+	value := m.Tags[TagEmotes]
+	if value == "" {
+		return nil
+	}
+	var result []EmoteRange
+	for emote := range strings.SplitSeq(value, "/") {
+		id, ranges, ok := strings.Cut(emote, ":")
+		if !ok || id == "" {
+			continue
+		}
+		for r := range strings.SplitSeq(ranges, ",") {
+			startStr, endStr, ok := strings.Cut(r, "-")
+			if !ok {
+				continue
+			}
+			start, err := strconv.Atoi(startStr)
+			if err != nil {
+				continue
+			}
+			end, err := strconv.Atoi(endStr)
+			if err != nil || end < start {
+				continue
+			}
+			result = append(result, EmoteRange{ID: id, Start: start, End: end})
+		}
+	}
+	return result
+}
+
+// Bits returns the amount of bits cheered with this message, 0 if none.
+func (m *Message) Bits() int {
+	return m.tagInt(TagBits)
+}
+
+// DisplayName returns the display name of the sender, falling back to the login name.
+func (m *Message) DisplayName() string {
+	if name := m.Tags[TagDisplayName]; name != "" {
+		return name
+	}
+	return m.Sender
+}
+
+// ID returns the unique id of the message.
+func (m *Message) ID() string {
+	return m.Tags[TagID]
+}
+
+// UserID returns the id of the sender.
+func (m *Message) UserID() string {
+	return m.Tags[TagUserID]
+}
+
+// RoomID returns the id of the channel.
+func (m *Message) RoomID() string {
+	return m.Tags[TagRoomID]
+}
+
+// SentAt returns the time the message was sent by twitch.
+// The zero time is returned if the tag is missing or invalid.
+func (m *Message) SentAt() time.Time {
+	ms, err := strconv.ParseInt(m.Tags[TagTmiSentTs], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// IsBroadcaster reports whether the sender is the broadcaster of the channel.
+func (m *Message) IsBroadcaster() bool {
+	return m.HasBadge(BadgeBroadcaster)
+}
+
+// IsMod reports whether the sender is a moderator of the channel.
+func (m *Message) IsMod() bool {
+	return m.tagFlag(TagMod) || m.HasBadge(BadgeModerator)
+}
+
+// IsSubscriber reports whether the sender is subscribed to the channel.
+func (m *Message) IsSubscriber() bool {
+	if m.tagFlag(TagSubscriber) {
+		return true
+	}
+	badges := m.Badges()
+	_, sub := badges[BadgeSubscriber]
+	_, founder := badges[BadgeFounder]
+	return sub || founder
+}
+
+// IsVIP reports whether the sender is a VIP of the channel.
+func (m *Message) IsVIP() bool {
+	return m.tagFlag(TagVIP) || m.HasBadge(BadgeVIP)
+}
+
+// IsFirstMessage reports whether this is the first message the sender ever sent in the channel.
+func (m *Message) IsFirstMessage() bool {
+	return m.tagFlag(TagFirstMsg)
+}
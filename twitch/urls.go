@@ -7,6 +7,7 @@ const (
 	PubSubURL                = "wss://pubsub-edge.twitch.tv"
 	OAuth2ValidateURL        = "https://id.twitch.tv/oauth2/validate"
 	EventSubSubscriptionsURL = "https://api.twitch.tv/helix/eventsub/subscriptions"
+	RedemptionsURL           = "https://api.twitch.tv/helix/channel_points/custom_rewards/redemptions"
 	// EventSubSubscriptionsURL  = "http://127.0.0.1:8080/eventsub/subscriptions"
 
 	EventSubURL = "wss://eventsub.wss.twitch.tv/ws"
@@ -24,3 +25,7 @@ func QueryUsersURL(values url.Values) string {
 func QuerySubscriptionsURL(values url.Values) string {
 	return EventSubSubscriptionsURL + "?" + values.Encode()
 }
+
+func QueryRedemptionsURL(values url.Values) string {
+	return RedemptionsURL + "?" + values.Encode()
+}